@@ -0,0 +1,274 @@
+// Package acl holds the users allowed to talk to the cluster and what they
+// may do. Users are replicated through the FSM so every node enforces the
+// same rules, secrets are only replicated hashed.
+package acl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"y3cache/glob"
+)
+
+// Perm is a set of command classes.
+type Perm byte
+
+const (
+	// PermRead allows GET, WATCH, stats, subscriptions and the change stream
+	PermRead Perm = 1 << iota
+	// PermWrite allows SET, DEL, INVALIDATE, EXEC, scripts and PUBLISH
+	PermWrite
+	// PermAdmin allows namespace configuration, membership changes and
+	// managing users
+	PermAdmin
+	// PermJoin allows nodes to JOIN
+	PermJoin
+
+	PermAll = PermRead | PermWrite | PermAdmin | PermJoin
+)
+
+var permNames = []struct {
+	perm Perm
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermAdmin, "admin"},
+	{PermJoin, "join"},
+}
+
+func (p Perm) String() string {
+	var names []string
+	for _, n := range permNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePerms parses a comma separated list like "read,write", "all" grants
+// everything.
+func ParsePerms(s string) (Perm, error) {
+	var p Perm
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			p |= PermAll
+			continue
+		}
+		found := false
+		for _, n := range permNames {
+			if n.name == name {
+				p |= n.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return p, nil
+}
+
+type User struct {
+	Name string
+	// Salt and PasswordHash verify the password, see HashPassword
+	Salt         []byte
+	PasswordHash []byte
+	// TokenHash verifies the token, see HashToken
+	TokenHash []byte
+	Perms     Perm
+	// Keys are glob patterns of the keys the user may touch, empty
+	// allows every key
+	Keys []string
+	// Namespaces the user may use, empty allows every namespace
+	Namespaces []string
+}
+
+func (u *User) Can(p Perm) bool {
+	return u.Perms&p == p
+}
+
+// AllKeys tells whether the user is not restricted to some keys.
+func (u *User) AllKeys() bool {
+	if len(u.Keys) == 0 {
+		return true
+	}
+	for _, k := range u.Keys {
+		if k == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) namespace(ns string) bool {
+	if len(u.Namespaces) == 0 {
+		return true
+	}
+	for _, n := range u.Namespaces {
+		if glob.Match(n, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) key(key []byte) bool {
+	if u.AllKeys() {
+		return true
+	}
+	for _, k := range u.Keys {
+		if glob.Match(k, string(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed tells whether the user may run a command of class p on keys of
+// namespace ns. Commands that touch no key known in advance pass no keys
+// and need a user allowed every key.
+func (u *User) Allowed(p Perm, ns string, keys ...[]byte) bool {
+	if !u.Can(p) || !u.namespace(ns) {
+		return false
+	}
+	if keys == nil {
+		return u.AllKeys()
+	}
+	for _, key := range keys {
+		if !u.key(key) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	saltSize   = 16
+	iterations = 4096
+)
+
+// HashPassword returns a random salt and the password stretched with it,
+// PBKDF2 with HMAC-SHA256.
+func HashPassword(password []byte) (salt, hash []byte, err error) {
+	salt = make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	return salt, stretch(password, salt), nil
+}
+
+func stretch(password, salt []byte) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	binary.Write(prf, binary.BigEndian, uint32(1))
+	u := prf.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// HashToken hashes a token, tokens are random enough not to need a salt
+// and are looked up by hash.
+func HashToken(token []byte) []byte {
+	h := sha256.Sum256(token)
+	return h[:]
+}
+
+type Store struct {
+	lock  sync.RWMutex
+	users map[string]*User
+}
+
+func NewStore() *Store {
+	return &Store{users: make(map[string]*User)}
+}
+
+// Enabled tells whether users are defined, until then anyone may run
+// anything.
+func (s *Store) Enabled() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.users) != 0
+}
+
+func (s *Store) Get(name string) (*User, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	u, ok := s.users[name]
+	return u, ok
+}
+
+// Set creates or replaces the user, the store keeps u.
+func (s *Store) Set(u *User) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[u.Name] = u
+}
+
+func (s *Store) Delete(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.users[name]
+	delete(s.users, name)
+	return ok
+}
+
+// Users returns the users sorted by name.
+func (s *Store) Users() []*User {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+func (s *Store) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users = make(map[string]*User)
+}
+
+// Authenticate checks the password of user name, an empty name takes the
+// password as a token.
+func (s *Store) Authenticate(name string, password []byte) (*User, bool) {
+	if name == "" {
+		hash := HashToken(password)
+		for _, u := range s.Users() {
+			if len(u.TokenHash) != 0 && subtle.ConstantTimeCompare(u.TokenHash, hash) == 1 {
+				return u, true
+			}
+		}
+		return nil, false
+	}
+	u, ok := s.Get(name)
+	if !ok || len(u.PasswordHash) == 0 {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare(u.PasswordHash, stretch(password, u.Salt)) != 1 {
+		return nil, false
+	}
+	return u, true
+}
@@ -0,0 +1,55 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowed(t *testing.T) {
+	p, err := ParsePerms("read, write")
+	assert.Nil(t, err)
+	assert.Equal(t, "read,write", p.String())
+	_, err = ParsePerms("read,fly")
+	assert.NotNil(t, err)
+
+	u := &User{Perms: p, Keys: []string{"app:*"}, Namespaces: []string{"default", "app-*"}}
+	assert.True(t, u.Allowed(PermRead, "default", []byte("app:1")))
+	assert.True(t, u.Allowed(PermWrite, "app-eu", []byte("app:1"), []byte("app:2")))
+	assert.False(t, u.Allowed(PermWrite, "default", []byte("app:1"), []byte("other")))
+	assert.False(t, u.Allowed(PermRead, "sessions", []byte("app:1")))
+	assert.False(t, u.Allowed(PermAdmin, "default"))
+	// commands touching unknown keys need every key
+	assert.False(t, u.Allowed(PermWrite, "default"))
+	assert.True(t, u.Allowed(PermWrite, "default", [][]byte{}...))
+
+	all := &User{Perms: PermAll}
+	assert.True(t, all.Allowed(PermAdmin|PermJoin, "any"))
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := NewStore()
+	assert.False(t, s.Enabled())
+	salt, hash, err := HashPassword([]byte("s3cret"))
+	assert.Nil(t, err)
+	s.Set(&User{Name: "app", Salt: salt, PasswordHash: hash})
+	s.Set(&User{Name: "ci", TokenHash: HashToken([]byte("tok"))})
+	assert.True(t, s.Enabled())
+
+	u, ok := s.Authenticate("app", []byte("s3cret"))
+	assert.True(t, ok)
+	assert.Equal(t, "app", u.Name)
+	_, ok = s.Authenticate("app", []byte("wrong"))
+	assert.False(t, ok)
+	_, ok = s.Authenticate("ci", []byte("tok"))
+	assert.False(t, ok, "ci has no password")
+	u, ok = s.Authenticate("", []byte("tok"))
+	assert.True(t, ok)
+	assert.Equal(t, "ci", u.Name)
+	_, ok = s.Authenticate("", []byte("s3cret"))
+	assert.False(t, ok)
+
+	assert.True(t, s.Delete("ci"))
+	assert.False(t, s.Delete("ci"))
+	assert.Len(t, s.Users(), 1)
+}
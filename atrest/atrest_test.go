@@ -0,0 +1,135 @@
+package atrest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyring(t *testing.T, ids ...uint32) *Keyring {
+	k := NewKeyring()
+	for _, id := range ids {
+		key := make([]byte, KeySize)
+		rand.Read(key)
+		if err := k.Add(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return k
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	k1, _ := GenerateKey()
+	k2, _ := GenerateKey()
+	os.WriteFile(path, []byte("# rotated\n2 "+k2+"\n\n1 "+k1+"\n"), 0600)
+	k, err := LoadKeyring(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), k.Active())
+	assert.Equal(t, []uint32{1, 2}, k.IDs())
+
+	os.WriteFile(path, []byte("1 "+base64.StdEncoding.EncodeToString([]byte("short"))+"\n"), 0600)
+	_, err = LoadKeyring(path)
+	assert.NotNil(t, err)
+}
+
+func TestLogStore(t *testing.T) {
+	inner := raft.NewInmemStore()
+	keys := newTestKeyring(t, 1)
+	s := NewLogStore(inner, keys)
+
+	secret := []byte("card=4242")
+	in := &raft.Log{Index: 1, Term: 1, Type: raft.LogCommand, Data: secret}
+	assert.Nil(t, s.StoreLogs([]*raft.Log{in}))
+	assert.Equal(t, secret, in.Data, "the stored log is left alone")
+	raw := &raft.Log{}
+	assert.Nil(t, inner.GetLog(1, raw))
+	assert.False(t, bytes.Contains(raw.Data, secret))
+
+	// after a rotation old entries still open, new ones use the new key
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	assert.Nil(t, keys.Add(2, key))
+	assert.Nil(t, s.StoreLog(&raft.Log{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("b")}))
+	out := &raft.Log{}
+	assert.Nil(t, s.GetLog(1, out))
+	assert.Equal(t, secret, out.Data)
+	assert.Nil(t, s.GetLog(2, out))
+	assert.Equal(t, []byte("b"), out.Data)
+
+	// entries from before encryption are read as they are
+	assert.Nil(t, inner.StoreLog(&raft.Log{Index: 3, Data: []byte{1, 2}}))
+	assert.Nil(t, s.GetLog(3, out))
+	assert.Equal(t, []byte{1, 2}, out.Data)
+
+	// a sealed entry does not open at another index, nor without its key
+	raw.Index = 4
+	assert.Nil(t, inner.StoreLog(raw))
+	assert.ErrorIs(t, s.GetLog(4, out), ErrCorrupted)
+	assert.ErrorIs(t, NewLogStore(inner, newTestKeyring(t, 3)).GetLog(1, out), ErrUnknownKey)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir := t.TempDir()
+	inner, err := raft.NewFileSnapshotStore(dir, 2, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newTestKeyring(t, 1)
+	s := NewSnapshotStore(inner, keys)
+
+	for _, size := range []int{0, 10, chunkSize, 3*chunkSize + 7} {
+		data := bytes.Repeat([]byte("y3cache!"), size/8+1)[:size]
+		sink, err := s.Create(raft.SnapshotVersionMax, uint64(size+1), 1, raft.Configuration{}, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Write(data[:size/2])
+		sink.Write(data[size/2:])
+		assert.Nil(t, sink.Close())
+
+		metas, err := s.List()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), metas[0].Size)
+		meta, rc, err := s.Open(sink.ID())
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), meta.Size)
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	// snapshots from before encryption are read as they are
+	sink, err := inner.Create(raft.SnapshotVersionMax, 1<<40, 1, raft.Configuration{}, 1, nil)
+	assert.Nil(t, err)
+	sink.Write([]byte("plain"))
+	assert.Nil(t, sink.Close())
+	_, rc, err := s.Open(sink.ID())
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "plain", string(got))
+
+	// the file holds no plaintext and a cut snapshot is refused
+	metas, _ := inner.List()
+	path := filepath.Join(dir, "snapshots", metas[1].ID, "state.bin")
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("y3cache!")))
+	aead, _ := keys.get(1)
+	cut := &sealedReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(raw[headerSize : headerSize+chunkSize+aead.Overhead()])),
+		chunks:     chunks{aead: aead, prefix: raw[6:headerSize]},
+		buf:        make([]byte, chunkSize+aead.Overhead()),
+	}
+	_, err = io.ReadAll(cut)
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
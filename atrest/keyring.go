@@ -0,0 +1,148 @@
+// Package atrest encrypts what raft keeps on disk, the log entries and the
+// snapshots, with AES-256-GCM. Every ciphertext names the key it was
+// sealed with so keys can be rotated: new data uses the active key while
+// older keys stay around to read what they sealed.
+package atrest
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const KeySize = 32
+
+var ErrUnknownKey = errors.New("data sealed with a key missing from the keyring")
+
+type Keyring struct {
+	lock   sync.RWMutex
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// Add puts key under id and makes it the active key when id is the highest
+// one, rotating means adding a key with a higher id.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("key %d: want %d bytes, got %d", id, KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("duplicate key id %d", id)
+	}
+	k.keys[id] = aead
+	if len(k.keys) == 1 || id > k.active {
+		k.active = id
+	}
+	return nil
+}
+
+// Active returns the id of the key new data is sealed with.
+func (k *Keyring) Active() uint32 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.active
+}
+
+// IDs returns the ids of the keys, sorted.
+func (k *Keyring) IDs() []uint32 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	ids := make([]uint32, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (k *Keyring) get(id uint32) (cipher.AEAD, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w (id %d)", ErrUnknownKey, id)
+	}
+	return aead, nil
+}
+
+func (k *Keyring) current() (uint32, cipher.AEAD, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	aead, ok := k.keys[k.active]
+	if !ok {
+		return 0, nil, errors.New("the keyring is empty")
+	}
+	return k.active, aead, nil
+}
+
+// LoadKeyring reads a keyring file, one "<id> <base64 key>" per line. Empty
+// lines and lines starting with # are skipped.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k := NewKeyring()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<id> <base64 key>\"", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key id: %s", path, line, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key: %s", path, line, err)
+		}
+		if err := k.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.IDs()) == 0 {
+		return nil, fmt.Errorf("%s holds no key", path)
+	}
+	return k, nil
+}
+
+// GenerateKey returns a random key encoded for a keyring file.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
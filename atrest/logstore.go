@@ -0,0 +1,122 @@
+package atrest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/hashicorp/raft"
+)
+
+// magic starts every sealed log entry, command bytes and msgpack encoded
+// configurations never start with it so entries written before encryption
+// was turned on are still read as they are.
+var magic = []byte{0xe7, 0x01}
+
+var ErrCorrupted = errors.New("sealed data is corrupted")
+
+// LogStore seals the Data and Extensions of the entries it stores in
+// another LogStore, the index, term and type stay in the clear.
+type LogStore struct {
+	raft.LogStore
+	keys *Keyring
+}
+
+func NewLogStore(inner raft.LogStore, keys *Keyring) *LogStore {
+	return &LogStore{LogStore: inner, keys: keys}
+}
+
+// aad binds a sealed field to its entry, moving it to another index fails
+// to open.
+func aad(index uint64, field byte) []byte {
+	buf := make([]byte, 9)
+	binary.BigEndian.PutUint64(buf, index)
+	buf[8] = field
+	return buf
+}
+
+func (s *LogStore) seal(data, ad []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	id, aead, err := s.keys.current()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(magic)+4+aead.NonceSize(), len(magic)+4+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, magic)
+	binary.BigEndian.PutUint32(out[len(magic):], id)
+	nonce := out[len(magic)+4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, ad), nil
+}
+
+func (s *LogStore) open(data, ad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return data, nil
+	}
+	data = data[len(magic):]
+	if len(data) < 4 {
+		return nil, ErrCorrupted
+	}
+	aead, err := s.keys.get(binary.BigEndian.Uint32(data))
+	if err != nil {
+		return nil, err
+	}
+	data = data[4:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrCorrupted
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return plain, nil
+}
+
+func (s *LogStore) sealLog(log *raft.Log) (*raft.Log, error) {
+	sealed := *log
+	var err error
+	if sealed.Data, err = s.seal(log.Data, aad(log.Index, 'd')); err != nil {
+		return nil, err
+	}
+	if sealed.Extensions, err = s.seal(log.Extensions, aad(log.Index, 'e')); err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+func (s *LogStore) GetLog(index uint64, log *raft.Log) error {
+	if err := s.LogStore.GetLog(index, log); err != nil {
+		return err
+	}
+	var err error
+	if log.Data, err = s.open(log.Data, aad(log.Index, 'd')); err != nil {
+		return err
+	}
+	log.Extensions, err = s.open(log.Extensions, aad(log.Index, 'e'))
+	return err
+}
+
+// StoreLog leaves log untouched, raft keeps using it after storing.
+func (s *LogStore) StoreLog(log *raft.Log) error {
+	sealed, err := s.sealLog(log)
+	if err != nil {
+		return err
+	}
+	return s.LogStore.StoreLog(sealed)
+}
+
+func (s *LogStore) StoreLogs(logs []*raft.Log) error {
+	sealed := make([]*raft.Log, len(logs))
+	for i, log := range logs {
+		var err error
+		if sealed[i], err = s.sealLog(log); err != nil {
+			return err
+		}
+	}
+	return s.LogStore.StoreLogs(sealed)
+}
@@ -0,0 +1,222 @@
+package atrest
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+)
+
+// chunkSize is how much of a snapshot is sealed at once. Every chunk but
+// the last one is full, the last one is always written, even empty, so a
+// snapshot cut at a chunk boundary does not go unnoticed.
+const chunkSize = 64 << 10
+
+// header is the magic, the key id and the nonce prefix, chunk nonces are
+// the prefix followed by the chunk number.
+const (
+	prefixSize = 8
+	headerSize = 2 + 4 + prefixSize
+)
+
+// SnapshotStore seals the snapshots it keeps in another SnapshotStore.
+// Sizes are reported in plaintext bytes, raft sends that many when it
+// installs a snapshot on a follower. Snapshots taken before encryption was
+// turned on are read as they are.
+type SnapshotStore struct {
+	inner raft.SnapshotStore
+	keys  *Keyring
+}
+
+func NewSnapshotStore(inner raft.SnapshotStore, keys *Keyring) *SnapshotStore {
+	return &SnapshotStore{inner: inner, keys: keys}
+}
+
+func (s *SnapshotStore) Create(
+	version raft.SnapshotVersion,
+	index, term uint64,
+	configuration raft.Configuration,
+	configurationIndex uint64,
+	trans raft.Transport,
+) (raft.SnapshotSink, error) {
+	id, aead, err := s.keys.current()
+	if err != nil {
+		return nil, err
+	}
+	sink, err := s.inner.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[2:], id)
+	if _, err := rand.Read(header[6:]); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	if _, err := sink.Write(header); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	return &sealedSink{
+		SnapshotSink: sink,
+		chunks:       chunks{aead: aead, prefix: header[6:]},
+		buf:          make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// plainSize is the plaintext size of a sealed snapshot of size bytes.
+func plainSize(size int64) int64 {
+	const overhead = 16
+	size -= headerSize + overhead
+	if size < 0 {
+		return 0
+	}
+	full := size / (chunkSize + overhead)
+	return full*chunkSize + size%(chunkSize+overhead)
+}
+
+func (s *SnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := s.inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range metas {
+		meta.Size = plainSize(meta.Size)
+	}
+	return metas, nil
+}
+
+func (s *SnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.inner.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, header)
+	if !bytes.HasPrefix(header[:n], magic) {
+		// taken before encryption was turned on
+		return meta, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(header[:n]), rc), rc}, nil
+	}
+	if err != nil {
+		rc.Close()
+		return nil, nil, fmt.Errorf("snapshot %s: %w", id, ErrCorrupted)
+	}
+	aead, err := s.keys.get(binary.BigEndian.Uint32(header[2:]))
+	if err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	m := *meta
+	m.Size = plainSize(meta.Size)
+	return &m, &sealedReader{
+		ReadCloser: rc,
+		chunks:     chunks{aead: aead, prefix: header[6:]},
+		buf:        make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+type chunks struct {
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+}
+
+// next returns the nonce and additional data of the next chunk.
+func (c *chunks) next(last bool) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], c.n)
+	c.n++
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	return nonce, ad
+}
+
+type sealedSink struct {
+	raft.SnapshotSink
+	chunks chunks
+	buf    []byte
+}
+
+func (s *sealedSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p, written = p[n:], written+n
+		if len(s.buf) == chunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *sealedSink) flush(last bool) error {
+	nonce, ad := s.chunks.next(last)
+	_, err := s.SnapshotSink.Write(s.chunks.aead.Seal(nil, nonce, s.buf, ad))
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *sealedSink) Close() error {
+	if err := s.flush(true); err != nil {
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	return s.SnapshotSink.Close()
+}
+
+type sealedReader struct {
+	io.ReadCloser
+	chunks chunks
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *sealedReader) fill() error {
+	n, err := io.ReadFull(r.ReadCloser, r.buf)
+	switch {
+	case errors.Is(err, io.EOF):
+		// full chunks are never the last one
+		return fmt.Errorf("snapshot truncated: %w", ErrCorrupted)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		r.done = true
+	case err != nil:
+		return err
+	}
+	nonce, ad := r.chunks.next(r.done)
+	plain, err := r.chunks.aead.Open(nil, nonce, r.buf[:n], ad)
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.plain = plain
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package audit records who changed what as JSON lines, one Entry per
+// mutating or admin command a node handled.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Class groups the audited commands, each class can be turned on alone.
+type Class string
+
+const (
+	// ClassWrite is SET, DEL, INVALIDATE, EXEC and scripts
+	ClassWrite Class = "write"
+	// ClassMembership is JOIN, LEAVE, REMOVE, PROMOTE, DEMOTE and TRANSFER
+	ClassMembership Class = "membership"
+	// ClassACL is AUTH and the changes to users
+	ClassACL Class = "acl"
+	// ClassAdmin is the namespace configuration and FLUSH
+	ClassAdmin Class = "admin"
+)
+
+var classes = []Class{ClassWrite, ClassMembership, ClassACL, ClassAdmin}
+
+// ParseClasses parses a comma separated list of classes, empty is all of
+// them.
+func ParseClasses(s string) ([]Class, error) {
+	var out []Class
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range classes {
+			if string(c) == name {
+				out = append(out, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown audit class %q", name)
+		}
+	}
+	return out, nil
+}
+
+// ValueMode is how written values appear in the log.
+type ValueMode string
+
+const (
+	// ValuesOmit leaves values out, the default
+	ValuesOmit ValueMode = "omit"
+	// ValuesHash logs the sha256 of values
+	ValuesHash ValueMode = "hash"
+	// ValuesFull logs values as they are
+	ValuesFull ValueMode = "full"
+)
+
+func ParseValueMode(s string) (ValueMode, error) {
+	switch m := ValueMode(s); m {
+	case "":
+		return ValuesOmit, nil
+	case ValuesOmit, ValuesHash, ValuesFull:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown audit value mode %q", s)
+}
+
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Class   Class     `json:"class"`
+	Command string    `json:"command"`
+	// Principal is the user or certificate identity of the connection,
+	// empty for anonymous ones
+	Principal string   `json:"principal,omitempty"`
+	Remote    string   `json:"remote,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	// Target is the node or user the command is about, or the tags of
+	// INVALIDATE
+	Target string `json:"target,omitempty"`
+	Status string `json:"status"`
+	// Index is the raft index the change was committed at, zero when
+	// nothing was committed
+	Index uint64 `json:"index,omitempty"`
+}
+
+type Options struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	// Classes are the audited classes, empty audits every class
+	Classes []Class
+	// HashKeys logs the sha256 of keys instead of the keys
+	HashKeys bool
+	Values   ValueMode
+}
+
+// Logger writes entries to a RotatingFile. A nil Logger audits nothing.
+type Logger struct {
+	opts    Options
+	classes map[Class]bool
+	file    *RotatingFile
+}
+
+func New(opts Options) (*Logger, error) {
+	f, err := OpenRotatingFile(opts.Path, opts.MaxSize, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l := &Logger{opts: opts, classes: make(map[Class]bool), file: f}
+	if len(opts.Classes) == 0 {
+		opts.Classes = classes
+	}
+	for _, c := range opts.Classes {
+		l.classes[c] = true
+	}
+	return l, nil
+}
+
+func (l *Logger) Enabled(c Class) bool {
+	return l != nil && l.classes[c]
+}
+
+func hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// Key is key as it should be logged.
+func (l *Logger) Key(key []byte) string {
+	if l.opts.HashKeys {
+		return hash(key)
+	}
+	return string(key)
+}
+
+// Value is value as it should be logged, empty when values are omitted.
+func (l *Logger) Value(value []byte) string {
+	switch l.opts.Values {
+	case ValuesFull:
+		return string(value)
+	case ValuesHash:
+		return hash(value)
+	}
+	return ""
+}
+
+// Log appends e when its class is audited, one JSON object per line.
+func (l *Logger) Log(e Entry) error {
+	if !l.Enabled(e.Class) {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
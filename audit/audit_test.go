@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(Options{
+		Path:     path,
+		Classes:  []Class{ClassWrite, ClassACL},
+		HashKeys: true,
+		Values:   ValuesHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, l.Log(Entry{
+		Class:   ClassWrite,
+		Command: "SET",
+		Keys:    []string{l.Key([]byte("user:1"))},
+		Value:   l.Value([]byte("secret")),
+		Status:  "OK",
+		Index:   7,
+	}))
+	assert.Nil(t, l.Log(Entry{Class: ClassMembership, Command: "JOIN"}))
+	assert.Nil(t, l.Close())
+
+	entries := readEntries(t, path)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(7), entries[0].Index)
+	assert.True(t, strings.HasPrefix(entries[0].Keys[0], "sha256:"))
+	assert.NotContains(t, entries[0].Value, "secret")
+	assert.False(t, entries[0].Time.IsZero())
+
+	var nop *Logger
+	assert.False(t, nop.Enabled(ClassWrite))
+	assert.Nil(t, nop.Log(Entry{Class: ClassWrite}))
+
+	_, err = ParseClasses("write,nope")
+	assert.NotNil(t, err)
+	mode, err := ParseValueMode("")
+	assert.Nil(t, err)
+	assert.Equal(t, ValuesOmit, mode)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, f.Close())
+
+	read := func(p string) string {
+		b, _ := os.ReadFile(p)
+		return string(b)
+	}
+	assert.Equal(t, "four\nfive\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// reopening counts what the current file already holds
+	f, err = OpenRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+	f.Write([]byte("six\n"))
+	f.Close()
+	assert.Equal(t, "six\n", read(path))
+	assert.Equal(t, "four\nfive\n", read(path+".1"))
+	assert.Equal(t, "three\n", read(path+".2"))
+}
@@ -1,58 +1,477 @@
 package cache
 
 import (
+	"container/heap"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
+var ErrFull = errors.New("namespace is full")
+
+type EvictionPolicy byte
+
+// Only write order and TTLs decide evictions: reads are served locally and
+// never reach the raft log, so a read based LRU would evict different keys
+// on every replica.
+const (
+	// NoEviction refuses writes once a limit is reached
+	NoEviction EvictionPolicy = iota
+	// EvictOldest evicts the least recently written keys
+	EvictOldest
+	// EvictVolatileTTL evicts the keys closest to expiring, keys without
+	// a TTL are never evicted
+	EvictVolatileTTL
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictOldest:
+		return "oldest"
+	case EvictVolatileTTL:
+		return "volatile-ttl"
+	default:
+		return "noeviction"
+	}
+}
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "", "noeviction":
+		return NoEviction, nil
+	case "oldest":
+		return EvictOldest, nil
+	case "volatile-ttl":
+		return EvictVolatileTTL, nil
+	}
+	return NoEviction, fmt.Errorf("unknown eviction policy %q", s)
+}
+
+// Limits of a keyspace, zero means unlimited. Memory counts the bytes of
+// keys and values.
+type Limits struct {
+	MaxMemory  int64
+	MaxKeys    int64
+	DefaultTTL time.Duration
+	Policy     EvictionPolicy
+}
+
+// Validate refuses an unknown policy and negative limits, nothing would
+// ever fit them.
+func (l Limits) Validate() error {
+	switch {
+	case l.MaxMemory < 0:
+		return fmt.Errorf("negative max memory %d", l.MaxMemory)
+	case l.MaxKeys < 0:
+		return fmt.Errorf("negative max keys %d", l.MaxKeys)
+	case l.DefaultTTL < 0:
+		return fmt.Errorf("negative default ttl %s", l.DefaultTTL)
+	case l.Policy > EvictVolatileTTL:
+		return fmt.Errorf("unknown eviction policy %d", l.Policy)
+	}
+	return nil
+}
+
+type Stats struct {
+	Keys        int64
+	Bytes       int64
+	Evictions   uint64
+	Expirations uint64
+}
+
+type entry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+	version   uint64
+	tags      []string
+	// position in the eviction queues, -1 when not in one
+	slots [2]int
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
 type Cache struct {
-	lock sync.RWMutex
-	data map[string][]byte
+	lock        sync.RWMutex
+	data        map[string]*entry
+	tags        map[string]map[string]struct{}
+	oldest      evictionQueue
+	volatile    evictionQueue
+	limits      Limits
+	bytes       int64
+	evictions   uint64
+	expirations uint64
 }
 
 func New() *Cache {
 	return &Cache{
-		data: make(map[string][]byte),
+		data:     make(map[string]*entry),
+		tags:     make(map[string]map[string]struct{}),
+		oldest:   evictionQueue{slot: oldestSlot},
+		volatile: evictionQueue{slot: volatileSlot},
 	}
 }
 
 func (c *Cache) Delete(key []byte) error {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-	delete(c.data, string(key))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(string(key))
 	return nil
 }
 
+// remove must be called with the lock held.
+func (c *Cache) remove(key string) {
+	if e, ok := c.data[key]; ok {
+		c.bytes -= entrySize(key, e.value)
+		c.untag(key, e)
+		c.unindex(e)
+		delete(c.data, key)
+	}
+}
+
+// untag drops key from the index of each of its tags, must be called with
+// the lock held.
+func (c *Cache) untag(key string, e *entry) {
+	for _, tag := range e.tags {
+		keys := c.tags[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	e.tags = nil
+}
+
 func (c *Cache) Has(key []byte) bool {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	_, ok := c.data[string(key)]
-	return ok
+	e, ok := c.data[string(key)]
+	return ok && !e.expired(time.Now())
 }
 
 func (c *Cache) Get(key []byte) ([]byte, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	keyStr := string(key)
-	val, ok := c.data[keyStr]
-	if !ok {
+	e, ok := c.data[keyStr]
+	if !ok || e.expired(time.Now()) {
 		return nil, fmt.Errorf("key (%s) not found", keyStr)
 	}
-	// log.Printf("[CACHE] GET %s = %s\n", string(key), string(val))
-	return val, nil
+	return e.value, nil
 }
 
+// Lookup returns key even if its TTL elapsed, as long as it was not
+// expired yet. Reads that must agree on every replica use it instead of Get.
+func (c *Cache) Lookup(key []byte) ([]byte, time.Time, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	e, ok := c.data[string(key)]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return e.value, e.expiresAt, true
+}
+
+// Set stores value under key. A positive ttl makes the key invisible to
+// readers once it elapses; the key itself is only removed by Expire so that
+// every replica drops it at the same point in the raft log.
 func (c *Cache) Set(key, value []byte, ttl time.Duration) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.data[string(key)] = value
-	// fmt.Println(ttl)
+	var expiresAt time.Time
 	if ttl > 0 {
-		go func() {
-			<-time.After(ttl)
-			delete(c.data, string(key))
-		}()
+		expiresAt = time.Now().Add(ttl)
 	}
+	return c.SetUntil(key, value, expiresAt)
+}
+
+// SetUntil is Set with an absolute deadline, the FSM uses it so that every
+// replica stores the exact same deadline. A zero expiresAt never expires.
+// The tags of a previous value are dropped.
+func (c *Cache) SetUntil(key, value []byte, expiresAt time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := string(key)
+	c.remove(k)
+	e := &entry{key: k, value: value, expiresAt: expiresAt}
+	c.data[k] = e
+	c.index(e)
+	c.bytes += entrySize(k, value)
 	return nil
 }
+
+// Version returns the version stamped on key by SetVersion, or zero when
+// the key does not exist. Expired keys keep their version until Expire.
+func (c *Cache) Version(key []byte) uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	e, ok := c.data[string(key)]
+	if !ok {
+		return 0
+	}
+	return e.version
+}
+
+// SetVersion stamps an existing key with version, the FSM uses the raft
+// index of the write so versions agree on every replica.
+func (c *Cache) SetVersion(key []byte, version uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.data[string(key)]; ok {
+		e.version = version
+		c.reindex(e)
+	}
+}
+
+// SetTags replaces the tags of an existing key.
+func (c *Cache) SetTags(key []byte, tags [][]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := string(key)
+	e, ok := c.data[k]
+	if !ok {
+		return
+	}
+	c.untag(k, e)
+	for _, tag := range tags {
+		t := string(tag)
+		keys, ok := c.tags[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[t] = keys
+		}
+		if _, ok := keys[k]; ok {
+			continue
+		}
+		keys[k] = struct{}{}
+		e.tags = append(e.tags, t)
+	}
+}
+
+// Tags returns the tags of key.
+func (c *Cache) Tags(key []byte) [][]byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	e, ok := c.data[string(key)]
+	if !ok {
+		return nil
+	}
+	return toBytes(e.tags)
+}
+
+// TaggedKeys returns, sorted, the keys carrying any of tags, expired ones
+// included.
+func (c *Cache) TaggedKeys(tags ...[]byte) [][]byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, tag := range tags {
+		for k := range c.tags[string(tag)] {
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return toBytes(keys)
+}
+
+func toBytes(list []string) [][]byte {
+	if len(list) == 0 {
+		return nil
+	}
+	out := make([][]byte, len(list))
+	for i, s := range list {
+		out[i] = []byte(s)
+	}
+	return out
+}
+
+// Expire removes key if its TTL had elapsed at now and reports whether it
+// did.
+func (c *Cache) Expire(key []byte, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.data[string(key)]
+	if !ok || !e.expired(now) {
+		return false
+	}
+	c.remove(string(key))
+	c.expirations++
+	return true
+}
+
+// ExpiredKeys returns up to max keys whose TTL has elapsed but which are
+// still waiting for an Expire.
+func (c *Cache) ExpiredKeys(max int) [][]byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	now := time.Now()
+	var keys [][]byte
+	for k, e := range c.data {
+		if len(keys) >= max {
+			break
+		}
+		if e.expired(now) {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys
+}
+
+func (c *Cache) Limits() Limits {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.limits
+}
+
+// SetLimits replaces the limits, call MakeRoom(nil, 0) afterwards to evict
+// down to lower limits.
+func (c *Cache) SetLimits(l Limits) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.limits = l
+}
+
+func (c *Cache) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return Stats{
+		Keys:        int64(len(c.data)),
+		Bytes:       c.bytes,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+	}
+}
+
+// Change is a key written by a batch, Size is the length of the value
+// stored or Delete when the key is removed.
+type Change struct {
+	Key    []byte
+	Size   int
+	Delete bool
+}
+
+// MakeRoom evicts keys, following the eviction policy, until storing a
+// value of size under key fits the limits and returns the evicted keys.
+// It evicts nothing and returns ErrFull when that is not possible.
+func (c *Cache) MakeRoom(key []byte, size int) ([][]byte, error) {
+	if key == nil {
+		return c.MakeRoomFor(nil)
+	}
+	return c.MakeRoomFor([]Change{{Key: key, Size: size}})
+}
+
+// MakeRoomFor is MakeRoom for a batch of changes applied in order: it
+// evicts until the state after the whole batch fits the limits, never
+// one of the keys of the batch.
+func (c *Cache) MakeRoomFor(changes []Change) ([][]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys, bytes := int64(len(c.data)), c.bytes
+	// the size of each key of the batch once it ran, -1 when removed
+	final := make(map[string]int64, len(changes))
+	for _, ch := range changes {
+		k := string(ch.Key)
+		if ch.Delete {
+			final[k] = -1
+		} else {
+			final[k] = int64(len(k) + ch.Size)
+		}
+	}
+	for k, size := range final {
+		if e, ok := c.data[k]; ok {
+			keys--
+			bytes -= entrySize(k, e.value)
+		}
+		if size >= 0 {
+			keys++
+			bytes += size
+		}
+	}
+	fits := func() bool {
+		return (c.limits.MaxKeys == 0 || keys <= c.limits.MaxKeys) &&
+			(c.limits.MaxMemory == 0 || bytes <= c.limits.MaxMemory)
+	}
+	if fits() {
+		return nil, nil
+	}
+	if c.limits.Policy == NoEviction {
+		return nil, ErrFull
+	}
+	// pop the victims in eviction order, the popped entries go back in
+	// the queue whether they are evicted or not, remove takes them out
+	q := c.queue()
+	var popped, victims []*entry
+	for !fits() && q.Len() > 0 {
+		e := heap.Pop(q).(*entry)
+		popped = append(popped, e)
+		if _, ok := final[e.key]; ok {
+			continue
+		}
+		victims = append(victims, e)
+		keys--
+		bytes -= entrySize(e.key, e.value)
+	}
+	for _, e := range popped {
+		heap.Push(q, e)
+	}
+	if !fits() {
+		return nil, ErrFull
+	}
+	evicted := make([][]byte, len(victims))
+	for i, e := range victims {
+		c.remove(e.key)
+		c.evictions++
+		evicted[i] = []byte(e.key)
+	}
+	return evicted, nil
+}
+
+// Flush removes every key and returns how many there were.
+func (c *Cache) Flush() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.data)
+	c.data = make(map[string]*entry)
+	c.tags = make(map[string]map[string]struct{})
+	c.oldest.reset()
+	c.volatile.reset()
+	c.bytes = 0
+	return n
+}
+
+type Item struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt time.Time
+	Version   uint64
+	Tags      [][]byte
+}
+
+// Items returns a copy of every key, including the expired ones still
+// waiting for an Expire.
+func (c *Cache) Items() []Item {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	items := make([]Item, 0, len(c.data))
+	for k, e := range c.data {
+		items = append(items, Item{
+			Key:       []byte(k),
+			Value:     e.value,
+			ExpiresAt: e.expiresAt,
+			Version:   e.version,
+			Tags:      toBytes(e.tags),
+		})
+	}
+	return items
+}
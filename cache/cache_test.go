@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func set(c *Cache, key string, version uint64, expiresAt time.Time) {
+	c.SetUntil([]byte(key), []byte("v"), expiresAt)
+	c.SetVersion([]byte(key), version)
+}
+
+func keys(list ...string) [][]byte {
+	return toBytes(list)
+}
+
+func TestEvictionOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New()
+	set(c, "a", 1, time.Time{})
+	set(c, "b", 2, now.Add(time.Minute))
+	set(c, "c", 3, now.Add(time.Second))
+	set(c, "d", 4, time.Time{})
+	// rewriting a makes it the newest
+	set(c, "a", 5, time.Time{})
+
+	c.SetLimits(Limits{MaxKeys: 3, Policy: EvictOldest})
+	evicted, err := c.MakeRoom(nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, keys("b"), evicted)
+
+	// the keys of the batch are never evicted, c is the oldest one left
+	c.SetLimits(Limits{MaxKeys: 2, Policy: EvictOldest})
+	evicted, err = c.MakeRoomFor([]Change{{Key: []byte("c"), Size: 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, keys("d"), evicted)
+	assert.NotZero(t, c.Version([]byte("c")))
+
+	// the closest deadline goes first whatever the version, keys without a
+	// TTL are never volatile
+	set(c, "e", 6, now)
+	c.SetLimits(Limits{MaxKeys: 2, Policy: EvictVolatileTTL})
+	evicted, err = c.MakeRoom(nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, keys("e"), evicted)
+	c.SetLimits(Limits{MaxKeys: 1, Policy: EvictVolatileTTL})
+	_, err = c.MakeRoom([]byte("h"), 1)
+	assert.Equal(t, ErrFull, err)
+	assert.Equal(t, int64(2), c.Stats().Keys)
+
+	// flushed keys leave the queues
+	c.Flush()
+	set(c, "f", 7, time.Time{})
+	c.SetLimits(Limits{MaxKeys: 1, Policy: EvictOldest})
+	evicted, err = c.MakeRoom([]byte("g"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, keys("f"), evicted)
+}
+
+func TestValidateLimits(t *testing.T) {
+	assert.Nil(t, Limits{MaxKeys: 10, Policy: EvictVolatileTTL}.Validate())
+	assert.NotNil(t, Limits{Policy: EvictVolatileTTL + 1}.Validate())
+	assert.NotNil(t, Limits{MaxKeys: -1}.Validate())
+	assert.NotNil(t, Limits{MaxMemory: -1}.Validate())
+	assert.NotNil(t, Limits{DefaultTTL: -time.Second}.Validate())
+}
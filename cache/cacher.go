@@ -4,7 +4,23 @@ import "time"
 
 type Cacher interface {
 	Set([]byte, []byte, time.Duration) error
+	SetUntil([]byte, []byte, time.Time) error
 	Has([]byte) bool
 	Get([]byte) ([]byte, error)
+	Lookup([]byte) ([]byte, time.Time, bool)
 	Delete([]byte) error
+	Version([]byte) uint64
+	SetVersion([]byte, uint64)
+	SetTags([]byte, [][]byte)
+	Tags([]byte) [][]byte
+	TaggedKeys(...[]byte) [][]byte
+	Expire([]byte, time.Time) bool
+	ExpiredKeys(int) [][]byte
+	Items() []Item
+	Limits() Limits
+	SetLimits(Limits)
+	Stats() Stats
+	MakeRoom([]byte, int) ([][]byte, error)
+	MakeRoomFor([]Change) ([][]byte, error)
+	Flush() int
 }
@@ -0,0 +1,97 @@
+package cache
+
+import "container/heap"
+
+// slots of an entry in the eviction queues
+const (
+	oldestSlot = iota
+	volatileSlot
+)
+
+// evictionQueue is a heap of the entries in the eviction order of one
+// policy, kept up to date on every write so making room never sorts the
+// keyspace. The order only depends on replicated state: the deadline for
+// volatile, then the version, then the key.
+type evictionQueue struct {
+	slot    int
+	entries []*entry
+}
+
+func (q *evictionQueue) Len() int { return len(q.entries) }
+
+func (q *evictionQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if q.slot == volatileSlot && !a.expiresAt.Equal(b.expiresAt) {
+		return a.expiresAt.Before(b.expiresAt)
+	}
+	if a.version != b.version {
+		return a.version < b.version
+	}
+	return a.key < b.key
+}
+
+func (q *evictionQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].slots[q.slot] = i
+	q.entries[j].slots[q.slot] = j
+}
+
+func (q *evictionQueue) Push(x any) {
+	e := x.(*entry)
+	e.slots[q.slot] = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *evictionQueue) Pop() any {
+	n := len(q.entries) - 1
+	e := q.entries[n]
+	q.entries[n] = nil
+	q.entries = q.entries[:n]
+	e.slots[q.slot] = -1
+	return e
+}
+
+func (q *evictionQueue) reset() {
+	q.entries = nil
+}
+
+// queue returns the eviction queue of the policy, must be called with the
+// lock held.
+func (c *Cache) queue() *evictionQueue {
+	if c.limits.Policy == EvictVolatileTTL {
+		return &c.volatile
+	}
+	return &c.oldest
+}
+
+// index adds e to the eviction queues, keys without a TTL are never
+// volatile. Must be called with the lock held.
+func (c *Cache) index(e *entry) {
+	e.slots = [2]int{-1, -1}
+	heap.Push(&c.oldest, e)
+	if !e.expiresAt.IsZero() {
+		heap.Push(&c.volatile, e)
+	}
+}
+
+// unindex drops e from the eviction queues, must be called with the lock
+// held.
+func (c *Cache) unindex(e *entry) {
+	if i := e.slots[oldestSlot]; i >= 0 {
+		heap.Remove(&c.oldest, i)
+	}
+	if i := e.slots[volatileSlot]; i >= 0 {
+		heap.Remove(&c.volatile, i)
+	}
+}
+
+// reindex moves e after its version changed, must be called with the lock
+// held.
+func (c *Cache) reindex(e *entry) {
+	if i := e.slots[oldestSlot]; i >= 0 {
+		heap.Fix(&c.oldest, i)
+	}
+	if i := e.slots[volatileSlot]; i >= 0 {
+		heap.Fix(&c.volatile, i)
+	}
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultNamespace holds the keys of connections that never selected a
+// namespace, it always exists.
+const DefaultNamespace = "default"
+
+// Namespaces keeps one keyspace, with its own limits, per namespace.
+type Namespaces struct {
+	lock   sync.RWMutex
+	spaces map[string]*Cache
+}
+
+func NewNamespaces() *Namespaces {
+	n := &Namespaces{}
+	n.Reset()
+	return n
+}
+
+// Get returns the keyspace of name without creating it, reads use it so
+// that only the FSM creates namespaces.
+func (n *Namespaces) Get(name string) (*Cache, bool) {
+	if name == "" {
+		name = DefaultNamespace
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	c, ok := n.spaces[name]
+	return c, ok
+}
+
+// GetOrCreate returns the keyspace of name, creating it without limits
+// when missing.
+func (n *Namespaces) GetOrCreate(name string) *Cache {
+	if name == "" {
+		name = DefaultNamespace
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	c, ok := n.spaces[name]
+	if !ok {
+		c = New()
+		n.spaces[name] = c
+	}
+	return c
+}
+
+func (n *Namespaces) Default() *Cache {
+	return n.GetOrCreate(DefaultNamespace)
+}
+
+// Names returns the namespaces in sorted order.
+func (n *Namespaces) Names() []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	names := make([]string, 0, len(n.spaces))
+	for name := range n.spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reset drops every namespace and leaves an empty default one.
+func (n *Namespaces) Reset() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.spaces = map[string]*Cache{DefaultNamespace: New()}
+}
@@ -0,0 +1,245 @@
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/raft"
+
+	"y3cache/cache"
+	"y3cache/fsm"
+	"y3cache/proto"
+)
+
+const (
+	liveBuffer = 1024
+	// pruneEvery is how many changes are recorded between two checks for
+	// compacted entries
+	pruneEvery = 1024
+)
+
+var (
+	ErrLagged = errors.New("consumer fell behind, resume from the last index received")
+	ErrClosed = errors.New("stream closed")
+)
+
+// Hub serves change streams of the writes applied by the FSM, live ones
+// come from the FSM hook.
+//
+// History is kept for every index still in the raft log store, as the
+// changes the FSM actually made: decoding the log entries again would miss
+// evictions, aborted transactions and the writes of scripts, which all
+// depend on the state the entry ran against. Raft replays the log into the
+// FSM on restart, which rebuilds the history, so a consumer can resume from
+// any index that was not compacted. The entries before a restored snapshot
+// are not replayed, history before floor counts as compacted.
+type Hub struct {
+	lock      sync.Mutex
+	lastIndex uint64
+	logs      raft.LogStore
+	spaces    *cache.Namespaces
+	streams   map[*Stream]struct{}
+	history   map[uint64][]*proto.Change
+	recorded  int
+	restored  bool
+	floor     uint64
+}
+
+func NewHub(logs raft.LogStore, spaces *cache.Namespaces) *Hub {
+	return &Hub{
+		logs:    logs,
+		spaces:  spaces,
+		streams: make(map[*Stream]struct{}),
+		history: make(map[uint64][]*proto.Change),
+	}
+}
+
+// Notify is the fsm.Hook feeding the live part of every open stream.
+func (h *Hub) Notify(ev fsm.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if ev.Type == fsm.EventRestore {
+		h.restored = true
+		return
+	}
+	if h.restored {
+		h.restored, h.floor = false, ev.Index
+	}
+	if ev.Index > h.lastIndex {
+		h.lastIndex = ev.Index
+	}
+	c := changeFromEvent(ev)
+	if c == nil {
+		return
+	}
+	h.history[ev.Index] = append(h.history[ev.Index], c)
+	if h.recorded++; h.recorded%pruneEvery == 0 {
+		h.prune()
+	}
+	for s := range h.streams {
+		select {
+		case s.live <- c:
+		default:
+			delete(h.streams, s)
+			close(s.live)
+		}
+	}
+}
+
+// Open starts a stream at from. When from is zero or was already compacted
+// the stream starts with a snapshot of the cache instead. Changes already
+// reflected by that snapshot may be repeated right after it, replaying them
+// is idempotent.
+func (h *Hub) Open(from uint64) (*Stream, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	first, err := h.prune()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first log index: %s", err)
+	}
+	s := &Stream{
+		hub:   h,
+		from:  from,
+		next:  from,
+		until: h.lastIndex,
+		live:  make(chan *proto.Change, liveBuffer),
+		done:  make(chan struct{}),
+	}
+	if from == 0 || from < first || from < h.floor ||
+		(first == 0 && from <= h.lastIndex) {
+		s.pending = h.snapshot()
+		s.from, s.next = h.lastIndex+1, h.lastIndex+1
+	}
+	h.streams[s] = struct{}{}
+	return s, nil
+}
+
+// prune drops the history of compacted entries and returns the first index
+// still in the log store. Must be called with the lock held.
+func (h *Hub) prune() (uint64, error) {
+	first, err := h.logs.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	for idx := range h.history {
+		if idx < first {
+			delete(h.history, idx)
+		}
+	}
+	return first, nil
+}
+
+func (h *Hub) snapshot() []*proto.Change {
+	changes := []*proto.Change{{
+		Type:  proto.ChangeResnapshot,
+		Index: h.lastIndex,
+	}}
+	for _, name := range h.spaces.Names() {
+		c, _ := h.spaces.Get(name)
+		for _, it := range c.Items() {
+			ch := &proto.Change{
+				Type:      proto.ChangeSnapshotItem,
+				Index:     h.lastIndex,
+				Namespace: []byte(name),
+				Key:       it.Key,
+				Value:     it.Value,
+			}
+			if !it.ExpiresAt.IsZero() {
+				ch.ExpiresAt = it.ExpiresAt.UnixNano()
+			}
+			changes = append(changes, ch)
+		}
+	}
+	return append(changes, &proto.Change{
+		Type:  proto.ChangeSnapshotDone,
+		Index: h.lastIndex,
+	})
+}
+
+type Stream struct {
+	hub     *Hub
+	pending []*proto.Change
+	// from is the first index delivered, next..until is the part of the
+	// history still to be sent
+	from, next, until uint64
+	live              chan *proto.Change
+	done              chan struct{}
+	closeOnce         sync.Once
+}
+
+// Next blocks until the next change is available. It returns ErrLagged
+// when the consumer did not keep up with the live changes.
+func (s *Stream) Next() (*proto.Change, error) {
+	for {
+		if len(s.pending) > 0 {
+			c := s.pending[0]
+			s.pending = s.pending[1:]
+			return c, nil
+		}
+		if s.next <= s.until {
+			s.pending = s.hub.historyBetween(s.next, s.until)
+			s.next = s.until + 1
+			continue
+		}
+		select {
+		case c, ok := <-s.live:
+			if !ok {
+				return nil, ErrLagged
+			}
+			if c.Index < s.from || c.Index <= s.until {
+				continue
+			}
+			return c, nil
+		case <-s.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// historyBetween returns the recorded changes of the indexes from..until in
+// order.
+func (h *Hub) historyBetween(from, until uint64) []*proto.Change {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var changes []*proto.Change
+	for idx := from; idx <= until; idx++ {
+		changes = append(changes, h.history[idx]...)
+	}
+	return changes
+}
+
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		s.hub.lock.Lock()
+		delete(s.hub.streams, s)
+		s.hub.lock.Unlock()
+		close(s.done)
+	})
+}
+
+func changeFromEvent(ev fsm.Event) *proto.Change {
+	c := &proto.Change{
+		Index:     ev.Index,
+		Namespace: []byte(ev.Namespace),
+		Key:       ev.Key,
+	}
+	switch ev.Type {
+	case fsm.EventSet:
+		c.Type, c.Value = proto.ChangeSet, ev.Value
+		if !ev.ExpiresAt.IsZero() {
+			c.ExpiresAt = ev.ExpiresAt.UnixNano()
+		}
+	case fsm.EventDel:
+		c.Type = proto.ChangeDel
+	case fsm.EventExpire:
+		c.Type = proto.ChangeExpire
+	case fsm.EventEvict:
+		c.Type = proto.ChangeEvict
+	case fsm.EventFlush:
+		c.Type = proto.ChangeFlush
+	default:
+		return nil
+	}
+	return c
+}
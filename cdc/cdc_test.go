@@ -0,0 +1,91 @@
+package cdc
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+
+	"y3cache/acl"
+	"y3cache/cache"
+	"y3cache/cluster"
+	"y3cache/fsm"
+	"y3cache/proto"
+)
+
+func apply(t *testing.T, logs raft.LogStore, f raft.FSM, index uint64, cmd interface{ Bytes() []byte }) {
+	l := &raft.Log{Index: index, Type: raft.LogCommand, Data: cmd.Bytes()}
+	assert.Nil(t, logs.StoreLog(l))
+	f.Apply(l)
+}
+
+func setup() (raft.LogStore, *Hub, raft.FSM) {
+	logs, spaces := raft.NewInmemStore(), cache.NewNamespaces()
+	h := NewHub(logs, spaces)
+	return logs, h, fsm.NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil, h.Notify)
+}
+
+func TestResume(t *testing.T) {
+	logs, h, f := setup()
+	apply(t, logs, f, 1, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+	apply(t, logs, f, 2, &proto.CommandSet{Key: []byte("b"), Value: []byte("2")})
+
+	s, err := h.Open(2)
+	assert.Nil(t, err)
+	defer s.Close()
+	apply(t, logs, f, 3, &proto.CommandSet{Key: []byte("c"), Value: []byte("3")})
+
+	for _, want := range []uint64{2, 3} {
+		ch, err := s.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, proto.ChangeSet, ch.Type)
+		assert.Equal(t, want, ch.Index)
+	}
+}
+
+func TestHistoryOnlyHasAppliedChanges(t *testing.T) {
+	logs, h, f := setup()
+	apply(t, logs, f, 1, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+	// aborted, a is at version 1
+	apply(t, logs, f, 2, &proto.CommandExec{
+		Watches: []proto.WatchedKey{{Key: []byte("a"), Version: 7}},
+		Ops:     []any{&proto.CommandDel{Key: []byte("a")}},
+	})
+	apply(t, logs, f, 3, &proto.CommandEval{Script: []byte(`(set "b" (get "a"))`)})
+
+	s, err := h.Open(1)
+	assert.Nil(t, err)
+	defer s.Close()
+	for _, want := range []string{"a", "b"} {
+		ch, err := s.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, proto.ChangeSet, ch.Type)
+		assert.Equal(t, want, string(ch.Key))
+		assert.Equal(t, "1", string(ch.Value))
+	}
+}
+
+func TestResnapshot(t *testing.T) {
+	logs, h, f := setup()
+	apply(t, logs, f, 1, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+	apply(t, logs, f, 2, &proto.CommandSet{Key: []byte("b"), Value: []byte("2")})
+	assert.Nil(t, logs.DeleteRange(1, 1))
+
+	s, err := h.Open(1)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	var types []proto.ChangeType
+	for i := 0; i < 4; i++ {
+		ch, err := s.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), ch.Index)
+		types = append(types, ch.Type)
+	}
+	assert.Equal(t, []proto.ChangeType{
+		proto.ChangeResnapshot,
+		proto.ChangeSnapshotItem,
+		proto.ChangeSnapshotItem,
+		proto.ChangeSnapshotDone,
+	}, types)
+}
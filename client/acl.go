@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"y3cache/acl"
+	"y3cache/proto"
+)
+
+// ErrUnauthorized is returned for a failed AUTH and for commands the
+// authenticated user is not allowed to run.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// UserOptions define a user, it authenticates with Password, Token or
+// both. Empty Keys (glob patterns) or Namespaces allow all of them.
+type UserOptions struct {
+	Password   string
+	Token      string
+	Perms      acl.Perm
+	Keys       []string
+	Namespaces []string
+}
+
+type User struct {
+	Name       string
+	Perms      acl.Perm
+	Keys       []string
+	Namespaces []string
+}
+
+// Auth authenticates the connection as user, the connections the client
+// opens later use Options instead.
+func (c *Client) Auth(ctx context.Context, user, password string) error {
+	return auth(c.conn, user, password)
+}
+
+// AuthToken authenticates the connection with a token.
+func (c *Client) AuthToken(ctx context.Context, token string) error {
+	return auth(c.conn, "", token)
+}
+
+func auth(conn net.Conn, user, password string) error {
+	cmd := &proto.CommandAuth{Username: []byte(user), Password: []byte(password)}
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		return err
+	}
+	resp, err := proto.ParseStatusResponse(conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status == proto.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return nil
+}
+
+// SetUser creates or replaces user name. Until the first user is created
+// anyone may do anything, it must have acl.PermAdmin.
+func (c *Client) SetUser(ctx context.Context, name string, opts UserOptions) error {
+	return c.status(ctx, &proto.CommandACLSetUser{
+		Username: []byte(name),
+		Password: []byte(opts.Password),
+		Token:    []byte(opts.Token),
+		Rule: proto.ACLRule{
+			Perms:      byte(opts.Perms),
+			Keys:       toBytes(opts.Keys),
+			Namespaces: toBytes(opts.Namespaces),
+		},
+	})
+}
+
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	return c.status(ctx, &proto.CommandACLDelUser{Username: []byte(name)})
+}
+
+// Users lists the users sorted by name.
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	cmd := &proto.CommandACLList{}
+	if err := c.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseACLListResponse(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == proto.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	if resp.Status != proto.StatusOK {
+		return nil, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	users := make([]User, len(resp.Users))
+	for i, u := range resp.Users {
+		users[i] = User{
+			Name:       string(u.Username),
+			Perms:      acl.Perm(u.Rule.Perms),
+			Keys:       toStrings(u.Rule.Keys),
+			Namespaces: toStrings(u.Rule.Namespaces),
+		}
+	}
+	return users, nil
+}
+
+func toStrings(list [][]byte) []string {
+	out := make([]string, len(list))
+	for i, b := range list {
+		out[i] = string(b)
+	}
+	return out
+}
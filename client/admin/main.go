@@ -0,0 +1,160 @@
+// Command admin changes the membership of a running cluster.
+//
+//	admin --node-port=2221 members
+//	admin --node-port=2222 leave
+//	admin --node-port=2221 remove node3
+//	admin --node-port=2221 demote node2
+//	admin --node-port=2221 promote node2
+//	admin --node-port=2221 transfer [node2]
+//	admin --node-port=2221 users
+//	admin --node-port=2221 setuser app s3cret read,write 'app:*'
+//	admin --node-port=2221 deluser app
+//	admin --node-port=2221 slowlog [count]
+//	admin --node-port=2221 slowlog reset
+//
+// --tls-cert, --tls-key and --tls-ca connect to nodes serving TLS,
+// --user and --password or --token authenticate once users are defined.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"y3cache/acl"
+	"y3cache/client"
+	"y3cache/tlsutil"
+)
+
+func main() {
+	nodePort := flag.Int("node-port", 2221, "choose the node to operate on")
+	var tlsConf tlsutil.Config
+	flag.StringVar(&tlsConf.CertFile, "tls-cert", "", "client certificate for mutual TLS")
+	flag.StringVar(&tlsConf.KeyFile, "tls-key", "", "key of the client certificate")
+	flag.StringVar(&tlsConf.CAFile, "tls-ca", "", "CA verifying the node, enables TLS")
+	var opts client.Options
+	flag.StringVar(&opts.Username, "user", "", "user to authenticate as")
+	flag.StringVar(&opts.Password, "password", "", "password of the user")
+	flag.StringVar(&opts.Token, "token", "", "token to authenticate with")
+	flag.Parse()
+
+	if *nodePort == 0 || flag.NArg() == 0 {
+		log.Fatal("usage: admin [--node-port=N] members|leave|remove <node>|promote <node>|demote <node>|transfer [node]")
+	}
+	var err error
+	if opts.TLS, err = tlsConf.Client(); err != nil {
+		log.Fatal(err)
+	}
+	c, err := client.New(fmt.Sprintf(":%d", *nodePort), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	switch cmd := flag.Arg(0); cmd {
+	case "members":
+		members, err := c.Members(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range members {
+			role := "replica"
+			if m.Voter {
+				role = "voter"
+			}
+			if m.Leader {
+				role = "leader"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", m.NodeId, role, m.RaftAddress, m.ClientAddress)
+		}
+	case "leave":
+		err = c.Leave(ctx)
+	case "transfer":
+		err = c.TransferLeadership(ctx, flag.Arg(1))
+	case "remove", "promote", "demote":
+		if flag.NArg() != 2 {
+			log.Fatalf("usage: admin %s <node>", cmd)
+		}
+		switch cmd {
+		case "remove":
+			err = c.RemoveNode(ctx, flag.Arg(1))
+		case "promote":
+			err = c.PromoteNode(ctx, flag.Arg(1))
+		default:
+			err = c.DemoteNode(ctx, flag.Arg(1))
+		}
+	case "users":
+		users, err := c.Users(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\tkeys=%v\tnamespaces=%v\n", u.Name, u.Perms, u.Keys, u.Namespaces)
+		}
+	case "setuser":
+		if flag.NArg() < 4 {
+			log.Fatal("usage: admin setuser <name> <password> <perms> [key patterns...]")
+		}
+		perms, err := acl.ParsePerms(flag.Arg(3))
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.SetUser(ctx, flag.Arg(1), client.UserOptions{
+			Password: flag.Arg(2),
+			Perms:    perms,
+			Keys:     flag.Args()[4:],
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "slowlog":
+		if flag.Arg(1) == "reset" {
+			err = c.SlowlogReset(ctx)
+			break
+		}
+		count := 0
+		if flag.NArg() > 1 {
+			if count, err = strconv.Atoi(flag.Arg(1)); err != nil {
+				log.Fatal("usage: admin slowlog [count|reset]")
+			}
+		}
+		entries, err := c.Slowlog(ctx, count)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range entries {
+			spans := []time.Duration{
+				time.Duration(e.Parse), time.Duration(e.Queue), time.Duration(e.Raft),
+				time.Duration(e.FSM), time.Duration(e.Exec), time.Duration(e.Write),
+			}
+			var total time.Duration
+			for _, d := range spans {
+				total += d
+			}
+			fmt.Printf(
+				"%d\t%s\t%s\t%s\t%s\t%v\tparse=%v queue=%v raft=%v fsm=%v exec=%v write=%v\n",
+				e.ID,
+				time.Unix(0, e.Time).Format(time.RFC3339Nano),
+				e.Remote,
+				e.Namespace,
+				e.Command,
+				total,
+				spans[0], spans[1], spans[2], spans[3], spans[4], spans[5],
+			)
+		}
+	case "deluser":
+		if flag.NArg() != 2 {
+			log.Fatal("usage: admin deluser <name>")
+		}
+		err = c.DeleteUser(ctx, flag.Arg(1))
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"y3cache/proto"
+)
+
+// ChangeStream reads the changes applied by the cluster in raft log order.
+type ChangeStream struct {
+	conn net.Conn
+}
+
+// Changes opens a new connection streaming every write applied from index
+// on. Pass the index after the last change you processed to resume, or zero
+// to start with a snapshot.
+func (c *Client) Changes(ctx context.Context, from uint64) (*ChangeStream, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &proto.CommandChanges{FromIndex: from}
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ChangeStream{conn: conn}, nil
+}
+
+// Next returns the next change. A proto.ChangeResnapshot means the
+// requested index is gone, drop your state and load the snapshot items up to
+// the proto.ChangeSnapshotDone.
+func (s *ChangeStream) Next() (*proto.Change, error) {
+	c, err := proto.ParseChange(s.conn)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type == proto.ChangeError {
+		return nil, fmt.Errorf("change stream ended: %s", c.Value)
+	}
+	return c, nil
+}
+
+func (s *ChangeStream) Close() error {
+	return s.conn.Close()
+}
@@ -2,23 +2,43 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"time"
 
+	"go.uber.org/zap"
+
+	"y3cache/logging"
 	"y3cache/proto"
+	"y3cache/tlsutil"
 )
 
 type (
-	Options struct{}
-	Client  struct {
-		conn net.Conn
+	Options struct {
+		// TLS connects over TLS when set, Certificates is presented to
+		// servers asking for a client certificate
+		TLS *tls.Config
+		// Username and Password, or Token alone, authenticate every
+		// connection of the client, see Auth
+		Username string
+		Password string
+		Token    string
+		// Logger logs what the client does, nothing when nil
+		Logger *zap.Logger
+	}
+	Client struct {
+		endpoint string
+		conn     net.Conn
+		opts     Options
+		logger   *zap.SugaredLogger
 	}
 )
 
 func NewFromConn(conn net.Conn) *Client {
 	return &Client{
-		conn: conn,
+		conn:   conn,
+		logger: zap.NewNop().Sugar(),
 	}
 }
 
@@ -26,7 +46,7 @@ func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
 	cmd := &proto.CommandGet{
 		Key: key,
 	}
-	_, err := c.conn.Write(cmd.Bytes())
+	err := c.send(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -48,21 +68,53 @@ func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
 }
 
 func (c *Client) Set(ctx context.Context, key, value []byte) error {
+	return c.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL sets key and lets it expire once ttl (in whole seconds) has
+// passed, a zero ttl never expires.
+func (c *Client) SetWithTTL(
+	ctx context.Context,
+	key, value []byte,
+	ttl time.Duration,
+) error {
+	return c.SetWithTags(ctx, key, value, ttl)
+}
+
+// SetWithTags is SetWithTTL tagging key with tags, see Invalidate.
+func (c *Client) SetWithTags(
+	ctx context.Context,
+	key, value []byte,
+	ttl time.Duration,
+	tags ...[]byte,
+) error {
 	cmd := &proto.CommandSet{
 		Key:   key,
 		Value: value,
-		TTL:   0,
+		TTL:   int32(ttl / time.Second),
+		Tags:  tags,
 	}
-	_, err := c.conn.Write(cmd.Bytes())
+	err := c.send(ctx, cmd)
 	if err != nil {
 		return err
 	}
 
 	resp, err := proto.ParseSetResponse(c.conn)
-	fmt.Println("received: ", string(resp.Bytes()))
 	if err != nil {
 		return err
 	}
+	c.logger.Debugw(
+		"command answered",
+		logging.FieldCmd,
+		"SET",
+		logging.FieldKeyHash,
+		logging.HashKey(key),
+		"status",
+		resp.Status.String(),
+	)
+	if resp.Status == proto.StatusFull {
+		return ErrFull
+	}
 	if resp.Status != proto.StatusOK {
 		return fmt.Errorf(
 			"server repsonsed with non OK status [%s]",
@@ -72,15 +124,98 @@ func (c *Client) Set(ctx context.Context, key, value []byte) error {
 	return nil
 }
 
-func New(endpoint string, _ Options) (*Client, error) {
-	conn, err := net.Dial("tcp", endpoint)
+func New(endpoint string, opts Options) (*Client, error) {
+	c := &Client{
+		endpoint: endpoint,
+		opts:     opts,
+		logger:   logging.OrNop(opts.Logger).Named("client").Sugar(),
+	}
+	conn, err := c.dial(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	c.conn = conn
+	return c, nil
+}
 
-	return &Client{
-		conn: conn,
-	}, nil
+// Invalidate deletes every key tagged with any of tags and returns how
+// many were deleted.
+func (c *Client) Invalidate(ctx context.Context, tags ...[]byte) (int, error) {
+	cmd := &proto.CommandInvalidate{Tags: tags}
+	if err := c.send(ctx, cmd); err != nil {
+		return 0, err
+	}
+	resp, err := proto.ParseInvalidateResponse(c.conn)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Status != proto.StatusOK {
+		return 0, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return int(resp.Count), nil
+}
+
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	cmd := &proto.CommandDel{
+		Key: key,
+	}
+	err := c.send(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	resp, err := proto.ParseDelResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status == proto.StatusKeyNotFound {
+		return fmt.Errorf("could not find key (%s)", key)
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return nil
+}
+
+// dial opens an extra connection to the same node for the commands that
+// take a connection over, authenticated like the first one.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = c.conn.RemoteAddr().String()
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.opts.TLS == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", endpoint)
+	} else {
+		d := tls.Dialer{Config: tlsutil.ForAddr(c.opts.TLS, endpoint)}
+		conn, err = d.DialContext(ctx, "tcp", endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugw("connected", "endpoint", endpoint, "tls", c.opts.TLS != nil)
+	if c.opts.Username == "" && c.opts.Token == "" {
+		return conn, nil
+	}
+	password := c.opts.Password
+	if c.opts.Username == "" {
+		password = c.opts.Token
+	}
+	if err := auth(conn, c.opts.Username, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func (c *Client) Close() error {
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"y3cache/proto"
+)
+
+// Leave removes the node the client is connected to from the cluster.
+func (c *Client) Leave(ctx context.Context) error {
+	return c.membership(ctx, &proto.CommandLeave{})
+}
+
+// RemoveNode removes nodeID from the cluster, any node forwards it to the
+// leader.
+func (c *Client) RemoveNode(ctx context.Context, nodeID string) error {
+	return c.membership(ctx, &proto.CommandRemove{NodeId: []byte(nodeID)})
+}
+
+// PromoteNode turns the read replica nodeID into a voter.
+func (c *Client) PromoteNode(ctx context.Context, nodeID string) error {
+	return c.membership(ctx, &proto.CommandPromote{NodeId: []byte(nodeID)})
+}
+
+// DemoteNode turns the voter nodeID into a non-voter.
+func (c *Client) DemoteNode(ctx context.Context, nodeID string) error {
+	return c.membership(ctx, &proto.CommandDemote{NodeId: []byte(nodeID)})
+}
+
+// TransferLeadership moves leadership to the voter nodeID, or to the most
+// up to date voter when nodeID is empty.
+func (c *Client) TransferLeadership(ctx context.Context, nodeID string) error {
+	return c.membership(ctx, &proto.CommandTransfer{NodeId: []byte(nodeID)})
+}
+
+func (c *Client) membership(ctx context.Context, cmd interface{ Bytes() []byte }) error {
+	if err := c.send(ctx, cmd); err != nil {
+		return err
+	}
+	resp, err := proto.ParseMembershipResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf("membership change refused: %s", resp.Message)
+	}
+	return nil
+}
+
+// Members returns the servers of the raft configuration as seen by the
+// node the client is connected to.
+func (c *Client) Members(ctx context.Context) ([]proto.Member, error) {
+	cmd := &proto.CommandMembers{}
+	if err := c.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseMembersResponse(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != proto.StatusOK {
+		return nil, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return resp.Members, nil
+}
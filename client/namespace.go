@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"y3cache/cache"
+	"y3cache/proto"
+)
+
+// ErrFull is returned for writes refused by a namespace with noeviction
+// that is at its limits.
+var ErrFull = errors.New("namespace is full")
+
+// NamespaceOptions are the limits of a namespace, zero values are
+// unlimited.
+type NamespaceOptions struct {
+	MaxMemory  int64
+	MaxKeys    int64
+	DefaultTTL time.Duration
+	Policy     cache.EvictionPolicy
+}
+
+// Select makes the following commands of the client run in namespace, an
+// empty one goes back to the default namespace.
+func (c *Client) Select(ctx context.Context, namespace string) error {
+	return c.status(ctx, &proto.CommandSelect{Namespace: []byte(namespace)})
+}
+
+// ConfigureNamespace creates namespace or replaces its limits, keys over the
+// new limits are evicted right away.
+func (c *Client) ConfigureNamespace(ctx context.Context, namespace string, opts NamespaceOptions) error {
+	return c.status(ctx, &proto.CommandNamespaceConfig{
+		Namespace:  []byte(namespace),
+		MaxMemory:  opts.MaxMemory,
+		MaxKeys:    opts.MaxKeys,
+		DefaultTTL: int32(opts.DefaultTTL / time.Second),
+		Policy:     byte(opts.Policy),
+	})
+}
+
+// Flush removes every key of namespace, an empty one flushes the selected
+// namespace.
+func (c *Client) Flush(ctx context.Context, namespace string) error {
+	return c.status(ctx, &proto.CommandFlush{Namespace: []byte(namespace)})
+}
+
+// NamespaceStats returns the stats of namespaces as seen by the node the
+// client is connected to, or of all of them when none are given.
+func (c *Client) NamespaceStats(ctx context.Context, namespaces ...string) ([]proto.NamespaceStats, error) {
+	cmd := &proto.CommandNamespaceStats{Namespaces: toBytes(namespaces)}
+	if err := c.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseNamespaceStatsResponse(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != proto.StatusOK {
+		return nil, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return resp.Stats, nil
+}
+
+func (c *Client) status(ctx context.Context, cmd interface{ Bytes() []byte }) error {
+	if err := c.send(ctx, cmd); err != nil {
+		return err
+	}
+	resp, err := proto.ParseStatusResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status == proto.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return nil
+}
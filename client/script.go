@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"y3cache/proto"
+)
+
+var ErrNoScript = errors.New("no cached script with this sha")
+
+// Eval runs script on the leader against keys, see the script package for
+// the language. The returned values are the flattened result.
+func (c *Client) Eval(ctx context.Context, script string, keys [][]byte, args ...[]byte) ([][]byte, error) {
+	return c.eval(ctx, &proto.CommandEval{Script: []byte(script), Keys: keys, Args: args})
+}
+
+// EvalSha runs a script cached by Eval or ScriptLoad.
+func (c *Client) EvalSha(ctx context.Context, sha string, keys [][]byte, args ...[]byte) ([][]byte, error) {
+	return c.eval(ctx, &proto.CommandEvalSha{Sha: []byte(sha), Keys: keys, Args: args})
+}
+
+func (c *Client) eval(ctx context.Context, cmd interface{ Bytes() []byte }) ([][]byte, error) {
+	if err := c.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseEvalResponse(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Status {
+	case proto.StatusOK:
+		return resp.Values, nil
+	case proto.StatusNoScript:
+		return nil, ErrNoScript
+	case proto.StatusFull:
+		return nil, ErrFull
+	case proto.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	}
+	if len(resp.Values) > 0 {
+		return nil, fmt.Errorf("script failed: %s", resp.Values[0])
+	}
+	return nil, fmt.Errorf(
+		"server repsonsed with non OK status [%s]",
+		resp.Status,
+	)
+}
+
+// ScriptLoad caches script on every replica and returns its sha.
+func (c *Client) ScriptLoad(ctx context.Context, script string) (string, error) {
+	cmd := &proto.CommandScriptLoad{Script: []byte(script)}
+	if err := c.send(ctx, cmd); err != nil {
+		return "", err
+	}
+	resp, err := proto.ParseScriptLoadResponse(c.conn)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != proto.StatusOK {
+		return "", fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return string(resp.Sha), nil
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"y3cache/proto"
+)
+
+// Slowlog returns the count most recent slow commands of the node the
+// client is connected to, newest first, all of them when count is zero.
+func (c *Client) Slowlog(ctx context.Context, count int) ([]proto.SlowlogEntry, error) {
+	return c.slowlog(ctx, &proto.CommandSlowlog{Count: int32(count)})
+}
+
+// SlowlogReset empties the slowlog of the node the client is connected to.
+func (c *Client) SlowlogReset(ctx context.Context) error {
+	_, err := c.slowlog(ctx, &proto.CommandSlowlog{Reset: true})
+	return err
+}
+
+func (c *Client) slowlog(ctx context.Context, cmd *proto.CommandSlowlog) ([]proto.SlowlogEntry, error) {
+	if err := c.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseSlowlogResponse(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == proto.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	if resp.Status != proto.StatusOK {
+		return nil, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return resp.Entries, nil
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"y3cache/proto"
+)
+
+type Message struct {
+	Pattern string
+	Channel string
+	Payload []byte
+}
+
+// Subscription owns a dedicated connection, published messages are
+// delivered on C which is closed once the subscription ends.
+type Subscription struct {
+	C    <-chan *Message
+	conn net.Conn
+	done chan struct{}
+	// closed stops a reader waiting for the caller to take a message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Subscribe opens a new connection to the node and subscribes it to
+// channels.
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	return c.subscribe(ctx, &proto.CommandSubscribe{Channels: toBytes(channels)})
+}
+
+// PSubscribe opens a new connection to the node and subscribes it to every
+// channel matching patterns.
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*Subscription, error) {
+	return c.subscribe(ctx, &proto.CommandPSubscribe{Patterns: toBytes(patterns)})
+}
+
+func (c *Client) subscribe(ctx context.Context, cmd interface{ Bytes() []byte }) (*Subscription, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ch := make(chan *Message)
+	sub := &Subscription{
+		C:      ch,
+		conn:   conn,
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	go sub.read(ch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub, nil
+}
+
+func (s *Subscription) read(ch chan<- *Message) {
+	defer close(s.done)
+	defer close(ch)
+	for {
+		m, err := proto.ParseMessage(s.conn)
+		if err != nil {
+			return
+		}
+		if m.Kind != proto.MessagePublished {
+			continue
+		}
+		msg := &Message{
+			Pattern: string(m.Pattern),
+			Channel: string(m.Channel),
+			Payload: m.Payload,
+		}
+		select {
+		case ch <- msg:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Subscription) Subscribe(channels ...string) error {
+	return s.write(&proto.CommandSubscribe{Channels: toBytes(channels)})
+}
+
+func (s *Subscription) PSubscribe(patterns ...string) error {
+	return s.write(&proto.CommandPSubscribe{Patterns: toBytes(patterns)})
+}
+
+func (s *Subscription) Unsubscribe(channels ...string) error {
+	return s.write(&proto.CommandUnsubscribe{Channels: toBytes(channels)})
+}
+
+func (s *Subscription) PUnsubscribe(patterns ...string) error {
+	return s.write(&proto.CommandPUnsubscribe{Patterns: toBytes(patterns)})
+}
+
+func (s *Subscription) write(cmd interface{ Bytes() []byte }) error {
+	_, err := s.conn.Write(cmd.Bytes())
+	return err
+}
+
+// Close ends the subscription, C is closed even if the caller stopped
+// reading it.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.conn.Close()
+}
+
+// Publish sends payload to every subscriber of channel on every node. It
+// must be sent to the leader.
+func (c *Client) Publish(ctx context.Context, channel string, payload []byte) error {
+	cmd := &proto.CommandPublish{
+		Channel: []byte(channel),
+		Payload: payload,
+	}
+	if err := c.send(ctx, cmd); err != nil {
+		return err
+	}
+	resp, err := proto.ParsePublishResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return nil
+}
+
+func toBytes(list []string) [][]byte {
+	out := make([][]byte, len(list))
+	for i, s := range list {
+		out[i] = []byte(s)
+	}
+	return out
+}
@@ -0,0 +1,22 @@
+package client
+
+import (
+	"context"
+
+	"y3cache/proto"
+	"y3cache/trace"
+)
+
+// send writes cmd on the client connection, along with the trace context
+// of ctx when it has one.
+func (c *Client) send(ctx context.Context, cmd interface{ Bytes() []byte }) error {
+	if sc, ok := trace.FromContext(ctx); ok {
+		cmd = &proto.CommandTraced{
+			TraceParent: []byte(sc.Traceparent()),
+			TraceState:  []byte(sc.State),
+			Command:     cmd,
+		}
+	}
+	_, err := c.conn.Write(cmd.Bytes())
+	return err
+}
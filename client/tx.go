@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"y3cache/proto"
+)
+
+var ErrTxAborted = errors.New("transaction aborted, a watched key changed")
+
+// Tx collects the ops of a transaction, nothing is sent before Exec.
+//
+//	tx := c.Multi()
+//	tx.Watch(ctx, key)
+//	v, _ := c.Get(ctx, key)
+//	tx.Set(key, next(v), 0)
+//	results, err := tx.Exec(ctx)
+type Tx struct {
+	client  *Client
+	watches []proto.WatchedKey
+	ops     []any
+}
+
+func (c *Client) Multi() *Tx {
+	return &Tx{client: c}
+}
+
+// Watch records the current version of keys, Exec aborts if any of them
+// changes before the transaction is applied. Watch before reading the
+// values the transaction depends on.
+func (tx *Tx) Watch(ctx context.Context, keys ...[]byte) error {
+	cmd := &proto.CommandWatch{Keys: keys}
+	if err := tx.client.send(ctx, cmd); err != nil {
+		return err
+	}
+	resp, err := proto.ParseWatchResponse(tx.client.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != proto.StatusOK || len(resp.Versions) != len(keys) {
+		return fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	for i, key := range keys {
+		tx.watches = append(tx.watches, proto.WatchedKey{
+			Key:     key,
+			Version: resp.Versions[i],
+		})
+	}
+	return nil
+}
+
+func (tx *Tx) Set(key, value []byte, ttl time.Duration) {
+	tx.ops = append(tx.ops, &proto.CommandSet{
+		Key:   key,
+		Value: value,
+		TTL:   int32(ttl / time.Second),
+	})
+}
+
+func (tx *Tx) Delete(key []byte) {
+	tx.ops = append(tx.ops, &proto.CommandDel{Key: key})
+}
+
+// Get reads key as of its position in the transaction.
+func (tx *Tx) Get(key []byte) {
+	tx.ops = append(tx.ops, &proto.CommandGet{Key: key})
+}
+
+// Exec applies the transaction on the leader and returns one result per op
+// in the order they were added, or ErrTxAborted.
+func (tx *Tx) Exec(ctx context.Context) ([]proto.OpResult, error) {
+	cmd := &proto.CommandExec{Watches: tx.watches, Ops: tx.ops}
+	if err := tx.client.send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	resp, err := proto.ParseExecResponse(tx.client.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == proto.StatusAborted {
+		return nil, ErrTxAborted
+	}
+	if resp.Status == proto.StatusFull {
+		return nil, ErrFull
+	}
+	if resp.Status != proto.StatusOK {
+		return nil, fmt.Errorf(
+			"server repsonsed with non OK status [%s]",
+			resp.Status,
+		)
+	}
+	return resp.Results, nil
+}
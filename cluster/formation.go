@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+
+	"y3cache/logging"
+)
+
+// Mode tells how a node with no raft state of its own enters a cluster.
+type Mode string
+
+const (
+	// BootstrapSingle starts a one node cluster made of this node
+	BootstrapSingle Mode = "bootstrap-single"
+	// BootstrapExpected waits for Expected of the static Peers to be
+	// reachable, then every one of them bootstraps the same configuration
+	BootstrapExpected Mode = "bootstrap-expected"
+	// JoinExisting never bootstraps, the node joins through its seeds
+	JoinExisting Mode = "join"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case BootstrapSingle, BootstrapExpected, JoinExisting:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown formation mode %q", s)
+}
+
+const peerPollInterval = time.Second
+
+type Formation struct {
+	Mode Mode
+	Self raft.Server
+	// Peers is the static member list of BootstrapExpected, Self included
+	Peers []raft.Server
+	// Expected is how many of Peers must be reachable before bootstrapping,
+	// zero waits for all of them
+	Expected int
+	// Reachable checks a peer's raft address, it dials it when nil
+	Reachable func(raft.ServerAddress) bool
+	// Logger logs the progress of the formation, nothing when nil
+	Logger *zap.Logger
+}
+
+// ParsePeers reads a comma separated list of id=raft-address.
+func ParsePeers(s string) ([]raft.Server, error) {
+	var peers []raft.Server
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(item, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected id=address", item)
+		}
+		peers = append(peers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(addr),
+		})
+	}
+	return peers, nil
+}
+
+// Validate checks the formation is usable before anything is started.
+func (f *Formation) Validate() error {
+	if f.Mode != BootstrapExpected {
+		return nil
+	}
+	seen := make(map[raft.ServerID]bool)
+	for _, p := range f.Peers {
+		if seen[p.ID] {
+			return fmt.Errorf("peer %s is listed twice", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	if !seen[f.Self.ID] {
+		return fmt.Errorf("peers must include this node (%s)", f.Self.ID)
+	}
+	if f.Expected < 0 || f.Expected > len(f.Peers) {
+		return fmt.Errorf("expected peers must be between 0 (all of them) and %d", len(f.Peers))
+	}
+	return nil
+}
+
+// Form bootstraps r following the mode. A node that has raft state was
+// already part of a cluster, it is never bootstrapped again.
+func (f *Formation) Form(ctx context.Context, r *raft.Raft, hasState bool) error {
+	if hasState {
+		f.logger().Infow("existing raft state, skipping bootstrap")
+		return nil
+	}
+	switch f.Mode {
+	case BootstrapSingle:
+		self := f.Self
+		self.Suffrage = raft.Voter
+		return r.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{self},
+		}).Error()
+	case BootstrapExpected:
+		if err := f.waitPeers(ctx); err != nil {
+			return err
+		}
+		// sorted so that every peer bootstraps the exact same
+		// configuration
+		servers := append([]raft.Server(nil), f.Peers...)
+		sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+		return r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	}
+	return nil
+}
+
+func (f *Formation) logger() *zap.SugaredLogger {
+	return logging.OrNop(f.Logger).Named("formation").Sugar()
+}
+
+func (f *Formation) waitPeers(ctx context.Context) error {
+	expected := f.Expected
+	if expected == 0 {
+		expected = len(f.Peers)
+	}
+	reachable := f.Reachable
+	if reachable == nil {
+		reachable = dialPeer
+	}
+	ticker := time.NewTicker(peerPollInterval)
+	defer ticker.Stop()
+	for {
+		up := 0
+		for _, p := range f.Peers {
+			if p.ID == f.Self.ID || reachable(p.Address) {
+				up++
+			}
+		}
+		if up >= expected {
+			return nil
+		}
+		f.logger().Infow("waiting for peers", "reachable", up, "expected", expected)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func dialPeer(addr raft.ServerAddress) bool {
+	conn, err := net.DialTimeout("tcp", string(addr), peerPollInterval)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
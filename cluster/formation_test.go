@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopFSM struct{}
+
+func (nopFSM) Apply(*raft.Log) any                 { return nil }
+func (nopFSM) Snapshot() (raft.FSMSnapshot, error) { return nil, fmt.Errorf("no snapshot") }
+func (nopFSM) Restore(io.ReadCloser) error         { return nil }
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("node1=127.0.0.1:1111, node2=127.0.0.1:1112")
+	assert.Nil(t, err)
+	assert.Equal(t, []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "127.0.0.1:1111"},
+		{Suffrage: raft.Voter, ID: "node2", Address: "127.0.0.1:1112"},
+	}, peers)
+	_, err = ParsePeers("node1")
+	assert.NotNil(t, err)
+}
+
+func TestBootstrapExpected(t *testing.T) {
+	const n = 3
+	addrs := make([]raft.ServerAddress, n)
+	transports := make([]*raft.InmemTransport, n)
+	var peers []raft.Server
+	for i := range transports {
+		addrs[i], transports[i] = raft.NewInmemTransport("")
+		peers = append(peers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(fmt.Sprintf("node%d", n-i)),
+			Address:  addrs[i],
+		})
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(addrs[j], transports[j])
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	up := make(map[raft.ServerAddress]bool)
+	rafts := make([]*raft.Raft, n)
+	stores := make([]*raft.InmemStore, n)
+	errs := make(chan error, n)
+	for i := range rafts {
+		conf := raft.DefaultConfig()
+		conf.LocalID = peers[i].ID
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.LogOutput = io.Discard
+		stores[i] = raft.NewInmemStore()
+		r, err := raft.NewRaft(conf, nopFSM{}, stores[i], stores[i], raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Shutdown()
+		rafts[i] = r
+		f := &Formation{
+			Mode:  BootstrapExpected,
+			Self:  peers[i],
+			Peers: peers,
+			Reachable: func(addr raft.ServerAddress) bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return up[addr]
+			},
+		}
+		assert.Nil(t, f.Validate())
+		go func() { errs <- f.Form(context.Background(), r, false) }()
+	}
+
+	// nobody bootstraps until every peer is reachable
+	time.Sleep(100 * time.Millisecond)
+	for _, s := range stores {
+		idx, _ := s.LastIndex()
+		assert.Equal(t, uint64(0), idx)
+	}
+	lock.Lock()
+	for _, addr := range addrs {
+		up[addr] = true
+	}
+	lock.Unlock()
+	for range rafts {
+		assert.Nil(t, <-errs)
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, r := range rafts {
+			if r.State() == raft.Leader {
+				return len(r.GetConfiguration().Configuration().Servers) == n
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a restart finds its state and leaves the cluster as it is
+	hasState, err := raft.HasExistingState(stores[0], stores[0], raft.NewInmemSnapshotStore())
+	assert.Nil(t, err)
+	assert.True(t, hasState)
+	f := &Formation{Mode: BootstrapSingle, Self: peers[0]}
+	assert.Nil(t, f.Form(context.Background(), rafts[0], hasState))
+}
+
+func TestValidateExpected(t *testing.T) {
+	peers, err := ParsePeers("node1=a:7000,node2=b:7000")
+	assert.Nil(t, err)
+	f := &Formation{Mode: BootstrapExpected, Self: peers[0], Peers: peers}
+	// zero waits for every peer
+	assert.Nil(t, f.Validate())
+	f.Expected = 3
+	assert.EqualError(t, f.Validate(), "expected peers must be between 0 (all of them) and 2")
+}
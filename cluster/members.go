@@ -0,0 +1,61 @@
+// Package cluster keeps the metadata raft does not know about the members
+// of the cluster, it is replicated through the FSM.
+package cluster
+
+import (
+	"sort"
+	"sync"
+)
+
+type Member struct {
+	ID string
+	// ClientAddress is where the node serves the client protocol, followers
+	// use it to forward commands to the leader
+	ClientAddress string
+}
+
+type Members struct {
+	lock    sync.RWMutex
+	members map[string]Member
+}
+
+func NewMembers() *Members {
+	return &Members{members: make(map[string]Member)}
+}
+
+func (m *Members) Get(id string) (Member, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	member, ok := m.members[id]
+	return member, ok
+}
+
+func (m *Members) Set(member Member) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.members[member.ID] = member
+}
+
+func (m *Members) Remove(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.members, id)
+}
+
+// All returns the members sorted by id.
+func (m *Members) All() []Member {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	all := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		all = append(all, member)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+func (m *Members) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.members = make(map[string]Member)
+}
@@ -0,0 +1,237 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"y3cache/tlsutil"
+)
+
+// handshakeTimeout bounds the TLS handshake of an accepted connection
+const handshakeTimeout = 10 * time.Second
+
+// TLSStreamLayer carries raft traffic over mutual TLS, to be used with
+// raft.NewNetworkTransport. Nodes present a certificate whose common name
+// is their node id, see SetResolver and SetAuthorizer.
+type TLSStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	client    *tls.Config
+
+	lock      sync.RWMutex
+	resolve   Resolver
+	authorize Authorizer
+}
+
+// Resolver returns the node id expected at a raft address.
+type Resolver func(raft.ServerAddress) (raft.ServerID, bool)
+
+// Authorizer tells whether the node id may send raft traffic.
+type Authorizer func(raft.ServerID) bool
+
+// NewTLSStreamLayer listens on bind with server, peers must present a
+// certificate verified by its ClientCAs. client dials the other nodes.
+// advertise is the address given to peers, the listener's when nil.
+func NewTLSStreamLayer(bind string, advertise net.Addr, server, client *tls.Config) (*TLSStreamLayer, error) {
+	if server == nil || client == nil {
+		return nil, fmt.Errorf("raft over tls needs a server and a client config")
+	}
+	server = server.Clone()
+	server.ClientAuth = tls.RequireAndVerifyClientCert
+	ln, err := tls.Listen("tcp", bind, server)
+	if err != nil {
+		return nil, err
+	}
+	if advertise == nil {
+		advertise = ln.Addr()
+	}
+	return &TLSStreamLayer{
+		Listener:  ln,
+		advertise: advertise,
+		client:    client,
+	}, nil
+}
+
+// SetResolver verifies the node answering every dial, dialing an address
+// resolve does not know or answered by another node fails. Until it is
+// set only the certificate chain is checked.
+func (l *TLSStreamLayer) SetResolver(resolve Resolver) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.resolve = resolve
+}
+
+// SetAuthorizer verifies the node of every accepted connection, clients of
+// the same CA are not nodes and must not reach raft. Until it is set only
+// the certificate chain is checked.
+func (l *TLSStreamLayer) SetAuthorizer(authorize Authorizer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.authorize = authorize
+}
+
+// Accept returns connections that complete their handshake and check the
+// identity of the peer on first use, in the goroutine raft serves them
+// from: a peer stalling its handshake does not hold up the others.
+func (l *TLSStreamLayer) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.lock.RLock()
+	authorize := l.authorize
+	l.lock.RUnlock()
+	if authorize == nil {
+		return conn, nil
+	}
+	return &verifiedConn{Conn: conn, authorize: authorize}, nil
+}
+
+// verifiedConn fails every read and write, and is closed, unless its peer
+// is authorized.
+type verifiedConn struct {
+	net.Conn
+	authorize Authorizer
+	once      sync.Once
+	err       error
+}
+
+func (c *verifiedConn) verify() error {
+	c.once.Do(func() {
+		c.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		id, err := tlsutil.Identity(c.Conn)
+		c.Conn.SetDeadline(time.Time{})
+		switch {
+		case err != nil:
+			c.err = err
+		case !c.authorize(raft.ServerID(id)):
+			c.err = fmt.Errorf("peer %q is not a member of the cluster", id)
+		}
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *verifiedConn) Read(p []byte) (int, error) {
+	if err := c.verify(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *verifiedConn) Write(p []byte) (int, error) {
+	if err := c.verify(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (l *TLSStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *TLSStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	addr := string(address)
+	d := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(d, "tcp", addr, tlsutil.ForAddr(l.client, addr))
+	if err != nil {
+		return nil, err
+	}
+	l.lock.RLock()
+	resolve := l.resolve
+	l.lock.RUnlock()
+	if resolve == nil {
+		return conn, nil
+	}
+	id, err := tlsutil.Identity(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	want, ok := resolve(address)
+	if !ok || string(want) != id {
+		conn.Close()
+		return nil, fmt.Errorf("peer at %s is %q, expected %q", addr, id, want)
+	}
+	return conn, nil
+}
+
+// ConfigurationResolver resolves addresses from the latest raft
+// configuration of r, set once raft is created:
+//
+//	layer.SetResolver(cluster.ConfigurationResolver(r))
+func ConfigurationResolver(r *raft.Raft) Resolver {
+	return func(addr raft.ServerAddress) (raft.ServerID, bool) {
+		f := r.GetConfiguration()
+		if f.Error() != nil {
+			return "", false
+		}
+		for _, srv := range f.Configuration().Servers {
+			if srv.Address == addr {
+				return srv.ID, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Pending holds the nodes a node lets in while its configuration is still
+// empty: the static peers it bootstraps with and the seeds, or the leader,
+// it sends its join to.
+type Pending struct {
+	lock sync.RWMutex
+	ids  map[raft.ServerID]struct{}
+}
+
+func NewPending(ids ...raft.ServerID) *Pending {
+	p := &Pending{ids: make(map[raft.ServerID]struct{})}
+	for _, id := range ids {
+		p.Add(id)
+	}
+	return p
+}
+
+func (p *Pending) Add(id raft.ServerID) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ids[id] = struct{}{}
+}
+
+func (p *Pending) Has(id raft.ServerID) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	_, ok := p.ids[id]
+	return ok
+}
+
+// ConfigurationAuthorizer lets in the servers of the latest raft
+// configuration of r. A node with no configuration yet is bootstrapping or
+// waiting for the leader to replicate it after its join, it lets in the
+// nodes of pending only:
+//
+//	layer.SetAuthorizer(cluster.ConfigurationAuthorizer(r, pending))
+func ConfigurationAuthorizer(r *raft.Raft, pending *Pending) Authorizer {
+	return func(id raft.ServerID) bool {
+		f := r.GetConfiguration()
+		if f.Error() != nil {
+			return false
+		}
+		servers := f.Configuration().Servers
+		if len(servers) == 0 {
+			return pending != nil && pending.Has(id)
+		}
+		for _, srv := range servers {
+			if srv.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+
+	"y3cache/tlsutil"
+)
+
+func newTestLayer(t *testing.T, ca *tlsutil.CA, id string) *TLSStreamLayer {
+	cert, err := ca.Issue(id, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewTLSStreamLayer(
+		"127.0.0.1:0",
+		nil,
+		tlsutil.ServerConfig(cert, ca.Pool(), false),
+		&tls.Config{RootCAs: ca.Pool(), Certificates: []tls.Certificate{cert}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTLSStreamLayer(t *testing.T) {
+	ca, err := tlsutil.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1, node2 := newTestLayer(t, ca, "node1"), newTestLayer(t, ca, "node2")
+	addr2 := raft.ServerAddress(node2.Addr().String())
+	peers := map[raft.ServerAddress]raft.ServerID{addr2: "node2"}
+	node1.SetResolver(func(addr raft.ServerAddress) (raft.ServerID, bool) {
+		id, ok := peers[addr]
+		return id, ok
+	})
+
+	conn, err := node1.Dial(addr2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+	conn.Close()
+
+	// another node answering at the address is refused, and so are
+	// addresses out of the configuration
+	peers[addr2] = "node3"
+	_, err = node1.Dial(addr2, time.Second)
+	assert.NotNil(t, err)
+	delete(peers, addr2)
+	_, err = node1.Dial(addr2, time.Second)
+	assert.NotNil(t, err)
+
+	// peers without a certificate of the CA cannot talk to the layer
+	conn, err = tls.Dial("tcp", string(addr2), &tls.Config{RootCAs: ca.Pool()})
+	if err == nil {
+		conn.Write([]byte("ping"))
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+}
+
+func TestTLSStreamLayerAccept(t *testing.T) {
+	ca, err := tlsutil.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1, node2 := newTestLayer(t, ca, "node1"), newTestLayer(t, ca, "node2")
+	node2.SetAuthorizer(func(id raft.ServerID) bool { return id == "node1" })
+	addr2 := node2.Addr().String()
+
+	conn, err := node1.Dial(raft.ServerAddress(addr2), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+	conn.Close()
+
+	// a client certificate of the same CA is not a node
+	cert, err := ca.Issue("app", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.Dial("tcp", addr2, &tls.Config{
+		RootCAs:      ca.Pool(),
+		Certificates: []tls.Certificate{cert},
+	})
+	if err == nil {
+		conn.Write([]byte("ping"))
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+}
+
+func TestConfigurationAuthorizer(t *testing.T) {
+	conf := raft.DefaultConfig()
+	conf.LocalID = "node1"
+	conf.LogOutput = io.Discard
+	store := raft.NewInmemStore()
+	addr, transport := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(conf, &raft.MockFSM{}, store, store, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown()
+	authorize := ConfigurationAuthorizer(r, NewPending("seed"))
+
+	// until it has a configuration the node only lets in pending nodes,
+	// not every certificate of the CA
+	assert.True(t, authorize("seed"))
+	assert.False(t, authorize("app"))
+
+	err = r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+		{ID: "node1", Address: addr},
+		{ID: "node2", Address: "node2"},
+	}}).Error()
+	assert.Nil(t, err)
+	assert.True(t, authorize("node2"))
+	assert.False(t, authorize("seed"))
+	assert.False(t, authorize("app"))
+}
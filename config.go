@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+
+	"y3cache/audit"
+	"y3cache/logging"
+	"y3cache/proto"
+	"y3cache/tlsutil"
+)
+
+type config struct {
+	Server configServer `mapstructure:"server"`
+	Raft   configRaft   `mapstructure:"raft"`
+	TLS    configTLS    `mapstructure:"tls"`
+	Audit  configAudit  `mapstructure:"audit"`
+	Log    configLog    `mapstructure:"log"`
+}
+type configServer struct {
+	Port       int `mapstructure:"port"`
+	LeaderPort int `mapstructure:"leader_port"`
+	// HTTPPort serves /metrics, /healthz, /readyz and /status, zero
+	// serves nothing
+	HTTPPort int `mapstructure:"http_port"`
+	// ReadyMaxLag is how far behind the commit index a ready node may be
+	ReadyMaxLag  uint64        `mapstructure:"ready_max_lag"`
+	JoinSeeds    []string      `mapstructure:"join_seeds"`
+	MaxStaleness time.Duration `mapstructure:"max_staleness"`
+	// ShutdownTimeout bounds the wait for in-flight commands
+	ShutdownTimeout    time.Duration `mapstructure:"shutdown_timeout"`
+	TransferOnShutdown bool          `mapstructure:"shutdown_transfer"`
+	// NodeToken is the token of the user nodes authenticate as once ACLs
+	// are defined
+	NodeToken string `mapstructure:"node_token"`
+	// SlowlogThreshold records commands that take longer, zero records
+	// none, in a ring of SlowlogMaxLen entries
+	SlowlogThreshold time.Duration `mapstructure:"slowlog_threshold"`
+	SlowlogMaxLen    int           `mapstructure:"slowlog_max_len"`
+	// TraceFile is where the spans of traced commands are written as JSON
+	// lines, empty exports none
+	TraceFile string `mapstructure:"trace_file"`
+	// BindHost is the interface the client and HTTP listeners bind, all of
+	// them when empty
+	BindHost string `mapstructure:"bind_host"`
+	// AdvertiseAddr is the host:port other nodes reach the client listener
+	// at, the bind address when empty
+	AdvertiseAddr string `mapstructure:"advertise_addr"`
+	// MaxConnections refuses clients over this many, zero is unlimited
+	MaxConnections int `mapstructure:"max_connections"`
+}
+type configRaft struct {
+	NodeId    string `mapstructure:"node_id"`
+	Port      int    `mapstructure:"port"`
+	VolumeDir string `mapstructure:"volume_dir"`
+	// KeyringFile turns on encryption at rest of the log and snapshots,
+	// see atrest.LoadKeyring
+	KeyringFile string `mapstructure:"keyring_file"`
+	JoinSecret  string `mapstructure:"join_secret"`
+	Role        string `mapstructure:"role"`
+	// Formation is bootstrap-single, bootstrap-expected or join, see
+	// cluster.Mode
+	Formation     string `mapstructure:"formation"`
+	Peers         string `mapstructure:"peers"`
+	ExpectedPeers int    `mapstructure:"expected_peers"`
+	// BindHost is the interface the raft transport binds
+	BindHost string `mapstructure:"bind_host"`
+	// AdvertiseAddr is the host:port of the node in the raft
+	// configuration, the bind address when empty
+	AdvertiseAddr string `mapstructure:"advertise_addr"`
+	// the tuning of raft, see raft.Config
+	HeartbeatTimeout   time.Duration `mapstructure:"heartbeat_timeout"`
+	ElectionTimeout    time.Duration `mapstructure:"election_timeout"`
+	LeaderLeaseTimeout time.Duration `mapstructure:"leader_lease_timeout"`
+	CommitTimeout      time.Duration `mapstructure:"commit_timeout"`
+	MaxAppendEntries   int           `mapstructure:"max_append_entries"`
+	SnapshotInterval   time.Duration `mapstructure:"snapshot_interval"`
+	SnapshotThreshold  uint64        `mapstructure:"snapshot_threshold"`
+	TrailingLogs       uint64        `mapstructure:"trailing_logs"`
+	// SnapshotRetain is how many snapshots are kept in VolumeDir
+	SnapshotRetain int `mapstructure:"snapshot_retain"`
+	// LogCacheSize is how many recent log entries are kept in memory
+	LogCacheSize int `mapstructure:"log_cache_size"`
+	// MaxPool and TCPTimeout are the connection pool size and IO timeout
+	// of the transport
+	MaxPool    int           `mapstructure:"max_pool"`
+	TCPTimeout time.Duration `mapstructure:"tcp_timeout"`
+}
+
+// configTLS serves clients and raft over TLS once a certificate is set,
+// the same certificate is used to dial other nodes and its common name must
+// be the node id.
+type configTLS struct {
+	CertFile      string `mapstructure:"cert_file"`
+	KeyFile       string `mapstructure:"key_file"`
+	CAFile        string `mapstructure:"ca_file"`
+	VerifyClients bool   `mapstructure:"verify_clients"`
+}
+
+// configAudit turns the audit log on once File is set.
+type configAudit struct {
+	File       string `mapstructure:"file"`
+	MaxSize    int64  `mapstructure:"max_size"`
+	MaxBackups int    `mapstructure:"max_backups"`
+	// Classes is a comma separated list of audit.Class, empty is all
+	Classes  string `mapstructure:"classes"`
+	HashKeys bool   `mapstructure:"hash_keys"`
+	// Values is omit, hash or full
+	Values string `mapstructure:"values"`
+}
+
+// configLog is the level (debug, info, warn, error) and format (json,
+// console) of the logs every component writes to Output, stderr when
+// empty.
+type configLog struct {
+	Level  string   `mapstructure:"level"`
+	Format string   `mapstructure:"format"`
+	Output []string `mapstructure:"output"`
+}
+
+const (
+	configFile = "CONFIG_FILE"
+	serverPort = "SERVER_PORT"
+	serverHost = "SERVER_BIND_HOST"
+	serverAdv  = "SERVER_ADVERTISE_ADDR"
+	maxConns   = "SERVER_MAX_CONNECTIONS"
+	leaderPort = "LEADER_PORT"
+	httpPort   = "HTTP_PORT"
+	readyLag   = "READY_MAX_LAG"
+	slowThresh = "SLOWLOG_THRESHOLD"
+	slowLen    = "SLOWLOG_MAX_LEN"
+	traceFile  = "TRACE_FILE"
+	joinSeeds  = "JOIN_SEEDS"
+	raftNodeId = "RAFT_NODE_ID"
+	raftPort   = "RAFT_PORT"
+	raftHost   = "RAFT_BIND_HOST"
+	raftAdv    = "RAFT_ADVERTISE_ADDR"
+	raftVolDir = "RAFT_VOL_DIR"
+	raftKeys   = "RAFT_KEYRING_FILE"
+	joinSecret = "RAFT_JOIN_SECRET"
+	raftRole   = "RAFT_ROLE"
+	staleness  = "READ_MAX_STALENESS"
+	formation  = "RAFT_FORMATION"
+	raftPeers  = "RAFT_PEERS"
+	expPeers   = "RAFT_EXPECTED_PEERS"
+	heartbeat  = "RAFT_HEARTBEAT_TIMEOUT"
+	election   = "RAFT_ELECTION_TIMEOUT"
+	leaderLse  = "RAFT_LEADER_LEASE_TIMEOUT"
+	commitTO   = "RAFT_COMMIT_TIMEOUT"
+	maxAppend  = "RAFT_MAX_APPEND_ENTRIES"
+	snapIntv   = "RAFT_SNAPSHOT_INTERVAL"
+	snapThresh = "RAFT_SNAPSHOT_THRESHOLD"
+	snapRetain = "RAFT_SNAPSHOT_RETAIN"
+	trailing   = "RAFT_TRAILING_LOGS"
+	logCache   = "RAFT_LOG_CACHE_SIZE"
+	maxPool    = "RAFT_MAX_POOL"
+	tcpTimeout = "RAFT_TCP_TIMEOUT"
+	shutdownTO = "SHUTDOWN_TIMEOUT"
+	shutdownTr = "SHUTDOWN_TRANSFER"
+	tlsCert    = "TLS_CERT_FILE"
+	tlsKey     = "TLS_KEY_FILE"
+	tlsCA      = "TLS_CA_FILE"
+	tlsVerify  = "TLS_VERIFY_CLIENTS"
+	nodeToken  = "ACL_NODE_TOKEN"
+	auditFile  = "AUDIT_LOG_FILE"
+	auditSize  = "AUDIT_MAX_SIZE"
+	auditKeep  = "AUDIT_MAX_BACKUPS"
+	auditClass = "AUDIT_CLASSES"
+	auditHash  = "AUDIT_HASH_KEYS"
+	auditVals  = "AUDIT_VALUES"
+	logLevel   = "LOG_LEVEL"
+	logFormat  = "LOG_FORMAT"
+	logOutput  = "LOG_OUTPUT"
+)
+
+// settings are the keys of the config file with the environment variable
+// overriding each, a flag named after the key overrides both.
+var settings = []struct {
+	key, env string
+}{
+	{"server.port", serverPort},
+	{"server.bind_host", serverHost},
+	{"server.advertise_addr", serverAdv},
+	{"server.max_connections", maxConns},
+	{"server.leader_port", leaderPort},
+	{"server.http_port", httpPort},
+	{"server.ready_max_lag", readyLag},
+	{"server.join_seeds", joinSeeds},
+	{"server.max_staleness", staleness},
+	{"server.shutdown_timeout", shutdownTO},
+	{"server.shutdown_transfer", shutdownTr},
+	{"server.node_token", nodeToken},
+	{"server.slowlog_threshold", slowThresh},
+	{"server.slowlog_max_len", slowLen},
+	{"server.trace_file", traceFile},
+	{"raft.node_id", raftNodeId},
+	{"raft.port", raftPort},
+	{"raft.bind_host", raftHost},
+	{"raft.advertise_addr", raftAdv},
+	{"raft.volume_dir", raftVolDir},
+	{"raft.keyring_file", raftKeys},
+	{"raft.join_secret", joinSecret},
+	{"raft.role", raftRole},
+	{"raft.formation", formation},
+	{"raft.peers", raftPeers},
+	{"raft.expected_peers", expPeers},
+	{"raft.heartbeat_timeout", heartbeat},
+	{"raft.election_timeout", election},
+	{"raft.leader_lease_timeout", leaderLse},
+	{"raft.commit_timeout", commitTO},
+	{"raft.max_append_entries", maxAppend},
+	{"raft.snapshot_interval", snapIntv},
+	{"raft.snapshot_threshold", snapThresh},
+	{"raft.snapshot_retain", snapRetain},
+	{"raft.trailing_logs", trailing},
+	{"raft.log_cache_size", logCache},
+	{"raft.max_pool", maxPool},
+	{"raft.tcp_timeout", tcpTimeout},
+	{"tls.cert_file", tlsCert},
+	{"tls.key_file", tlsKey},
+	{"tls.ca_file", tlsCA},
+	{"tls.verify_clients", tlsVerify},
+	{"audit.file", auditFile},
+	{"audit.max_size", auditSize},
+	{"audit.max_backups", auditKeep},
+	{"audit.classes", auditClass},
+	{"audit.hash_keys", auditHash},
+	{"audit.values", auditVals},
+	{"log.level", logLevel},
+	{"log.format", logFormat},
+	{"log.output", logOutput},
+}
+
+func envOf(key string) string {
+	for _, s := range settings {
+		if s.key == key {
+			return s.env
+		}
+	}
+	return ""
+}
+
+func setDefaults(v *viper.Viper) {
+	rc := raft.DefaultConfig()
+	v.SetDefault("server.shutdown_timeout", 30*time.Second)
+	v.SetDefault("server.shutdown_transfer", true)
+	v.SetDefault("server.ready_max_lag", 100)
+	v.SetDefault("server.slowlog_threshold", 10*time.Millisecond)
+	v.SetDefault("server.slowlog_max_len", 128)
+	v.SetDefault("raft.bind_host", "127.0.0.1")
+	v.SetDefault("raft.heartbeat_timeout", rc.HeartbeatTimeout)
+	v.SetDefault("raft.election_timeout", rc.ElectionTimeout)
+	v.SetDefault("raft.leader_lease_timeout", rc.LeaderLeaseTimeout)
+	v.SetDefault("raft.commit_timeout", rc.CommitTimeout)
+	v.SetDefault("raft.max_append_entries", rc.MaxAppendEntries)
+	v.SetDefault("raft.snapshot_interval", rc.SnapshotInterval)
+	v.SetDefault("raft.snapshot_threshold", 1024)
+	v.SetDefault("raft.snapshot_retain", 2)
+	v.SetDefault("raft.trailing_logs", rc.TrailingLogs)
+	v.SetDefault("raft.log_cache_size", 512)
+	v.SetDefault("raft.max_pool", 3)
+	v.SetDefault("raft.tcp_timeout", 10*time.Second)
+	v.SetDefault("audit.max_size", 100<<20)
+	v.SetDefault("audit.max_backups", 5)
+}
+
+// loadConfig reads the config file given by -config or CONFIG_FILE, YAML
+// or TOML by its extension, then the environment and the flags over it.
+// The config is returned along with every validation error.
+func loadConfig(args []string) (config, error) {
+	var conf config
+	fs := flag.NewFlagSet("y3cache", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(configFile), "YAML or TOML config file")
+	for _, s := range settings {
+		fs.String(s.key, "", fmt.Sprintf("overrides %s", s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return conf, err
+	}
+
+	v := viper.New()
+	setDefaults(v)
+	for _, s := range settings {
+		v.BindEnv(s.key, s.env)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			v.Set(f.Name, f.Value.String())
+		}
+	})
+	if *file != "" {
+		v.SetConfigFile(*file)
+		if err := v.ReadInConfig(); err != nil {
+			return conf, fmt.Errorf("read config %s: %s", *file, err)
+		}
+	}
+	if err := v.Unmarshal(&conf); err != nil {
+		return conf, fmt.Errorf("decode config: %s", err)
+	}
+	// lists from the environment or flags are comma separated
+	conf.Server.JoinSeeds = splitList(strings.Join(conf.Server.JoinSeeds, ","))
+	conf.Log.Output = splitList(strings.Join(conf.Log.Output, ","))
+	return conf, conf.validate()
+}
+
+// validate returns every error of c at once.
+func (c config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	add := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", key, err))
+		}
+	}
+	advertise := func(key, addr string) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			add(key, err)
+			return
+		}
+		ip := net.ParseIP(host)
+		check(host != "" && (ip == nil || !ip.IsUnspecified()) && port != "0",
+			"%s: other nodes cannot reach %s, set %s", key, addr, envOf(key))
+	}
+	port := func(key string, p int, required bool) {
+		check(p >= 0 && p <= 65535, "%s: %d is not a port", key, p)
+		check(p != 0 || !required, "%s (%s) is required", key, envOf(key))
+	}
+
+	port("server.port", c.Server.Port, true)
+	port("server.leader_port", c.Server.LeaderPort, false)
+	port("server.http_port", c.Server.HTTPPort, false)
+	port("raft.port", c.Raft.Port, true)
+	check(c.Server.Port == 0 || c.Server.Port != c.Raft.Port,
+		"server.port and raft.port are both %d", c.Server.Port)
+	check(c.Server.HTTPPort == 0 || c.Server.HTTPPort != c.Server.Port && c.Server.HTTPPort != c.Raft.Port,
+		"server.http_port %d is already used", c.Server.HTTPPort)
+	if c.Server.AdvertiseAddr != "" {
+		advertise("server.advertise_addr", c.Server.AdvertiseAddr)
+	}
+	check(c.Server.MaxConnections >= 0, "server.max_connections must not be negative")
+	check(c.Server.MaxStaleness >= 0, "server.max_staleness must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.SlowlogThreshold >= 0, "server.slowlog_threshold must not be negative")
+	check(c.Server.SlowlogMaxLen > 0, "server.slowlog_max_len must be positive")
+
+	check(c.Raft.NodeId != "", "raft.node_id (%s) is required", raftNodeId)
+	check(c.Raft.VolumeDir != "", "raft.volume_dir (%s) is required", raftVolDir)
+	if c.Raft.Port != 0 {
+		advertise("raft.advertise_addr", c.raftAdvertise())
+	}
+	_, err := proto.ParseRole(c.Raft.Role)
+	add("raft.role", err)
+	_, err = newFormation(c.Raft, c.raftAdvertise(), c.seeds())
+	add("raft.formation", err)
+	check(c.Raft.ExpectedPeers >= 0, "raft.expected_peers must not be negative")
+	check(c.Raft.HeartbeatTimeout >= 5*time.Millisecond, "raft.heartbeat_timeout must be at least 5ms")
+	check(c.Raft.ElectionTimeout >= c.Raft.HeartbeatTimeout,
+		"raft.election_timeout must be at least raft.heartbeat_timeout")
+	check(c.Raft.LeaderLeaseTimeout >= 5*time.Millisecond, "raft.leader_lease_timeout must be at least 5ms")
+	check(c.Raft.LeaderLeaseTimeout <= c.Raft.HeartbeatTimeout,
+		"raft.leader_lease_timeout must not exceed raft.heartbeat_timeout")
+	check(c.Raft.CommitTimeout >= time.Millisecond, "raft.commit_timeout must be at least 1ms")
+	check(c.Raft.MaxAppendEntries > 0 && c.Raft.MaxAppendEntries <= 1024,
+		"raft.max_append_entries must be between 1 and 1024")
+	check(c.Raft.SnapshotInterval >= 5*time.Millisecond, "raft.snapshot_interval must be at least 5ms")
+	check(c.Raft.SnapshotThreshold > 0, "raft.snapshot_threshold must be positive")
+	check(c.Raft.SnapshotRetain > 0, "raft.snapshot_retain must be positive")
+	check(c.Raft.LogCacheSize > 0, "raft.log_cache_size must be positive")
+	check(c.Raft.MaxPool > 0, "raft.max_pool must be positive")
+	check(c.Raft.TCPTimeout > 0, "raft.tcp_timeout must be positive")
+	if c.Raft.KeyringFile != "" {
+		_, err := os.Stat(c.Raft.KeyringFile)
+		add("raft.keyring_file", err)
+	}
+
+	tlsConf := c.tls()
+	check(tlsConf.CertFile != "" || tlsConf.KeyFile == "", "tls.key_file needs tls.cert_file")
+	check(tlsConf.KeyFile != "" || tlsConf.CertFile == "", "tls.cert_file needs tls.key_file")
+	check(tlsConf.Enabled() || !tlsConf.VerifyClients, "tls.verify_clients needs a certificate")
+	check(tlsConf.CAFile != "" || !tlsConf.VerifyClients, "tls.verify_clients needs tls.ca_file")
+	// raft peers are verified against the CA, never the system roots
+	check(tlsConf.CAFile != "" || !tlsConf.Enabled(), "raft over tls needs tls.ca_file")
+	if tlsConf.CertFile != "" && tlsConf.KeyFile != "" {
+		_, err := tlsConf.Server()
+		add("tls", err)
+	} else if tlsConf.CAFile != "" {
+		_, err := tlsConf.Client()
+		add("tls", err)
+	}
+
+	if c.Audit.File != "" {
+		_, err := audit.ParseClasses(c.Audit.Classes)
+		add("audit.classes", err)
+		_, err = audit.ParseValueMode(c.Audit.Values)
+		add("audit.values", err)
+		check(c.Audit.MaxSize > 0, "audit.max_size must be positive")
+		check(c.Audit.MaxBackups >= 0, "audit.max_backups must not be negative")
+	}
+	add("log", c.logging().Validate())
+	return errors.Join(errs...)
+}
+
+// raftAddr is the address the raft transport binds.
+func (c config) raftAddr() string {
+	return net.JoinHostPort(c.Raft.BindHost, fmt.Sprint(c.Raft.Port))
+}
+
+// raftAdvertise is the address of the node in the raft configuration.
+func (c config) raftAdvertise() string {
+	if c.Raft.AdvertiseAddr != "" {
+		return c.Raft.AdvertiseAddr
+	}
+	return c.raftAddr()
+}
+
+// listenAddr is the address of the client listener.
+func (c config) listenAddr() string {
+	return net.JoinHostPort(c.Server.BindHost, fmt.Sprint(c.Server.Port))
+}
+
+// seeds are the join seeds, the local leader port included.
+func (c config) seeds() []string {
+	seeds := append([]string{}, c.Server.JoinSeeds...)
+	if c.Server.LeaderPort != 0 {
+		seeds = append(seeds, fmt.Sprintf(":%d", c.Server.LeaderPort))
+	}
+	return seeds
+}
+
+func (c config) raftConfig() *raft.Config {
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(c.Raft.NodeId)
+	rc.HeartbeatTimeout = c.Raft.HeartbeatTimeout
+	rc.ElectionTimeout = c.Raft.ElectionTimeout
+	rc.LeaderLeaseTimeout = c.Raft.LeaderLeaseTimeout
+	rc.CommitTimeout = c.Raft.CommitTimeout
+	rc.MaxAppendEntries = c.Raft.MaxAppendEntries
+	rc.SnapshotInterval = c.Raft.SnapshotInterval
+	rc.SnapshotThreshold = c.Raft.SnapshotThreshold
+	rc.TrailingLogs = c.Raft.TrailingLogs
+	return rc
+}
+
+func (c config) tls() tlsutil.Config {
+	return tlsutil.Config{
+		CertFile:      c.TLS.CertFile,
+		KeyFile:       c.TLS.KeyFile,
+		CAFile:        c.TLS.CAFile,
+		VerifyClients: c.TLS.VerifyClients,
+	}
+}
+
+func (c config) logging() logging.Options {
+	return logging.Options{Level: c.Log.Level, Format: c.Log.Format, Output: c.Log.Output}
+}
+
+// redacted is c without its secrets, to be logged.
+func (c config) redacted() config {
+	if c.Raft.JoinSecret != "" {
+		c.Raft.JoinSecret = "<redacted>"
+	}
+	if c.Server.NodeToken != "" {
+		c.Server.NodeToken = "<redacted>"
+	}
+	return c
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, "y3cache.yaml", `
+server:
+  port: 9000
+  join_seeds: [":9100", ":9200"]
+  max_connections: 64
+raft:
+  node_id: node1
+  port: 7000
+  volume_dir: `+dir+`
+  heartbeat_timeout: 500ms
+  election_timeout: 2s
+  leader_lease_timeout: 250ms
+  snapshot_threshold: 4096
+log:
+  level: debug
+`)
+	t.Setenv(raftPort, "7001")
+	t.Setenv(logLevel, "warn")
+	conf, err := loadConfig([]string{"-config", path, "-log.level", "error"})
+	assert.Nil(t, err)
+	assert.Equal(t, 9000, conf.Server.Port)
+	assert.Equal(t, []string{":9100", ":9200"}, conf.Server.JoinSeeds)
+	assert.Equal(t, 64, conf.Server.MaxConnections)
+	// the environment overrides the file, flags override both
+	assert.Equal(t, 7001, conf.Raft.Port)
+	assert.Equal(t, "error", conf.Log.Level)
+	assert.Equal(t, "127.0.0.1:7001", conf.raftAddr())
+
+	rc := conf.raftConfig()
+	assert.Equal(t, 500*time.Millisecond, rc.HeartbeatTimeout)
+	assert.Equal(t, 2*time.Second, rc.ElectionTimeout)
+	assert.Equal(t, uint64(4096), rc.SnapshotThreshold)
+	// defaults
+	assert.Equal(t, 30*time.Second, conf.Server.ShutdownTimeout)
+	assert.Equal(t, 512, conf.Raft.LogCacheSize)
+	assert.Equal(t, 2, conf.Raft.SnapshotRetain)
+
+	toml := writeConfig(t, "y3cache.toml", `
+[server]
+port = 9000
+[raft]
+node_id = "node1"
+port = 7000
+volume_dir = "`+dir+`"
+`)
+	t.Setenv(joinSeeds, ":9100, :9200")
+	conf, err = loadConfig([]string{"-config", toml})
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", conf.Raft.NodeId)
+	assert.Equal(t, []string{":9100", ":9200"}, conf.Server.JoinSeeds)
+}
+
+func TestValidateConfig(t *testing.T) {
+	path := writeConfig(t, "y3cache.yaml", `
+server:
+  port: 70000
+  slowlog_max_len: 0
+raft:
+  port: 7000
+  role: leader
+  formation: join
+  heartbeat_timeout: 1s
+  election_timeout: 500ms
+tls:
+  key_file: key.pem
+log:
+  format: xml
+`)
+	_, err := loadConfig([]string{"-config", path})
+	if !assert.NotNil(t, err) {
+		return
+	}
+	// every error is reported at once
+	for _, want := range []string{
+		"server.port: 70000 is not a port",
+		"server.slowlog_max_len must be positive",
+		"raft.node_id (RAFT_NODE_ID) is required",
+		"raft.volume_dir (RAFT_VOL_DIR) is required",
+		`raft.role: unknown role "leader"`,
+		"raft.formation: join formation needs",
+		"raft.election_timeout must be at least raft.heartbeat_timeout",
+		"tls.key_file needs tls.cert_file",
+		"raft over tls needs tls.ca_file",
+		"invalid log format",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+	assert.GreaterOrEqual(t, len(strings.Split(err.Error(), "\n")), 10)
+
+	_, err = loadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	assert.NotNil(t, err)
+}
+
+func TestAdvertiseConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(serverPort, "9000")
+	t.Setenv(raftNodeId, "node1")
+	t.Setenv(raftPort, "7000")
+	t.Setenv(raftVolDir, dir)
+
+	t.Setenv(serverHost, "::")
+	t.Setenv(raftHost, "::")
+	t.Setenv(serverAdv, "node1.cluster.local:9000")
+	t.Setenv(raftAdv, "[fd00::1]:7000")
+	conf, err := loadConfig(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "[::]:9000", conf.listenAddr())
+	assert.Equal(t, "[::]:7000", conf.raftAddr())
+	assert.Equal(t, "[fd00::1]:7000", conf.raftAdvertise())
+	assert.Equal(t, "node1.cluster.local:9000", conf.Server.AdvertiseAddr)
+
+	// a raft bound on every interface needs an address to advertise
+	t.Setenv(raftAdv, "")
+	t.Setenv(serverAdv, "0.0.0.0:9000")
+	_, err = loadConfig(nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "raft.advertise_addr: other nodes cannot reach [::]:7000, set RAFT_ADVERTISE_ADDR")
+		assert.Contains(t, err.Error(), "server.advertise_addr: other nodes cannot reach 0.0.0.0:9000")
+	}
+}
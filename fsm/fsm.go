@@ -3,20 +3,40 @@ package fsm
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
-	"os"
+	"time"
 
 	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
 
+	"y3cache/acl"
 	"y3cache/cache"
+	"y3cache/cluster"
+	"y3cache/logging"
 	"y3cache/proto"
+	"y3cache/script"
 )
 
+// CommnadPayload is one record of a snapshot. Operation "set" restores a
+// key of Namespace, "namespace" the limits of Namespace, "script" a
+// cached script held in Value, "member" the client address (Value) of
+// the node Key and "user" the ACL User.
 type CommnadPayload struct {
 	Operation string
-	Key       []byte
-	Value     []byte
+	Namespace string `json:",omitempty"`
+	Key       []byte `json:",omitempty"`
+	Value     []byte `json:",omitempty"`
+	// ExpiresAt is the unix time in nanoseconds, zero never expires
+	ExpiresAt int64    `json:",omitempty"`
+	Version   uint64   `json:",omitempty"`
+	Tags      [][]byte `json:",omitempty"`
+
+	MaxMemory  int64         `json:",omitempty"`
+	MaxKeys    int64         `json:",omitempty"`
+	DefaultTTL time.Duration `json:",omitempty"`
+	Policy     byte          `json:",omitempty"`
+
+	User *acl.User `json:",omitempty"`
 }
 
 type ApplyResponse struct {
@@ -24,8 +44,82 @@ type ApplyResponse struct {
 	Data  any
 }
 
+type EventType byte
+
+const (
+	EventSet EventType = iota + 1
+	EventDel
+	EventExpire
+	EventEvict
+	EventPublish
+	// EventAbort marks a transaction whose watches failed, it carries no
+	// key and changed nothing
+	EventAbort
+	// EventRestore is sent without an index once the state was replaced
+	// by a snapshot
+	EventRestore
+	// EventFlush removed every key of the namespace
+	EventFlush
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpire:
+		return "expired"
+	case EventEvict:
+		return "evicted"
+	case EventPublish:
+		return "publish"
+	case EventAbort:
+		return "abort"
+	case EventRestore:
+		return "restore"
+	case EventFlush:
+		return "flush"
+	default:
+		return "none"
+	}
+}
+
+// Event describes one change the FSM applied. For EventPublish Key holds
+// the channel and Value the payload.
+type Event struct {
+	Index     uint64
+	Type      EventType
+	Namespace string
+	Key       []byte
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// Hook is called synchronously from Apply after a command took effect, so
+// it runs on every node in log order and must not block.
+type Hook func(Event)
+
+// y3cacheFSM is used by value, Apply points c and ns at the namespace of
+// the command it applies.
 type y3cacheFSM struct {
-	c cache.Cacher
+	spaces  *cache.Namespaces
+	members *cluster.Members
+	users   *acl.Store
+	c       cache.Cacher
+	ns      string
+	hooks   []Hook
+	scripts *scriptCache
+	logger  *zap.SugaredLogger
+}
+
+func (y y3cacheFSM) notify(ev Event) {
+	if ev.Namespace == "" {
+		ev.Namespace = y.ns
+	}
+	for _, h := range y.hooks {
+		h(ev)
+	}
 }
 
 func (y y3cacheFSM) Apply(log *raft.Log) any {
@@ -34,31 +128,462 @@ func (y y3cacheFSM) Apply(log *raft.Log) any {
 		rd := bytes.NewReader(log.Data)
 		cmd, err := proto.ParseCommand(rd)
 		if err != nil {
-			fmt.Println("parse command error:", err)
+			y.logger.Errorw("parse command error", logging.FieldRaftIndex, log.Index, "error", err)
 			return nil
 		}
+		// the leader's append time is the same on every replica, so TTLs
+		// are measured from it rather than from the local clock
+		appendedAt := log.AppendedAt
+		if appendedAt.IsZero() {
+			appendedAt = time.Now()
+		}
+		y.ns = cache.DefaultNamespace
+		if v, ok := cmd.(*proto.CommandNamespaced); ok {
+			if len(v.Namespace) > 0 {
+				y.ns = string(v.Namespace)
+			}
+			cmd = v.Command
+		}
+		y.c = y.spaces.GetOrCreate(y.ns)
 		switch v := cmd.(type) {
 		case *proto.CommandSet:
-			err := y.c.Set(v.Key, v.Value, 0)
+			return &proto.ResponseSet{
+				Status: y.applySet(log.Index, appendedAt, v),
+			}
+		case *proto.CommandDel:
+			return &proto.ResponseDel{
+				Status: y.applyDel(log.Index, v),
+			}
+		case *proto.CommandExpire:
+			if y.c.Expire(v.Key, appendedAt) {
+				y.notify(Event{Index: log.Index, Type: EventExpire, Key: v.Key})
+			}
+			return nil
+		case *proto.CommandPublish:
+			y.notify(Event{
+				Index: log.Index,
+				Type:  EventPublish,
+				Key:   v.Channel,
+				Value: v.Payload,
+			})
+			return &proto.ResponsePublish{Status: proto.StatusOK}
+		case *proto.CommandExec:
+			return y.applyExec(log.Index, appendedAt, v)
+		case *proto.CommandScriptLoad:
+			sc, err := y.loadScript(v.Script)
 			if err != nil {
-				return &proto.ResponseSet{
+				return &proto.ResponseScriptLoad{Status: proto.StatusError}
+			}
+			return &proto.ResponseScriptLoad{
+				Status: proto.StatusOK,
+				Sha:    []byte(sc.Sha),
+			}
+		case *proto.CommandEval:
+			sc, err := y.loadScript(v.Script)
+			if err != nil {
+				return &proto.ResponseEval{
 					Status: proto.StatusError,
+					Values: [][]byte{[]byte(err.Error())},
 				}
 			}
-			return &proto.ResponseSet{
-				Status: proto.StatusOK,
+			return y.applyScript(log.Index, appendedAt, sc, v.Keys, v.Args)
+		case *proto.CommandEvalSha:
+			sc, ok := y.scripts.get(string(v.Sha))
+			if !ok {
+				return &proto.ResponseEval{Status: proto.StatusNoScript}
+			}
+			return y.applyScript(log.Index, appendedAt, sc, v.Keys, v.Args)
+		case *proto.CommandNamespaceConfig:
+			return y.applyNamespaceConfig(log.Index, v)
+		case *proto.CommandMember:
+			if v.Remove {
+				y.members.Remove(string(v.NodeId))
+			} else {
+				y.members.Set(cluster.Member{
+					ID:            string(v.NodeId),
+					ClientAddress: string(v.ClientAddress),
+				})
+			}
+			return &proto.ResponseStatus{Status: proto.StatusOK}
+		case *proto.CommandACLUser:
+			if v.Remove {
+				y.users.Delete(string(v.Username))
+			} else {
+				y.users.Set(userFromCommand(v))
+			}
+			return &proto.ResponseStatus{Status: proto.StatusOK}
+		case *proto.CommandInvalidate:
+			return y.applyInvalidate(log.Index, v)
+		case *proto.CommandFlush:
+			if len(v.Namespace) > 0 {
+				y.ns = string(v.Namespace)
 			}
+			if c, ok := y.spaces.Get(y.ns); ok {
+				c.Flush()
+				y.notify(Event{Index: log.Index, Type: EventFlush})
+			}
+			return &proto.ResponseStatus{Status: proto.StatusOK}
 		}
 	}
-	_, _ = fmt.Fprintf(os.Stderr, "not raft command type\n")
+	y.logger.Warnw("not a cache command", logging.FieldRaftIndex, log.Index, "type", log.Type.String())
 	return nil
 }
 
-// you can use this method get all data from the cache
-// and pass it to the FSMSnapshot so at the call of
-// persist method of the FSMSnapshot it can save it
+func userFromCommand(cmd *proto.CommandACLUser) *acl.User {
+	u := &acl.User{
+		Name:         string(cmd.Username),
+		Salt:         cmd.Salt,
+		PasswordHash: cmd.PasswordHash,
+		TokenHash:    cmd.TokenHash,
+		Perms:        acl.Perm(cmd.Rule.Perms),
+	}
+	for _, k := range cmd.Rule.Keys {
+		u.Keys = append(u.Keys, string(k))
+	}
+	for _, ns := range cmd.Rule.Namespaces {
+		u.Namespaces = append(u.Namespaces, string(ns))
+	}
+	return u
+}
+
+func (y y3cacheFSM) applySet(
+	index uint64,
+	appendedAt time.Time,
+	cmd *proto.CommandSet,
+) proto.Status {
+	evicted, err := y.c.MakeRoom(cmd.Key, len(cmd.Value))
+	if err != nil {
+		return proto.StatusFull
+	}
+	y.notifyEvicted(index, evicted)
+	return y.storeSet(index, appendedAt, cmd)
+}
+
+// storeSet writes cmd once room was made for it.
+func (y y3cacheFSM) storeSet(
+	index uint64,
+	appendedAt time.Time,
+	cmd *proto.CommandSet,
+) proto.Status {
+	var expiresAt time.Time
+	if cmd.TTL > 0 {
+		expiresAt = appendedAt.Add(time.Duration(cmd.TTL) * time.Second)
+	} else if ttl := y.c.Limits().DefaultTTL; ttl > 0 {
+		expiresAt = appendedAt.Add(ttl)
+	}
+	// a deadline already in the past is stored as well, the leader
+	// expires it through the log like any other
+	if err := y.c.SetUntil(cmd.Key, cmd.Value, expiresAt); err != nil {
+		return proto.StatusError
+	}
+	y.c.SetVersion(cmd.Key, index)
+	y.c.SetTags(cmd.Key, cmd.Tags)
+	y.notify(Event{
+		Index:     index,
+		Type:      EventSet,
+		Key:       cmd.Key,
+		Value:     cmd.Value,
+		ExpiresAt: expiresAt,
+	})
+	return proto.StatusOK
+}
+
+func (y y3cacheFSM) applyDel(
+	index uint64,
+	cmd *proto.CommandDel,
+) proto.Status {
+	// the version tells whether the key is stored regardless of the local
+	// clock, Has would hide an expired key on some replicas only
+	if y.c.Version(cmd.Key) == 0 {
+		return proto.StatusKeyNotFound
+	}
+	if err := y.c.Delete(cmd.Key); err != nil {
+		return proto.StatusError
+	}
+	y.notify(Event{Index: index, Type: EventDel, Key: cmd.Key})
+	return proto.StatusOK
+}
+
+// applyInvalidate deletes every key carrying one of the tags, in key order
+// so the events come out the same on every replica.
+func (y y3cacheFSM) applyInvalidate(
+	index uint64,
+	cmd *proto.CommandInvalidate,
+) *proto.ResponseInvalidate {
+	resp := &proto.ResponseInvalidate{Status: proto.StatusOK}
+	for _, key := range y.c.TaggedKeys(cmd.Tags...) {
+		if err := y.c.Delete(key); err != nil {
+			resp.Status = proto.StatusError
+			continue
+		}
+		resp.Count++
+		y.notify(Event{Index: index, Type: EventDel, Key: key})
+	}
+	return resp
+}
+
+func (y y3cacheFSM) notifyEvicted(index uint64, keys [][]byte) {
+	for _, key := range keys {
+		y.notify(Event{Index: index, Type: EventEvict, Key: key})
+	}
+}
+
+// NamespaceLimits are the limits cmd sets.
+func NamespaceLimits(cmd *proto.CommandNamespaceConfig) cache.Limits {
+	return cache.Limits{
+		MaxMemory:  cmd.MaxMemory,
+		MaxKeys:    cmd.MaxKeys,
+		DefaultTTL: time.Duration(cmd.DefaultTTL) * time.Second,
+		Policy:     cache.EvictionPolicy(cmd.Policy),
+	}
+}
+
+// applyNamespaceConfig creates the namespace or replaces its limits and
+// evicts down to them. Invalid limits are refused with StatusError, the
+// leader refuses them before they reach the log.
+func (y y3cacheFSM) applyNamespaceConfig(
+	index uint64,
+	cmd *proto.CommandNamespaceConfig,
+) *proto.ResponseStatus {
+	limits := NamespaceLimits(cmd)
+	if err := limits.Validate(); err != nil {
+		return &proto.ResponseStatus{Status: proto.StatusError}
+	}
+	if len(cmd.Namespace) > 0 {
+		y.ns = string(cmd.Namespace)
+	}
+	y.c = y.spaces.GetOrCreate(y.ns)
+	y.c.SetLimits(limits)
+	evicted, err := y.c.MakeRoom(nil, 0)
+	if err != nil {
+		// noeviction keeps the keys, new writes fail until it
+		// drops below the limits
+		return &proto.ResponseStatus{Status: proto.StatusOK}
+	}
+	y.notifyEvicted(index, evicted)
+	return &proto.ResponseStatus{Status: proto.StatusOK}
+}
+
+// applyExec runs every op of the transaction or none of them. It is refused
+// with StatusError when an op is not allowed in a transaction, StatusFull
+// when its writes do not fit the namespace and aborted when a watched key
+// changed since it was read.
+func (y y3cacheFSM) applyExec(
+	index uint64,
+	appendedAt time.Time,
+	cmd *proto.CommandExec,
+) *proto.ResponseExec {
+	for _, op := range cmd.Ops {
+		switch op.(type) {
+		case *proto.CommandSet, *proto.CommandDel, *proto.CommandGet:
+		default:
+			return &proto.ResponseExec{Status: proto.StatusError}
+		}
+	}
+	for _, w := range cmd.Watches {
+		if y.c.Version(w.Key) != w.Version {
+			y.notify(Event{Index: index, Type: EventAbort})
+			return &proto.ResponseExec{Status: proto.StatusAborted}
+		}
+	}
+	results, status := y.applyBatch(index, appendedAt, cmd.Ops)
+	return &proto.ResponseExec{Status: status, Results: results}
+}
+
+// saved is a key as it was before a batch wrote it.
+type saved struct {
+	key       []byte
+	value     []byte
+	expiresAt time.Time
+	version   uint64
+	tags      [][]byte
+}
+
+func (y y3cacheFSM) save(key []byte) saved {
+	value, expiresAt, _ := y.c.Lookup(key)
+	return saved{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+		version:   y.c.Version(key),
+		tags:      y.c.Tags(key),
+	}
+}
+
+func (y y3cacheFSM) restore(k saved) {
+	if k.version == 0 {
+		y.c.Delete(k.key)
+		return
+	}
+	y.c.SetUntil(k.key, k.value, k.expiresAt)
+	y.c.SetVersion(k.key, k.version)
+	y.c.SetTags(k.key, k.tags)
+}
+
+// applyBatch runs the SETs, DELs and GETs of ops as one: the room every
+// write needs is made before any runs, StatusFull when they do not fit,
+// and the writes are undone on the first op that fails. Their events are
+// only sent once every op succeeded.
+func (y y3cacheFSM) applyBatch(
+	index uint64,
+	appendedAt time.Time,
+	ops []any,
+) ([]proto.OpResult, proto.Status) {
+	var changes []cache.Change
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *proto.CommandSet:
+			changes = append(changes, cache.Change{Key: v.Key, Size: len(v.Value)})
+		case *proto.CommandDel:
+			changes = append(changes, cache.Change{Key: v.Key, Delete: true})
+		}
+	}
+	evicted, err := y.c.MakeRoomFor(changes)
+	if err != nil {
+		return nil, proto.StatusFull
+	}
+	y.notifyEvicted(index, evicted)
+
+	var events []Event
+	staged := y
+	staged.hooks = []Hook{func(ev Event) { events = append(events, ev) }}
+	var undo []saved
+	results := make([]proto.OpResult, len(ops))
+	for i, op := range ops {
+		var status proto.Status
+		switch v := op.(type) {
+		case *proto.CommandSet:
+			undo = append(undo, y.save(v.Key))
+			status = staged.storeSet(index, appendedAt, v)
+		case *proto.CommandDel:
+			undo = append(undo, y.save(v.Key))
+			status = staged.applyDel(index, v)
+		case *proto.CommandGet:
+			value, err := y.c.Get(v.Key)
+			if err != nil {
+				results[i].Status = proto.StatusKeyNotFound
+				continue
+			}
+			results[i] = proto.OpResult{Status: proto.StatusOK, Value: value}
+			continue
+		}
+		results[i].Status = status
+		if status != proto.StatusOK && status != proto.StatusKeyNotFound {
+			for j := len(undo) - 1; j >= 0; j-- {
+				y.restore(undo[j])
+			}
+			return nil, status
+		}
+	}
+	for _, ev := range events {
+		y.notify(ev)
+	}
+	return results, proto.StatusOK
+}
+
+func (y y3cacheFSM) loadScript(source []byte) (*script.Script, error) {
+	sha := script.Sha(string(source))
+	if sc, ok := y.scripts.get(sha); ok {
+		return sc, nil
+	}
+	sc, err := script.Compile(string(source))
+	if err != nil {
+		return nil, err
+	}
+	y.scripts.add(sc)
+	return sc, nil
+}
+
+// applyScript runs sc and applies its writes only when it succeeded and
+// they all fit the namespace, a failing script changes nothing on any
+// replica.
+func (y y3cacheFSM) applyScript(
+	index uint64,
+	appendedAt time.Time,
+	sc *script.Script,
+	keys, args [][]byte,
+) *proto.ResponseEval {
+	result, writes, err := sc.Run(script.Env{
+		Keys:   keys,
+		Args:   args,
+		Now:    appendedAt,
+		Index:  index,
+		Store:  y.c,
+		Limits: script.DefaultLimits,
+	})
+	if err != nil {
+		return &proto.ResponseEval{
+			Status: proto.StatusError,
+			Values: [][]byte{[]byte(err.Error())},
+		}
+	}
+	ops := make([]any, len(writes))
+	for i, w := range writes {
+		if w.Delete {
+			ops[i] = &proto.CommandDel{Key: w.Key}
+			continue
+		}
+		ops[i] = &proto.CommandSet{Key: w.Key, Value: w.Value, TTL: w.TTL}
+	}
+	if _, status := y.applyBatch(index, appendedAt, ops); status != proto.StatusOK {
+		return &proto.ResponseEval{Status: status}
+	}
+	return &proto.ResponseEval{
+		Status: proto.StatusOK,
+		Values: script.Encode(result),
+	}
+}
+
+// Snapshot copies the cache so the snapshot can be persisted while Apply
+// keeps running.
 func (y y3cacheFSM) Snapshot() (raft.FSMSnapshot, error) {
-	return NoOpSnp{}, nil
+	snp := &y3cacheSnapshot{}
+	for _, sc := range y.scripts.all() {
+		snp.records = append(snp.records, &CommnadPayload{
+			Operation: "script",
+			Value:     []byte(sc.Source),
+		})
+	}
+	for _, m := range y.members.All() {
+		snp.records = append(snp.records, &CommnadPayload{
+			Operation: "member",
+			Key:       []byte(m.ID),
+			Value:     []byte(m.ClientAddress),
+		})
+	}
+	for _, u := range y.users.Users() {
+		snp.records = append(snp.records, &CommnadPayload{
+			Operation: "user",
+			User:      u,
+		})
+	}
+	for _, name := range y.spaces.Names() {
+		c, _ := y.spaces.Get(name)
+		l := c.Limits()
+		snp.records = append(snp.records, &CommnadPayload{
+			Operation:  "namespace",
+			Namespace:  name,
+			MaxMemory:  l.MaxMemory,
+			MaxKeys:    l.MaxKeys,
+			DefaultTTL: l.DefaultTTL,
+			Policy:     byte(l.Policy),
+		})
+		for _, it := range c.Items() {
+			data := &CommnadPayload{
+				Operation: "set",
+				Namespace: name,
+				Key:       it.Key,
+				Value:     it.Value,
+				Version:   it.Version,
+				Tags:      it.Tags,
+			}
+			if !it.ExpiresAt.IsZero() {
+				data.ExpiresAt = it.ExpiresAt.UnixNano()
+			}
+			snp.records = append(snp.records, data)
+		}
+	}
+	return snp, nil
 }
 
 // snapshot: the snapshot written to the sink so you can
@@ -66,62 +591,131 @@ func (y y3cacheFSM) Snapshot() (raft.FSMSnapshot, error) {
 func (y y3cacheFSM) Restore(snapshot io.ReadCloser) error {
 	defer func() {
 		if err := snapshot.Close(); err != nil {
-			_, _ = fmt.Fprintf(
-				os.Stdout,
-				"[FINALLY RESTORE] close error %s",
-				err.Error(),
-			)
+			y.logger.Warnw("closing snapshot failed", "error", err)
 		}
 	}()
-	_, _ = fmt.Fprintf(
-		os.Stdout,
-		"[START RESTORE] read all message from snapshot\n",
-	)
+	y.logger.Infow("restoring snapshot")
+	y.spaces.Reset()
+	y.members.Reset()
+	y.users.Reset()
+	y.scripts.reset()
 	var totalRestored int
 	decoder := json.NewDecoder(snapshot)
+	if _, err := decoder.Token(); err != nil {
+		y.logger.Errorw("restoring snapshot failed", "error", err)
+		return err
+	}
 	for decoder.More() {
 		data := &CommnadPayload{}
-		err := decoder.Decode(data)
-		fmt.Printf("data: %v, total: %d", data, totalRestored)
-		if err != nil {
-			_, _ = fmt.Fprintf(
-				os.Stdout,
-				"[END RESTORE] error decode data %s\n", err.Error())
+		if err := decoder.Decode(data); err != nil {
+			y.logger.Errorw("restoring snapshot failed", "restored", totalRestored, "error", err)
 			return err
 		}
-		if err := y.c.Set(data.Key, data.Value, 0); err != nil {
-			_, _ = fmt.Fprintf(
-				os.Stdout,
-				"[END RESTORE] error persist data %s\n", err.Error())
+		switch data.Operation {
+		case "script":
+			if _, err := y.loadScript(data.Value); err != nil {
+				return err
+			}
+			continue
+		case "member":
+			y.members.Set(cluster.Member{
+				ID:            string(data.Key),
+				ClientAddress: string(data.Value),
+			})
+			continue
+		case "user":
+			if data.User != nil {
+				y.users.Set(data.User)
+			}
+			continue
+		case "namespace":
+			y.spaces.GetOrCreate(data.Namespace).SetLimits(cache.Limits{
+				MaxMemory:  data.MaxMemory,
+				MaxKeys:    data.MaxKeys,
+				DefaultTTL: data.DefaultTTL,
+				Policy:     cache.EvictionPolicy(data.Policy),
+			})
+			continue
+		}
+		var expiresAt time.Time
+		if data.ExpiresAt != 0 {
+			expiresAt = time.Unix(0, data.ExpiresAt)
+		}
+		c := y.spaces.GetOrCreate(data.Namespace)
+		if err := c.SetUntil(data.Key, data.Value, expiresAt); err != nil {
+			y.logger.Errorw(
+				"restoring key failed",
+				logging.FieldKeyHash,
+				logging.HashKey(data.Key),
+				"error",
+				err,
+			)
 			return err
 		}
+		c.SetVersion(data.Key, data.Version)
+		c.SetTags(data.Key, data.Tags)
 		totalRestored++
 	}
 	_, err := decoder.Token()
 	if err != nil {
-		_, _ = fmt.Fprintf(
-			os.Stdout,
-			"[END RESTORE] error %s\n", err.Error())
+		y.logger.Errorw("restoring snapshot failed", "error", err)
 		return err
 	}
 
-	_, _ = fmt.Fprintf(
-		os.Stdout,
-		"[END RESTORE] success restore %d message in snapshot\n", totalRestored)
+	y.notify(Event{Type: EventRestore})
+	y.logger.Infow("snapshot restored", "keys", totalRestored)
 	return nil
 }
 
-func NewY3CacheFSM(y cache.Cacher) raft.FSM {
+func NewY3CacheFSM(
+	spaces *cache.Namespaces,
+	members *cluster.Members,
+	users *acl.Store,
+	logger *zap.Logger,
+	hooks ...Hook,
+) raft.FSM {
 	return &y3cacheFSM{
-		c: y,
+		spaces:  spaces,
+		members: members,
+		users:   users,
+		c:       spaces.Default(),
+		ns:      cache.DefaultNamespace,
+		hooks:   hooks,
+		scripts: newScriptCache(MaxScripts),
+		logger:  logging.OrNop(logger).Named("fsm").Sugar(),
 	}
 }
 
-type NoOpSnp struct{}
+type y3cacheSnapshot struct {
+	records []*CommnadPayload
+}
 
-// use the NoOpSnp to get current snapshot made by Snapshot()
-// and write it to g
-func (s NoOpSnp) Persist(g raft.SnapshotSink) error {
-	return nil
+// Persist writes the records as a json array of CommnadPayload, the format
+// Restore reads back. A namespace record always comes before its keys.
+func (s *y3cacheSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := func() error {
+		if _, err := sink.Write([]byte("[")); err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(sink)
+		for i, data := range s.records {
+			if i > 0 {
+				if _, err := sink.Write([]byte(",")); err != nil {
+					return err
+				}
+			}
+			if err := encoder.Encode(data); err != nil {
+				return err
+			}
+		}
+		_, err := sink.Write([]byte("]"))
+		return err
+	}()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
 }
-func (s NoOpSnp) Release() {}
+
+func (s *y3cacheSnapshot) Release() {}
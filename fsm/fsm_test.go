@@ -0,0 +1,280 @@
+package fsm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+
+	"y3cache/acl"
+	"y3cache/cache"
+	"y3cache/cluster"
+	"y3cache/proto"
+)
+
+func applyCmd(f raft.FSM, index uint64, cmd interface{ Bytes() []byte }) any {
+	return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: cmd.Bytes()})
+}
+
+func TestExec(t *testing.T) {
+	spaces := cache.NewNamespaces()
+	f := NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil)
+	c := spaces.Default()
+	applyCmd(f, 1, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+	assert.Equal(t, uint64(1), c.Version([]byte("a")))
+
+	tx := &proto.CommandExec{
+		Watches: []proto.WatchedKey{{Key: []byte("a"), Version: 1}},
+		Ops: []any{
+			&proto.CommandSet{Key: []byte("a"), Value: []byte("2")},
+			&proto.CommandGet{Key: []byte("a")},
+			&proto.CommandDel{Key: []byte("b")},
+		},
+	}
+	resp := applyCmd(f, 2, tx).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusOK, resp.Status)
+	assert.Equal(t, []proto.OpResult{
+		{Status: proto.StatusOK},
+		{Status: proto.StatusOK, Value: []byte("2")},
+		{Status: proto.StatusKeyNotFound},
+	}, resp.Results)
+
+	// a was rewritten at index 2, the same watch now aborts
+	resp = applyCmd(f, 3, tx).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusAborted, resp.Status)
+	v, _ := c.Get([]byte("a"))
+	assert.Equal(t, []byte("2"), v)
+}
+
+func TestExecLimits(t *testing.T) {
+	spaces := cache.NewNamespaces()
+	var events []Event
+	f := NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil, func(ev Event) {
+		events = append(events, ev)
+	})
+	c := spaces.Default()
+	applyCmd(f, 1, &proto.CommandNamespaceConfig{MaxKeys: 2, Policy: byte(cache.NoEviction)})
+	applyCmd(f, 2, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+	events = nil
+
+	// the second SET does not fit, the first one is not applied either
+	resp := applyCmd(f, 3, &proto.CommandExec{Ops: []any{
+		&proto.CommandSet{Key: []byte("b"), Value: []byte("2")},
+		&proto.CommandSet{Key: []byte("c"), Value: []byte("3")},
+	}}).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusFull, resp.Status)
+	assert.False(t, c.Has([]byte("b")))
+	assert.Empty(t, events)
+
+	// a DEL of the same batch makes room
+	resp = applyCmd(f, 4, &proto.CommandExec{Ops: []any{
+		&proto.CommandSet{Key: []byte("b"), Value: []byte("2")},
+		&proto.CommandSet{Key: []byte("c"), Value: []byte("3")},
+		&proto.CommandDel{Key: []byte("a")},
+	}}).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusOK, resp.Status)
+	assert.Equal(t, int64(2), c.Stats().Keys)
+	assert.Len(t, events, 3)
+
+	applyCmd(f, 5, &proto.CommandNamespaceConfig{MaxMemory: 8, Policy: byte(cache.EvictOldest)})
+	events = nil
+	// the batch writes 8 bytes: b and c are evicted, never d written
+	// before e
+	resp = applyCmd(f, 6, &proto.CommandExec{Ops: []any{
+		&proto.CommandSet{Key: []byte("d"), Value: []byte("444")},
+		&proto.CommandSet{Key: []byte("e"), Value: []byte("555")},
+	}}).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusOK, resp.Status)
+	assert.True(t, c.Has([]byte("d")))
+	assert.True(t, c.Has([]byte("e")))
+	assert.False(t, c.Has([]byte("b")))
+
+	resp = applyCmd(f, 7, &proto.CommandExec{Ops: []any{
+		&proto.CommandSet{Key: []byte("f"), Value: []byte("6")},
+		&proto.CommandSet{Key: []byte("g"), Value: []byte("7777777")},
+	}}).(*proto.ResponseExec)
+	assert.Equal(t, proto.StatusFull, resp.Status)
+	assert.False(t, c.Has([]byte("f")))
+	assert.True(t, c.Has([]byte("d")))
+}
+
+func TestScriptLimits(t *testing.T) {
+	spaces := cache.NewNamespaces()
+	f := NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil)
+	c := spaces.Default()
+	applyCmd(f, 1, &proto.CommandNamespaceConfig{MaxKeys: 2, Policy: byte(cache.NoEviction)})
+	applyCmd(f, 2, &proto.CommandSet{Key: []byte("a"), Value: []byte("1")})
+
+	eval := &proto.CommandEval{Script: []byte(`(set "b" 2) (set "c" 3) "done"`)}
+	resp := applyCmd(f, 3, eval).(*proto.ResponseEval)
+	assert.Equal(t, proto.StatusFull, resp.Status)
+	assert.False(t, c.Has([]byte("b")))
+
+	eval = &proto.CommandEval{Script: []byte(`(set "b" 2) (set "c" 3) (del "a") "done"`)}
+	resp = applyCmd(f, 4, eval).(*proto.ResponseEval)
+	assert.Equal(t, proto.StatusOK, resp.Status)
+	assert.Equal(t, [][]byte{[]byte("done")}, resp.Values)
+	assert.True(t, c.Has([]byte("c")))
+}
+
+func TestNamespaces(t *testing.T) {
+	spaces := cache.NewNamespaces()
+	var evicted [][]byte
+	f := NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil, func(ev Event) {
+		if ev.Type == EventEvict {
+			assert.Equal(t, "small", ev.Namespace)
+			evicted = append(evicted, ev.Key)
+		}
+	})
+	applyCmd(f, 1, &proto.CommandNamespaceConfig{
+		Namespace: []byte("small"),
+		MaxKeys:   2,
+		Policy:    byte(cache.EvictOldest),
+	})
+	for i, key := range []string{"a", "b", "c"} {
+		resp := applyCmd(f, uint64(i+2), &proto.CommandNamespaced{
+			Namespace: []byte("small"),
+			Command:   &proto.CommandSet{Key: []byte(key), Value: []byte("v")},
+		}).(*proto.ResponseSet)
+		assert.Equal(t, proto.StatusOK, resp.Status)
+	}
+	applyCmd(f, 5, &proto.CommandSet{Key: []byte("a"), Value: []byte("default")})
+
+	// the oldest write of the namespace goes, the default one is untouched
+	assert.Equal(t, [][]byte{[]byte("a")}, evicted)
+	small, _ := spaces.Get("small")
+	assert.Equal(t, int64(2), small.Stats().Keys)
+	assert.False(t, small.Has([]byte("a")))
+	v, _ := spaces.Default().Get([]byte("a"))
+	assert.Equal(t, []byte("default"), v)
+
+	applyCmd(f, 6, &proto.CommandNamespaceConfig{
+		Namespace: []byte("small"),
+		MaxKeys:   2,
+		Policy:    byte(cache.NoEviction),
+	})
+	resp := applyCmd(f, 7, &proto.CommandNamespaced{
+		Namespace: []byte("small"),
+		Command:   &proto.CommandSet{Key: []byte("d"), Value: []byte("v")},
+	}).(*proto.ResponseSet)
+	assert.Equal(t, proto.StatusFull, resp.Status)
+
+	// invalid limits change nothing
+	for _, cmd := range []*proto.CommandNamespaceConfig{
+		{Namespace: []byte("small"), Policy: 9},
+		{Namespace: []byte("small"), MaxKeys: -1},
+		{Namespace: []byte("small"), MaxMemory: -1},
+		{Namespace: []byte("other"), DefaultTTL: -1},
+	} {
+		status := applyCmd(f, 8, cmd).(*proto.ResponseStatus)
+		assert.Equal(t, proto.StatusError, status.Status)
+	}
+	assert.Equal(t, cache.NoEviction, small.Limits().Policy)
+	_, ok := spaces.Get("other")
+	assert.False(t, ok)
+
+	applyCmd(f, 8, &proto.CommandFlush{Namespace: []byte("small")})
+	assert.Equal(t, int64(0), small.Stats().Keys)
+	assert.Equal(t, int64(1), spaces.Default().Stats().Keys)
+}
+
+func TestInvalidate(t *testing.T) {
+	spaces := cache.NewNamespaces()
+	var deleted [][]byte
+	f := NewY3CacheFSM(spaces, cluster.NewMembers(), acl.NewStore(), nil, func(ev Event) {
+		if ev.Type == EventDel {
+			deleted = append(deleted, ev.Key)
+		}
+	})
+	c := spaces.Default()
+	tag := func(tags ...string) [][]byte {
+		out := make([][]byte, len(tags))
+		for i, t := range tags {
+			out[i] = []byte(t)
+		}
+		return out
+	}
+	applyCmd(f, 1, &proto.CommandSet{Key: []byte("a"), Value: []byte("1"), Tags: tag("user:1")})
+	applyCmd(f, 2, &proto.CommandSet{Key: []byte("b"), Value: []byte("1"), Tags: tag("user:1", "post:1")})
+	applyCmd(f, 3, &proto.CommandSet{Key: []byte("c"), Value: []byte("1"), Tags: tag("post:2")})
+	// rewriting a without tags drops it from user:1
+	applyCmd(f, 4, &proto.CommandSet{Key: []byte("a"), Value: []byte("2")})
+	applyCmd(f, 5, &proto.CommandDel{Key: []byte("c")})
+	assert.Empty(t, c.TaggedKeys([]byte("post:2")))
+
+	resp := applyCmd(f, 6, &proto.CommandInvalidate{Tags: tag("user:1", "post:2")}).(*proto.ResponseInvalidate)
+	assert.Equal(t, int32(1), resp.Count)
+	assert.Equal(t, tag("c", "b"), deleted)
+	assert.True(t, c.Has([]byte("a")))
+	assert.False(t, c.Has([]byte("b")))
+	assert.Empty(t, c.TaggedKeys([]byte("post:1")))
+
+	now := time.Now()
+	f.Apply(&raft.Log{Index: 7, AppendedAt: now, Data: (&proto.CommandSet{
+		Key: []byte("d"), Value: []byte("1"), TTL: 1, Tags: tag("session"),
+	}).Bytes()})
+	f.Apply(&raft.Log{Index: 8, AppendedAt: now.Add(time.Second), Data: (&proto.CommandExpire{
+		Key: []byte("d"),
+	}).Bytes()})
+	assert.Empty(t, c.TaggedKeys([]byte("session")))
+}
+
+func TestTimings(t *testing.T) {
+	timings := NewTimings(2)
+	f := Timed(NewY3CacheFSM(cache.NewNamespaces(), cluster.NewMembers(), acl.NewStore(), nil), timings)
+	for i := uint64(1); i <= 3; i++ {
+		applyCmd(f, i, &proto.CommandSet{Key: []byte("k"), Value: []byte("v")})
+	}
+	_, _, ok := timings.Get(1)
+	assert.False(t, ok)
+	start, _, ok := timings.Get(3)
+	assert.True(t, ok)
+	assert.False(t, start.IsZero())
+	_, _, ok = timings.Get(4)
+	assert.False(t, ok)
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestScriptCache(t *testing.T) {
+	f := NewY3CacheFSM(cache.NewNamespaces(), cluster.NewMembers(), acl.NewStore(), nil)
+	f.(*y3cacheFSM).scripts = newScriptCache(2)
+	load := func(f raft.FSM, index uint64, source string) string {
+		resp := applyCmd(f, index, &proto.CommandScriptLoad{Script: []byte(source)})
+		return string(resp.(*proto.ResponseScriptLoad).Sha)
+	}
+	evalSha := func(f raft.FSM, index uint64, sha string) proto.Status {
+		resp := applyCmd(f, index, &proto.CommandEvalSha{Sha: []byte(sha)})
+		return resp.(*proto.ResponseEval).Status
+	}
+	a, b := load(f, 1, `"a"`), load(f, 2, `"b"`)
+	// a was used last, b is dropped for c
+	assert.Equal(t, proto.StatusOK, evalSha(f, 3, a))
+	c := load(f, 4, `"c"`)
+	assert.Equal(t, proto.StatusNoScript, evalSha(f, 5, b))
+	assert.Equal(t, proto.StatusOK, evalSha(f, 6, c))
+
+	// the order of use is kept in snapshots, a restored replica drops the
+	// same script next
+	snp, err := f.Snapshot()
+	assert.Nil(t, err)
+	sink := &bufferSink{}
+	assert.Nil(t, snp.Persist(sink))
+	restored := NewY3CacheFSM(cache.NewNamespaces(), cluster.NewMembers(), acl.NewStore(), nil)
+	restored.(*y3cacheFSM).scripts = newScriptCache(2)
+	assert.Nil(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	for _, f := range []raft.FSM{f, restored} {
+		load(f, 7, `"d"`)
+		assert.Equal(t, proto.StatusNoScript, evalSha(f, 8, a))
+		assert.Equal(t, proto.StatusOK, evalSha(f, 9, c))
+	}
+}
@@ -0,0 +1,64 @@
+package fsm
+
+import (
+	"container/list"
+
+	"y3cache/script"
+)
+
+// MaxScripts bounds the scripts kept for EVALSHA, the least recently used
+// one is dropped first. Every replica uses scripts in log order so they all
+// drop the same one.
+const MaxScripts = 1000
+
+// scriptCache holds the compiled scripts from the least to the most
+// recently used.
+type scriptCache struct {
+	size  int
+	order *list.List
+	bySha map[string]*list.Element
+}
+
+func newScriptCache(size int) *scriptCache {
+	return &scriptCache{
+		size:  size,
+		order: list.New(),
+		bySha: make(map[string]*list.Element),
+	}
+}
+
+func (s *scriptCache) get(sha string) (*script.Script, bool) {
+	el, ok := s.bySha[sha]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToBack(el)
+	return el.Value.(*script.Script), true
+}
+
+func (s *scriptCache) add(sc *script.Script) {
+	if _, ok := s.get(sc.Sha); ok {
+		return
+	}
+	s.bySha[sc.Sha] = s.order.PushBack(sc)
+	for s.order.Len() > s.size {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.bySha, oldest.Value.(*script.Script).Sha)
+	}
+}
+
+// all returns the scripts least recently used first, adding them back in
+// that order restores the same cache.
+func (s *scriptCache) all() []*script.Script {
+	scripts := make([]*script.Script, 0, s.order.Len())
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		scripts = append(scripts, el.Value.(*script.Script))
+	}
+	return scripts
+}
+
+func (s *scriptCache) reset() {
+	s.order.Init()
+	s.bySha = make(map[string]*list.Element)
+}
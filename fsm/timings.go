@@ -0,0 +1,64 @@
+package fsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Timings remembers how long the FSM took to apply the last entries, so
+// the node that proposed one can tell its FSM time apart from raft's.
+type Timings struct {
+	lock  sync.Mutex
+	slots []timing
+}
+
+type timing struct {
+	index uint64
+	start time.Time
+	took  time.Duration
+}
+
+// NewTimings remembers the last size entries, older ones are overwritten.
+func NewTimings(size int) *Timings {
+	if size <= 0 {
+		size = 1
+	}
+	return &Timings{slots: make([]timing, size)}
+}
+
+func (t *Timings) record(index uint64, start time.Time, took time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.slots[index%uint64(len(t.slots))] = timing{index: index, start: start, took: took}
+}
+
+// Get returns when the entry at index started to apply and how long it
+// took, false when it was not applied yet or was overwritten.
+func (t *Timings) Get(index uint64) (time.Time, time.Duration, bool) {
+	if t == nil {
+		return time.Time{}, 0, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.slots[index%uint64(len(t.slots))]
+	return s.start, s.took, s.index == index && index != 0
+}
+
+type timedFSM struct {
+	raft.FSM
+	timings *Timings
+}
+
+// Timed records in timings how long f takes to apply every entry.
+func Timed(f raft.FSM, timings *Timings) raft.FSM {
+	return &timedFSM{FSM: f, timings: timings}
+}
+
+func (f *timedFSM) Apply(log *raft.Log) any {
+	start := time.Now()
+	resp := f.FSM.Apply(log)
+	f.timings.record(log.Index, start, time.Since(start))
+	return resp
+}
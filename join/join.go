@@ -0,0 +1,103 @@
+// Package join authenticates the nodes asking to join the cluster. A
+// joining node signs its CommandJoin with the shared cluster secret, the
+// secret itself never goes over the wire.
+package join
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"y3cache/proto"
+)
+
+// DefaultWindow is how far a join's timestamp may be from the leader's
+// clock, and how long its nonce is remembered.
+const DefaultWindow = time.Minute
+
+var (
+	ErrNoSecret     = errors.New("joins are disabled, no cluster secret is configured")
+	ErrBadSignature = errors.New("bad join signature")
+	ErrExpired      = errors.New("join token expired")
+	ErrReplayed     = errors.New("join token already used")
+)
+
+// Sign stamps cmd with the current time, a random nonce and the HMAC of
+// both along with the node id, addresses and role.
+func Sign(secret []byte, cmd *proto.CommandJoin, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	cmd.Timestamp = now.UnixNano()
+	cmd.Nonce = nonce
+	cmd.Mac = mac(secret, cmd)
+	return nil
+}
+
+func mac(secret []byte, cmd *proto.CommandJoin) []byte {
+	buf := new(bytes.Buffer)
+	for _, b := range [][]byte{cmd.NodeId, cmd.RaftAddress, cmd.ClientAddress, cmd.Nonce} {
+		binary.Write(buf, binary.LittleEndian, int32(len(b)))
+		buf.Write(b)
+	}
+	binary.Write(buf, binary.LittleEndian, cmd.Role)
+	binary.Write(buf, binary.LittleEndian, cmd.Timestamp)
+	h := hmac.New(sha256.New, secret)
+	h.Write(buf.Bytes())
+	return h.Sum(nil)
+}
+
+// Verifier checks signed joins, each token is accepted once.
+type Verifier struct {
+	secret []byte
+	window time.Duration
+
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewVerifier(secret []byte, window time.Duration) *Verifier {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Verifier{
+		secret: secret,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Verify accepts cmd if it was signed with the secret within the window
+// around now and its nonce was not seen yet.
+func (v *Verifier) Verify(cmd *proto.CommandJoin, now time.Time) error {
+	if len(v.secret) == 0 {
+		return ErrNoSecret
+	}
+	if !hmac.Equal(cmd.Mac, mac(v.secret, cmd)) {
+		return ErrBadSignature
+	}
+	at := time.Unix(0, cmd.Timestamp)
+	if at.Before(now.Add(-v.window)) || at.After(now.Add(v.window)) {
+		return ErrExpired
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	// a nonce only has to be remembered while its timestamp is accepted
+	for nonce, t := range v.seen {
+		if t.Before(now.Add(-v.window)) {
+			delete(v.seen, nonce)
+		}
+	}
+	if _, ok := v.seen[string(cmd.Nonce)]; ok {
+		return ErrReplayed
+	}
+	v.seen[string(cmd.Nonce)] = at
+	return nil
+}
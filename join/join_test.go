@@ -0,0 +1,34 @@
+package join
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"y3cache/proto"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Now()
+	v := NewVerifier(secret, time.Minute)
+
+	cmd := &proto.CommandJoin{NodeId: []byte("node-2"), RaftAddress: []byte("127.0.0.1:7002")}
+	assert.Nil(t, Sign(secret, cmd, now))
+	assert.Nil(t, v.Verify(cmd, now))
+	assert.Equal(t, ErrReplayed, v.Verify(cmd, now.Add(time.Second)))
+
+	other := &proto.CommandJoin{NodeId: []byte("node-3"), RaftAddress: []byte("127.0.0.1:7003")}
+	assert.Nil(t, Sign([]byte("wrong"), other, now))
+	assert.Equal(t, ErrBadSignature, v.Verify(other, now))
+
+	assert.Nil(t, Sign(secret, other, now))
+	other.RaftAddress = []byte("10.0.0.1:7003")
+	assert.Equal(t, ErrBadSignature, v.Verify(other, now))
+
+	assert.Nil(t, Sign(secret, other, now.Add(-2*time.Minute)))
+	assert.Equal(t, ErrExpired, v.Verify(other, now))
+
+	assert.Equal(t, ErrNoSecret, NewVerifier(nil, 0).Verify(cmd, now))
+}
@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// hcLogger lets raft, which logs through hclog, log through zap.
+type hcLogger struct {
+	root    *zap.Logger
+	l       *zap.SugaredLogger
+	name    string
+	implied []any
+}
+
+var _ hclog.Logger = (*hcLogger)(nil)
+
+// HCLog adapts l to hclog, named name.
+func HCLog(l *zap.Logger, name string) hclog.Logger {
+	root := OrNop(l)
+	return &hcLogger{
+		root: root,
+		l:    root.Named(name).WithOptions(zap.AddCallerSkip(2)).Sugar(),
+		name: name,
+	}
+}
+
+func zapLevel(level hclog.Level) zapcore.Level {
+	switch level {
+	case hclog.Trace, hclog.Debug:
+		return zapcore.DebugLevel
+	case hclog.Warn:
+		return zapcore.WarnLevel
+	case hclog.Error:
+		return zapcore.ErrorLevel
+	}
+	return zapcore.InfoLevel
+}
+
+func (h *hcLogger) Log(level hclog.Level, msg string, args ...any) {
+	switch level {
+	case hclog.Off:
+		return
+	case hclog.Trace, hclog.Debug:
+		h.l.Debugw(msg, args...)
+	case hclog.Warn:
+		h.l.Warnw(msg, args...)
+	case hclog.Error:
+		h.l.Errorw(msg, args...)
+	default:
+		h.l.Infow(msg, args...)
+	}
+}
+
+func (h *hcLogger) Trace(msg string, args ...any) { h.Log(hclog.Trace, msg, args...) }
+func (h *hcLogger) Debug(msg string, args ...any) { h.Log(hclog.Debug, msg, args...) }
+func (h *hcLogger) Info(msg string, args ...any)  { h.Log(hclog.Info, msg, args...) }
+func (h *hcLogger) Warn(msg string, args ...any)  { h.Log(hclog.Warn, msg, args...) }
+func (h *hcLogger) Error(msg string, args ...any) { h.Log(hclog.Error, msg, args...) }
+
+func (h *hcLogger) enabled(level hclog.Level) bool {
+	return h.l.Desugar().Core().Enabled(zapLevel(level))
+}
+
+func (h *hcLogger) IsTrace() bool { return h.enabled(hclog.Trace) }
+func (h *hcLogger) IsDebug() bool { return h.enabled(hclog.Debug) }
+func (h *hcLogger) IsInfo() bool  { return h.enabled(hclog.Info) }
+func (h *hcLogger) IsWarn() bool  { return h.enabled(hclog.Warn) }
+func (h *hcLogger) IsError() bool { return h.enabled(hclog.Error) }
+
+func (h *hcLogger) ImpliedArgs() []any { return h.implied }
+
+func (h *hcLogger) With(args ...any) hclog.Logger {
+	return &hcLogger{
+		root:    h.root,
+		l:       h.l.With(args...),
+		name:    h.name,
+		implied: append(append([]any(nil), h.implied...), args...),
+	}
+}
+
+func (h *hcLogger) Name() string { return h.name }
+
+func (h *hcLogger) Named(name string) hclog.Logger {
+	if h.name != "" {
+		name = h.name + "." + name
+	}
+	return h.ResetNamed(name)
+}
+
+func (h *hcLogger) ResetNamed(name string) hclog.Logger {
+	l := HCLog(h.root, name).(*hcLogger)
+	if len(h.implied) != 0 {
+		return l.With(h.implied...)
+	}
+	return l
+}
+
+// SetLevel is ignored, the level is the one of the zap logger.
+func (h *hcLogger) SetLevel(hclog.Level) {}
+
+func (h *hcLogger) GetLevel() hclog.Level {
+	for _, level := range []hclog.Level{hclog.Debug, hclog.Info, hclog.Warn, hclog.Error} {
+		if h.enabled(level) {
+			return level
+		}
+	}
+	return hclog.Off
+}
+
+func (h *hcLogger) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	return log.New(h.StandardWriter(opts), "", 0)
+}
+
+func (h *hcLogger) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	infer := opts != nil && opts.InferLevels
+	return &stdWriter{h: h, infer: infer}
+}
+
+// stdWriter logs every line written, at the level in its "[LEVEL]" prefix
+// when inferring levels.
+type stdWriter struct {
+	h     *hcLogger
+	infer bool
+}
+
+func (w *stdWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, " \t\n"))
+	level := hclog.Info
+	if w.infer {
+		level, msg = inferLevel(msg)
+	}
+	w.h.Log(level, msg)
+	return len(p), nil
+}
+
+func inferLevel(msg string) (hclog.Level, string) {
+	for prefix, level := range map[string]hclog.Level{
+		"[TRACE]": hclog.Trace,
+		"[DEBUG]": hclog.Debug,
+		"[INFO]":  hclog.Info,
+		"[WARN]":  hclog.Warn,
+		"[ERR]":   hclog.Error,
+		"[ERROR]": hclog.Error,
+	} {
+		if strings.HasPrefix(msg, prefix) {
+			return level, strings.TrimSpace(msg[len(prefix):])
+		}
+	}
+	return hclog.Info, msg
+}
@@ -0,0 +1,88 @@
+// Package logging builds the zap logger every component logs through, and
+// the names of the fields they share.
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Fields shared by the components, keys are logged by their hash and
+// values are not logged.
+const (
+	FieldNode      = "node_id"
+	FieldConn      = "conn_id"
+	FieldCmd       = "cmd"
+	FieldKeyHash   = "key_hash"
+	FieldRaftIndex = "raft_index"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type Options struct {
+	// Level is debug, info, warn or error, info when empty
+	Level string
+	// Format is json or console, json when empty
+	Format string
+	// Output are paths or stdout/stderr, stderr when empty
+	Output []string
+}
+
+// Validate checks the level and format of opts.
+func (opts Options) Validate() error {
+	if opts.Level != "" {
+		if _, err := zap.ParseAtomicLevel(opts.Level); err != nil {
+			return fmt.Errorf("invalid log level %q", opts.Level)
+		}
+	}
+	switch opts.Format {
+	case "", FormatJSON, FormatConsole:
+	default:
+		return fmt.Errorf("invalid log format %q, want json or console", opts.Format)
+	}
+	return nil
+}
+
+// New builds the root logger of a node.
+func New(opts Options) (*zap.Logger, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	if opts.Level != "" {
+		level, _ = zap.ParseAtomicLevel(opts.Level)
+	}
+	conf := zap.NewProductionConfig()
+	conf.Level = level
+	conf.Sampling = nil
+	conf.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	if opts.Format == FormatConsole {
+		conf.Encoding = FormatConsole
+		conf.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	}
+	if len(opts.Output) != 0 {
+		conf.OutputPaths = opts.Output
+	}
+	return conf.Build()
+}
+
+// HashKey is how keys appear in logs, the first 8 bytes of their sha256.
+func HashKey(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// OrNop returns l, or a logger dropping everything when l is nil.
+func OrNop(l *zap.Logger) *zap.Logger {
+	if l == nil {
+		return zap.NewNop()
+	}
+	return l
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{})
+	assert.Nil(t, err)
+	_, err = New(Options{Level: "debug", Format: "console"})
+	assert.Nil(t, err)
+	_, err = New(Options{Level: "loud"})
+	assert.NotNil(t, err)
+	_, err = New(Options{Format: "xml"})
+	assert.NotNil(t, err)
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Len(t, HashKey([]byte("k")), 16)
+	assert.Equal(t, HashKey([]byte("k")), HashKey([]byte("k")))
+	assert.NotEqual(t, HashKey([]byte("k")), HashKey([]byte("l")))
+}
+
+func TestHCLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	h := HCLog(zap.New(core), "raft")
+
+	assert.False(t, h.IsDebug())
+	assert.True(t, h.IsInfo())
+	assert.Equal(t, hclog.Info, h.GetLevel())
+
+	h.Debug("dropped")
+	h.With("peer", "node2").Warn("heartbeat failed", "error", "timeout")
+	h.Named("snapshot").Info("snapshot taken", "index", 12)
+	h.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true}).Print("[ERR] dial failed")
+
+	entries := logs.AllUntimed()
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+		assert.Equal(t, "raft", entries[0].LoggerName)
+		assert.Equal(t, map[string]any{"peer": "node2", "error": "timeout"}, entries[0].ContextMap())
+		assert.Equal(t, "raft.snapshot", entries[1].LoggerName)
+		assert.Equal(t, int64(12), entries[1].ContextMap()["index"])
+		assert.Equal(t, zapcore.ErrorLevel, entries[2].Level)
+		assert.Equal(t, "dial failed", entries[2].Message)
+	}
+}
@@ -1,149 +1,324 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"syscall"
 
+	gometrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
-	"github.com/spf13/viper"
+	"go.uber.org/zap"
 
+	"y3cache/acl"
+	"y3cache/atrest"
+	"y3cache/audit"
 	"y3cache/cache"
+	"y3cache/cdc"
+	"y3cache/cluster"
 	"y3cache/fsm"
+	"y3cache/logging"
+	"y3cache/metrics"
+	"y3cache/proto"
+	"y3cache/pubsub"
+	"y3cache/slowlog"
+	"y3cache/trace"
 )
 
-type config struct {
-	Server configServer `mapstructure:"server"`
-	Raft   configRaft   `mapstructure:"raft"`
-}
-type configServer struct {
-	Port       int `mapstructure:"port"`
-	LeaderPort int `mapstructure:"leader_port"`
-}
-type configRaft struct {
-	NodeId    string `mapstructure:"node_id"`
-	Port      int    `mapstructure:"port"`
-	VolumeDir string `mapstructure:"volume_dir"`
-}
-
-const (
-	serverPort = "SERVER_PORT"
-	leaderPort = "LEADER_PORT"
-	raftNodeId = "RAFT_NODE_ID"
-	raftPort   = "RAFT_PORT"
-	raftVolDir = "RAFT_VOL_DIR"
-)
-
-var confKeys = []string{
-	serverPort,
-	raftNodeId,
-	raftPort,
-	raftVolDir,
-}
-
-const (
-	maxPool            = 3
-	tcpTimeout         = 10 * time.Second
-	raftSnapShotRetain = 2
-	raftLogCacheSize   = 512
-)
+// applyTimings is how many entries FSM apply times are kept for
+const applyTimings = 1024
 
 func main() {
-	v := viper.New()
-	v.AutomaticEnv()
-	conf := config{
-		Server: configServer{
-			Port:       v.GetInt(serverPort),
-			LeaderPort: v.GetInt(leaderPort),
-		},
-		Raft: configRaft{
-			NodeId:    v.GetString(raftNodeId),
-			Port:      v.GetInt(raftPort),
-			VolumeDir: v.GetString(raftVolDir),
-		},
+	conf, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
+		return
 	}
-	log.Printf("%+v\n", conf)
-
-	raftBindAddr := fmt.Sprintf("127.0.0.1:%d", conf.Raft.Port)
-	raftConf := raft.DefaultConfig()
-	raftConf.LocalID = raft.ServerID(conf.Raft.NodeId)
-	raftConf.SnapshotThreshold = 1024
-	y3Cache := cache.New()
+	root, err := logging.New(conf.logging())
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	root = root.With(zap.String(logging.FieldNode, conf.Raft.NodeId))
+	defer root.Sync()
+	logger := root.Sugar()
+	logger.Infow("starting", "config", fmt.Sprintf("%+v", conf.redacted()))
 
-	y3FSM := fsm.NewY3CacheFSM(y3Cache)
-	if conf.Raft.VolumeDir == "" {
-		log.Fatal("please enter a valid dir")
+	raftBindAddr, raftAddr := conf.raftAddr(), conf.raftAdvertise()
+	role, err := proto.ParseRole(conf.Raft.Role)
+	if err != nil {
+		logger.Fatal(err)
 		return
 	}
+	tlsConf := conf.tls()
+	serverTLS, err := tlsConf.Server()
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	peerTLS, err := tlsConf.Client()
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	auditLog, err := newAuditLog(conf.Audit)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	defer auditLog.Close()
+	var tracer *trace.Tracer
+	if conf.Server.TraceFile != "" {
+		exporter, err := trace.NewFileExporter(conf.Server.TraceFile)
+		if err != nil {
+			logger.Fatal(err)
+			return
+		}
+		tracer = trace.NewTracer("y3cache", exporter)
+		defer tracer.Close()
+	}
+	seeds := conf.seeds()
+	form, err := newFormation(conf.Raft, raftAddr, seeds)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	form.Logger = root
+	registry := metrics.NewRegistry()
+	// raft reports its timings to the global go-metrics sink
+	if _, err := gometrics.NewGlobal(metrics.Config(), metrics.NewSink(registry, "y3cache_go")); err != nil {
+		logger.Fatal(err)
+		return
+	}
+	raftConf := conf.raftConfig()
+	raftConf.Logger = logging.HCLog(root, "raft")
+	spaces := cache.NewNamespaces()
+	members := cluster.NewMembers()
+	users := acl.NewStore()
+
+	broker := pubsub.NewBroker()
+
 	if err := os.MkdirAll(conf.Raft.VolumeDir, os.FileMode(0744)); err != nil {
-		log.Fatal("couldn't create dir: ", err)
+		logger.Fatal("couldn't create dir: ", err)
 		return
 	}
 	store, err := raftboltdb.NewBoltStore(
 		filepath.Join(conf.Raft.VolumeDir, "raft.dataRepo"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 		return
 	}
-	cacheStore, err := raft.NewLogCache(raftLogCacheSize, store)
+	var (
+		logStore raft.LogStore = store
+		snpStore raft.SnapshotStore
+		keyring  *atrest.Keyring
+	)
+	if conf.Raft.KeyringFile != "" {
+		if keyring, err = atrest.LoadKeyring(conf.Raft.KeyringFile); err != nil {
+			logger.Fatal(err)
+			return
+		}
+		logger.Infow("encrypting the raft log and snapshots", "key_id", keyring.Active())
+		logStore = atrest.NewLogStore(store, keyring)
+	}
+	cacheStore, err := raft.NewLogCache(conf.Raft.LogCacheSize, logStore)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 		return
 	}
-	snpStore, err := raft.NewFileSnapshotStore(
+	changes := cdc.NewHub(cacheStore, spaces)
+	timings := fsm.NewTimings(applyTimings)
+	y3FSM := fsm.NewY3CacheFSM(spaces, members, users, root, broker.Notify, changes.Notify)
+	fileSnapshots, err := raft.NewFileSnapshotStoreWithLogger(
 		conf.Raft.VolumeDir,
-		raftSnapShotRetain,
-		os.Stdout,
+		conf.Raft.SnapshotRetain,
+		logging.HCLog(root, "snapshot"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 		return
 	}
-	tcpAddr, err := net.ResolveTCPAddr("tcp", raftBindAddr)
+	snpStore = fileSnapshots
+	if keyring != nil {
+		snpStore = atrest.NewSnapshotStore(fileSnapshots, keyring)
+	}
+	// raft advertises an IP, hostnames are only kept in the configuration
+	tcpAddr, err := net.ResolveTCPAddr("tcp", raftAddr)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 		return
 	}
-	transport, err := raft.NewTCPTransport(
-		raftBindAddr,
-		tcpAddr,
-		maxPool,
-		tcpTimeout,
-		os.Stdout,
+	var (
+		transport *raft.NetworkTransport
+		layer     *cluster.TLSStreamLayer
+		pending   = cluster.NewPending()
 	)
-	fmt.Println(transport.LocalAddr())
+	for _, p := range form.Peers {
+		pending.Add(p.ID)
+	}
+	if tlsConf.Enabled() {
+		// replication goes over mutual TLS with the client certificates
+		layer, err = cluster.NewTLSStreamLayer(raftBindAddr, tcpAddr, serverTLS, peerTLS)
+		if err != nil {
+			logger.Fatal(err)
+			return
+		}
+		transport = raft.NewNetworkTransportWithLogger(layer, conf.Raft.MaxPool, conf.Raft.TCPTimeout, logging.HCLog(root, "transport"))
+	} else {
+		transport, err = raft.NewTCPTransportWithLogger(
+			raftBindAddr,
+			tcpAddr,
+			conf.Raft.MaxPool,
+			conf.Raft.TCPTimeout,
+			logging.HCLog(root, "transport"),
+		)
+		if err != nil {
+			logger.Fatal(err)
+			return
+		}
+	}
 	raftServer, err := raft.NewRaft(
 		raftConf,
-		y3FSM,
+		fsm.Timed(y3FSM, timings),
 		cacheStore,
 		store,
 		snpStore,
 		transport,
 	)
-	configuration := raft.Configuration{
-		Servers: []raft.Server{
-			{
-				ID:      raft.ServerID(conf.Raft.NodeId),
-				Address: transport.LocalAddr(),
-			},
-		},
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	if layer != nil {
+		layer.SetResolver(cluster.ConfigurationResolver(raftServer))
+		layer.SetAuthorizer(cluster.ConfigurationAuthorizer(raftServer, pending))
+	}
+	hasState, err := raft.HasExistingState(cacheStore, store, snpStore)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	if err := form.Form(context.Background(), raftServer, hasState); err != nil {
+		logger.Fatal("cluster formation failed: ", err)
+		return
 	}
-	raftServer.BootstrapCluster(configuration)
 
-	flag.Parse()
 	opts := ServerOpts{
-		NodeID:      conf.Raft.NodeId,
-		RaftAddress: raftBindAddr,
-		ListenAddr:  fmt.Sprintf(":%d", conf.Server.Port),
-		LeaderAddr:  fmt.Sprintf(":%d", conf.Server.LeaderPort),
-		IsLeader:    conf.Server.LeaderPort == 0,
-	}
-	server := NewServer(opts, y3Cache, raftServer)
-	server.Start()
+		NodeID:             conf.Raft.NodeId,
+		RaftAddress:        raftAddr,
+		ListenAddr:         conf.listenAddr(),
+		AdvertiseAddr:      conf.Server.AdvertiseAddr,
+		Seeds:              seeds,
+		IsLeader:           form.Mode != cluster.JoinExisting,
+		JoinSecret:         []byte(conf.Raft.JoinSecret),
+		Role:               role,
+		MaxStaleness:       conf.Server.MaxStaleness,
+		TransferOnShutdown: conf.Server.TransferOnShutdown,
+		TLS:                serverTLS,
+		PeerTLS:            peerTLS,
+		Pending:            pending,
+		NodeToken:          []byte(conf.Server.NodeToken),
+		Audit:              auditLog,
+		Metrics:            registry,
+		Logger:             root,
+		ReadyMaxLag:        conf.Server.ReadyMaxLag,
+		Slowlog:            slowlog.New(conf.Server.SlowlogMaxLen, conf.Server.SlowlogThreshold),
+		ApplyTimings:       timings,
+		Tracer:             tracer,
+		MaxConns:           conf.Server.MaxConnections,
+	}
+	server := NewServer(opts, spaces, members, users, raftServer, broker, changes)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.Start(ctx); err != nil && !errors.Is(err, errServerClosed) {
+			logger.Fatal(err)
+		}
+	}()
+	var httpServer *http.Server
+	if conf.Server.HTTPPort != 0 {
+		httpServer = &http.Server{
+			Addr:    net.JoinHostPort(conf.Server.BindHost, fmt.Sprint(conf.Server.HTTPPort)),
+			Handler: server.Handler(),
+		}
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal(err)
+			}
+		}()
+	}
+	<-ctx.Done()
+	stop()
+	logger.Infow("signal received, shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warnw("shutdown", "error", err)
+	}
+	if httpServer != nil {
+		httpServer.Shutdown(shutdownCtx)
+	}
+}
+
+// newFormation picks the formation mode, nodes with seeds join by default
+// and the others bootstrap alone.
+func newFormation(conf configRaft, raftAddr string, seeds []string) (*cluster.Formation, error) {
+	mode := cluster.BootstrapSingle
+	if len(seeds) != 0 {
+		mode = cluster.JoinExisting
+	}
+	if conf.Formation != "" {
+		var err error
+		if mode, err = cluster.ParseMode(conf.Formation); err != nil {
+			return nil, err
+		}
+	}
+	if mode == cluster.JoinExisting && len(seeds) == 0 {
+		return nil, fmt.Errorf("%s formation needs %s or %s", mode, joinSeeds, leaderPort)
+	}
+	peers, err := cluster.ParsePeers(conf.Peers)
+	if err != nil {
+		return nil, err
+	}
+	f := &cluster.Formation{
+		Mode: mode,
+		Self: raft.Server{
+			ID:      raft.ServerID(conf.NodeId),
+			Address: raft.ServerAddress(raftAddr),
+		},
+		Peers:    peers,
+		Expected: conf.ExpectedPeers,
+	}
+	return f, f.Validate()
+}
+
+// newAuditLog opens the audit log, nil when it is not configured.
+func newAuditLog(conf configAudit) (*audit.Logger, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	classes, err := audit.ParseClasses(conf.Classes)
+	if err != nil {
+		return nil, err
+	}
+	values, err := audit.ParseValueMode(conf.Values)
+	if err != nil {
+		return nil, err
+	}
+	return audit.New(audit.Options{
+		Path:       conf.File,
+		MaxSize:    conf.MaxSize,
+		MaxBackups: conf.MaxBackups,
+		Classes:    classes,
+		HashKeys:   conf.HashKeys,
+		Values:     values,
+	})
 }
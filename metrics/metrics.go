@@ -0,0 +1,284 @@
+// Package metrics exposes counters, histograms and gauges in the
+// Prometheus text format, without pulling the Prometheus client in.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 100µs to 10s.
+var DefaultBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector writes its samples on every scrape.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc turns a function into a Collector, handy for gauges read
+// from elsewhere at scrape time.
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) { f(w) }
+
+type Registry struct {
+	lock       sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.lock.Unlock()
+	w := &Writer{w: bufio.NewWriter(out), seen: make(map[string]bool)}
+	for _, c := range collectors {
+		c.Collect(w)
+	}
+	return w.n, w.w.Flush()
+}
+
+// Handler serves the registry at /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(rw)
+	})
+}
+
+// Writer writes samples in the text format, the samples of a family must
+// be written one after the other.
+type Writer struct {
+	w    *bufio.Writer
+	n    int64
+	seen map[string]bool
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	n, _ := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+}
+
+func (w *Writer) family(name, help, typ string) {
+	if w.seen[name] {
+		return
+	}
+	w.seen[name] = true
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+func (w *Writer) sample(name string, labels []Label, value float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+func (w *Writer) Gauge(name, help string, value float64, labels ...Label) {
+	w.family(name, help, "gauge")
+	w.sample(name, labels, value)
+}
+
+func (w *Writer) Counter(name, help string, value float64, labels ...Label) {
+	w.family(name, help, "counter")
+	w.sample(name, labels, value)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.Name, r.Replace(l.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec keeps one value per combination of label values.
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*T
+	keys   map[string][]string
+	newT   func() *T
+}
+
+func (v *vec[T]) get(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: want %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	t, ok := v.values[key]
+	if !ok {
+		t = v.newT()
+		v.values[key] = t
+		v.keys[key] = append([]string(nil), values...)
+	}
+	return t
+}
+
+// each calls f in a stable order, with v locked.
+func (v *vec[T]) each(f func(labels []Label, t *T)) {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		labels := make([]Label, len(v.labels))
+		for i, name := range v.labels {
+			labels[i] = Label{Name: name, Value: v.keys[k][i]}
+		}
+		f(labels, v.values[k])
+	}
+}
+
+func newVec[T any](name, help string, labels []string, newT func() *T) vec[T] {
+	return vec[T]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*T),
+		keys:   make(map[string][]string),
+		newT:   newT,
+	}
+}
+
+type CounterVec struct {
+	vec[float64]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labels, func() *float64 { return new(float64) })}
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*c.get(labelValues) += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Collect(w *Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.each(func(labels []Label, v *float64) {
+		w.Counter(c.name, c.help, *v, labels...)
+	})
+}
+
+// GaugeVec keeps the last value set.
+type GaugeVec struct {
+	vec[float64]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, labels, func() *float64 { return new(float64) })}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	*g.get(labelValues) = value
+}
+
+func (g *GaugeVec) Collect(w *Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.each(func(labels []Label, v *float64) {
+		w.Gauge(g.name, g.help, *v, labels...)
+	})
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	vec[histogram]
+	buckets []float64
+}
+
+// NewHistogramVec counts observations in buckets, sorted upper bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		vec: newVec(name, help, labels, func() *histogram {
+			return &histogram{counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hist := h.get(labelValues)
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) Collect(w *Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.each(func(labels []Label, hist *histogram) {
+		w.family(h.name, h.help, "histogram")
+		le := append(labels, Label{Name: "le"})
+		for i, bound := range h.buckets {
+			le[len(le)-1].Value = formatFloat(bound)
+			w.sample(h.name+"_bucket", le, float64(hist.counts[i]))
+		}
+		le[len(le)-1].Value = "+Inf"
+		w.sample(h.name+"_bucket", le, float64(hist.count))
+		w.sample(h.name+"_sum", labels, hist.sum)
+		w.sample(h.name+"_count", labels, float64(hist.count))
+	})
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	commands := NewCounterVec("test_commands_total", "Commands run.", "command", "status")
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{.1, 1}, "command")
+	r.Register(commands)
+	r.Register(latency)
+	r.Register(CollectorFunc(func(w *Writer) {
+		w.Gauge("test_connections", "Open connections.", 3)
+		w.Gauge("test_keys", "Keys.", 1, Label{"namespace", `a"b`})
+		w.Gauge("test_keys", "Keys.", 2, Label{"namespace", "c"})
+	}))
+
+	commands.Inc("SET", "OK")
+	commands.Inc("SET", "OK")
+	commands.Inc("GET", "NOT_FOUND")
+	latency.Observe(.05, "SET")
+	latency.Observe(.5, "SET")
+	latency.Observe(5, "SET")
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Equal(t, `# HELP test_commands_total Commands run.
+# TYPE test_commands_total counter
+test_commands_total{command="GET",status="NOT_FOUND"} 1
+test_commands_total{command="SET",status="OK"} 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{command="SET",le="0.1"} 1
+test_latency_seconds_bucket{command="SET",le="1"} 2
+test_latency_seconds_bucket{command="SET",le="+Inf"} 3
+test_latency_seconds_sum{command="SET"} 5.55
+test_latency_seconds_count{command="SET"} 3
+# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections 3
+# HELP test_keys Keys.
+# TYPE test_keys gauge
+test_keys{namespace="a\"b"} 1
+test_keys{namespace="c"} 2
+`, rec.Body.String())
+}
+
+func TestSink(t *testing.T) {
+	r := NewRegistry()
+	s := NewSink(r, "test")
+	s.AddSample([]string{"raft", "commitTime"}, 20)
+	s.IncrCounter([]string{"raft", "apply"}, 2)
+	s.SetGauge([]string{"raft", "peers"}, 3)
+
+	var b strings.Builder
+	_, err := r.WriteTo(&b)
+	assert.Nil(t, err)
+	assert.Contains(t, b.String(), `test_sample_seconds_bucket{name="raft.commitTime",le="0.025"} 1`)
+	assert.Contains(t, b.String(), `test_sample_seconds_bucket{name="raft.commitTime",le="0.01"} 0`)
+	assert.Contains(t, b.String(), `test_counter_total{name="raft.apply"} 2`)
+	assert.Contains(t, b.String(), `test_gauge{name="raft.peers"} 3`)
+}
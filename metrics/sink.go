@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"strings"
+
+	gometrics "github.com/armon/go-metrics"
+)
+
+// Sink receives what raft emits through armon/go-metrics and exposes it
+// keyed by a name label, e.g. name="raft.commitTime". Timer samples are in
+// milliseconds and converted to seconds. Labels are dropped.
+type Sink struct {
+	samples  *HistogramVec
+	counters *CounterVec
+	gauges   *GaugeVec
+}
+
+var _ gometrics.MetricSink = (*Sink)(nil)
+
+// NewSink registers the sink's families on r with the given prefix.
+func NewSink(r *Registry, prefix string) *Sink {
+	s := &Sink{
+		samples:  NewHistogramVec(prefix+"_sample_seconds", "Timings emitted through go-metrics.", DefaultBuckets, "name"),
+		counters: NewCounterVec(prefix+"_counter_total", "Counters emitted through go-metrics.", "name"),
+		gauges:   NewGaugeVec(prefix+"_gauge", "Gauges emitted through go-metrics.", "name"),
+	}
+	r.Register(s.samples)
+	r.Register(s.counters)
+	r.Register(s.gauges)
+	return s
+}
+
+// Config is a go-metrics config fit for the sink, without hostname or
+// runtime metrics.
+func Config() *gometrics.Config {
+	conf := gometrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableHostnameLabel = false
+	conf.EnableServiceLabel = false
+	conf.EnableRuntimeMetrics = false
+	return conf
+}
+
+func (s *Sink) SetGauge(key []string, val float32) {
+	s.gauges.Set(float64(val), name(key))
+}
+
+func (s *Sink) SetGaugeWithLabels(key []string, val float32, _ []gometrics.Label) {
+	s.SetGauge(key, val)
+}
+
+func (s *Sink) EmitKey(key []string, val float32) {}
+
+func (s *Sink) IncrCounter(key []string, val float32) {
+	s.counters.Add(float64(val), name(key))
+}
+
+func (s *Sink) IncrCounterWithLabels(key []string, val float32, _ []gometrics.Label) {
+	s.IncrCounter(key, val)
+}
+
+func (s *Sink) AddSample(key []string, val float32) {
+	s.samples.Observe(float64(val)/1000, name(key))
+}
+
+func (s *Sink) AddSampleWithLabels(key []string, val float32, _ []gometrics.Label) {
+	s.AddSample(key, val)
+}
+
+func name(key []string) string {
+	return strings.Join(key, ".")
+}
@@ -0,0 +1,166 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandAuth authenticates the connection as Username, an empty Username
+// takes Password as a token. Answered with a ResponseStatus.
+type CommandAuth struct {
+	Username []byte
+	Password []byte
+}
+
+func (c *CommandAuth) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdAuth)
+	writeBytes(buf, c.Username)
+	writeBytes(buf, c.Password)
+	return buf.Bytes()
+}
+
+// ACLRule is what a user may do, Perms is an acl.Perm. Empty Keys (glob
+// patterns) or Namespaces allow all of them.
+type ACLRule struct {
+	Perms      byte
+	Keys       [][]byte
+	Namespaces [][]byte
+}
+
+func (r *ACLRule) write(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, r.Perms)
+	writeBytesList(buf, r.Keys)
+	writeBytesList(buf, r.Namespaces)
+}
+
+func readACLRule(r io.Reader) ACLRule {
+	rule := ACLRule{}
+	binary.Read(r, binary.LittleEndian, &rule.Perms)
+	rule.Keys = readBytesList(r)
+	rule.Namespaces = readBytesList(r)
+	return rule
+}
+
+// CommandACLSetUser creates or replaces Username. The user authenticates
+// with Password, Token or both, the leader only replicates their hashes.
+type CommandACLSetUser struct {
+	Username []byte
+	Password []byte
+	Token    []byte
+	Rule     ACLRule
+}
+
+func (c *CommandACLSetUser) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdACLSetUser)
+	writeBytes(buf, c.Username)
+	writeBytes(buf, c.Password)
+	writeBytes(buf, c.Token)
+	c.Rule.write(buf)
+	return buf.Bytes()
+}
+
+func parseACLSetUserCommand(r io.Reader) *CommandACLSetUser {
+	return &CommandACLSetUser{
+		Username: readBytes(r),
+		Password: readBytes(r),
+		Token:    readBytes(r),
+		Rule:     readACLRule(r),
+	}
+}
+
+type CommandACLDelUser struct {
+	Username []byte
+}
+
+func (c *CommandACLDelUser) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdACLDelUser)
+	writeBytes(buf, c.Username)
+	return buf.Bytes()
+}
+
+// CommandACLUser is never sent by clients, the leader appends it for
+// ACLSETUSER and ACLDELUSER with the secrets already hashed.
+type CommandACLUser struct {
+	Username     []byte
+	Salt         []byte
+	PasswordHash []byte
+	TokenHash    []byte
+	Rule         ACLRule
+	Remove       bool
+}
+
+func (c *CommandACLUser) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdACLUser)
+	writeBytes(buf, c.Username)
+	writeBytes(buf, c.Salt)
+	writeBytes(buf, c.PasswordHash)
+	writeBytes(buf, c.TokenHash)
+	c.Rule.write(buf)
+	binary.Write(buf, binary.LittleEndian, c.Remove)
+	return buf.Bytes()
+}
+
+func parseACLUserCommand(r io.Reader) *CommandACLUser {
+	cmd := &CommandACLUser{
+		Username:     readBytes(r),
+		Salt:         readBytes(r),
+		PasswordHash: readBytes(r),
+		TokenHash:    readBytes(r),
+		Rule:         readACLRule(r),
+	}
+	binary.Read(r, binary.LittleEndian, &cmd.Remove)
+	return cmd
+}
+
+// CommandACLList lists the users, without their secrets.
+type CommandACLList struct{}
+
+func (c *CommandACLList) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdACLList)
+	return buf.Bytes()
+}
+
+type ACLUser struct {
+	Username []byte
+	Rule     ACLRule
+}
+
+type ResponseACLList struct {
+	Status Status
+	Users  []ACLUser
+}
+
+func (r *ResponseACLList) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Users)))
+	for _, u := range r.Users {
+		writeBytes(buf, u.Username)
+		u.Rule.write(buf)
+	}
+	return buf.Bytes()
+}
+
+func ParseACLListResponse(r io.Reader) (*ResponseACLList, error) {
+	resp := &ResponseACLList{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return resp, err
+	}
+	for i := int32(0); i < n; i++ {
+		resp.Users = append(resp.Users, ACLUser{
+			Username: readBytes(r),
+			Rule:     readACLRule(r),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,109 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandChanges turns the connection into a change stream of every write
+// applied after FromIndex - 1. A FromIndex of zero asks for a snapshot
+// bootstrap.
+type CommandChanges struct {
+	FromIndex uint64
+}
+
+func (c *CommandChanges) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdChanges)
+	binary.Write(buf, binary.LittleEndian, c.FromIndex)
+	return buf.Bytes()
+}
+
+func parseChangesCommand(r io.Reader) *CommandChanges {
+	cmd := &CommandChanges{}
+	binary.Read(r, binary.LittleEndian, &cmd.FromIndex)
+	return cmd
+}
+
+type ChangeType byte
+
+const (
+	ChangeNone ChangeType = iota
+	ChangeSet
+	ChangeDel
+	ChangeExpire
+	// ChangeResnapshot tells the consumer the requested index was
+	// compacted, it must drop its state and load the ChangeSnapshotItem
+	// frames that follow up to ChangeSnapshotDone.
+	ChangeResnapshot
+	ChangeSnapshotItem
+	// ChangeSnapshotDone carries the index the snapshot reflects, the
+	// stream continues with the changes after it.
+	ChangeSnapshotDone
+	// ChangeError ends the stream, Value holds the reason.
+	ChangeError
+	// ChangeFlush removed every key of the namespace.
+	ChangeFlush
+	ChangeEvict
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeSet:
+		return "SET"
+	case ChangeDel:
+		return "DEL"
+	case ChangeExpire:
+		return "EXPIRE"
+	case ChangeResnapshot:
+		return "RESNAPSHOT"
+	case ChangeSnapshotItem:
+		return "SNAPSHOTITEM"
+	case ChangeSnapshotDone:
+		return "SNAPSHOTDONE"
+	case ChangeError:
+		return "ERR"
+	case ChangeFlush:
+		return "FLUSH"
+	case ChangeEvict:
+		return "EVICT"
+	default:
+		return "NONE"
+	}
+}
+
+// Change is the frame written to a change stream. ExpiresAt is the unix
+// time in nanoseconds, zero never expires.
+type Change struct {
+	Type      ChangeType
+	Index     uint64
+	Namespace []byte
+	Key       []byte
+	Value     []byte
+	ExpiresAt int64
+}
+
+func (c *Change) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, c.Type)
+	binary.Write(buf, binary.LittleEndian, c.Index)
+	writeBytes(buf, c.Namespace)
+	writeBytes(buf, c.Key)
+	writeBytes(buf, c.Value)
+	binary.Write(buf, binary.LittleEndian, c.ExpiresAt)
+	return buf.Bytes()
+}
+
+func ParseChange(r io.Reader) (*Change, error) {
+	c := &Change{}
+	if err := binary.Read(r, binary.LittleEndian, &c.Type); err != nil {
+		return nil, err
+	}
+	binary.Read(r, binary.LittleEndian, &c.Index)
+	c.Namespace = readBytes(r)
+	c.Key = readBytes(r)
+	c.Value = readBytes(r)
+	err := binary.Read(r, binary.LittleEndian, &c.ExpiresAt)
+	return c, err
+}
@@ -0,0 +1,202 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Role is the part a node asks for when joining.
+type Role byte
+
+const (
+	// RoleVoter counts in the quorum
+	RoleVoter Role = iota
+	// RoleReplica receives the log without voting, it only serves reads
+	RoleReplica
+)
+
+func (r Role) String() string {
+	if r == RoleReplica {
+		return "replica"
+	}
+	return "voter"
+}
+
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "", "voter":
+		return RoleVoter, nil
+	case "replica":
+		return RoleReplica, nil
+	}
+	return RoleVoter, fmt.Errorf("unknown role %q", s)
+}
+
+// CommandLeave removes the node receiving it from the cluster.
+type CommandLeave struct{}
+
+func (c *CommandLeave) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdLeave)
+	return buf.Bytes()
+}
+
+// CommandRemove removes NodeId from the cluster, typically a dead node.
+type CommandRemove struct {
+	NodeId []byte
+}
+
+func (c *CommandRemove) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdRemove)
+	writeBytes(buf, c.NodeId)
+	return buf.Bytes()
+}
+
+// CommandPromote turns the non-voter NodeId into a voter.
+type CommandPromote struct {
+	NodeId []byte
+}
+
+func (c *CommandPromote) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdPromote)
+	writeBytes(buf, c.NodeId)
+	return buf.Bytes()
+}
+
+// CommandDemote turns the voter NodeId into a non-voter.
+type CommandDemote struct {
+	NodeId []byte
+}
+
+func (c *CommandDemote) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdDemote)
+	writeBytes(buf, c.NodeId)
+	return buf.Bytes()
+}
+
+// CommandTransfer moves leadership to the voter NodeId, or to the most up
+// to date voter when empty.
+type CommandTransfer struct {
+	NodeId []byte
+}
+
+func (c *CommandTransfer) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdTransfer)
+	writeBytes(buf, c.NodeId)
+	return buf.Bytes()
+}
+
+// ResponseMembership answers JOIN, LEAVE, REMOVE, PROMOTE, DEMOTE and
+// TRANSFER, Message tells why the change was refused.
+type ResponseMembership struct {
+	Status  Status
+	Message []byte
+}
+
+func (r *ResponseMembership) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	writeBytes(buf, r.Message)
+	return buf.Bytes()
+}
+
+func ParseMembershipResponse(r io.Reader) (*ResponseMembership, error) {
+	resp := &ResponseMembership{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	resp.Message = readBytes(r)
+	return resp, nil
+}
+
+// CommandMember is never sent by clients, the leader appends it to keep
+// the member list of every replica in sync with the raft configuration.
+type CommandMember struct {
+	NodeId        []byte
+	ClientAddress []byte
+	Remove        bool
+}
+
+func (c *CommandMember) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdMember)
+	writeBytes(buf, c.NodeId)
+	writeBytes(buf, c.ClientAddress)
+	binary.Write(buf, binary.LittleEndian, c.Remove)
+	return buf.Bytes()
+}
+
+func parseMemberCommand(r io.Reader) *CommandMember {
+	cmd := &CommandMember{
+		NodeId:        readBytes(r),
+		ClientAddress: readBytes(r),
+	}
+	binary.Read(r, binary.LittleEndian, &cmd.Remove)
+	return cmd
+}
+
+// CommandMembers lists the servers of the raft configuration.
+type CommandMembers struct{}
+
+func (c *CommandMembers) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdMembers)
+	return buf.Bytes()
+}
+
+type Member struct {
+	NodeId        []byte
+	RaftAddress   []byte
+	ClientAddress []byte
+	Voter         bool
+	Leader        bool
+}
+
+type ResponseMembers struct {
+	Status  Status
+	Members []Member
+}
+
+func (r *ResponseMembers) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Members)))
+	for _, m := range r.Members {
+		writeBytes(buf, m.NodeId)
+		writeBytes(buf, m.RaftAddress)
+		writeBytes(buf, m.ClientAddress)
+		binary.Write(buf, binary.LittleEndian, m.Voter)
+		binary.Write(buf, binary.LittleEndian, m.Leader)
+	}
+	return buf.Bytes()
+}
+
+func ParseMembersResponse(r io.Reader) (*ResponseMembers, error) {
+	resp := &ResponseMembers{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return resp, err
+	}
+	for i := int32(0); i < n; i++ {
+		m := Member{
+			NodeId:        readBytes(r),
+			RaftAddress:   readBytes(r),
+			ClientAddress: readBytes(r),
+		}
+		binary.Read(r, binary.LittleEndian, &m.Voter)
+		if err := binary.Read(r, binary.LittleEndian, &m.Leader); err != nil {
+			return resp, err
+		}
+		resp.Members = append(resp.Members, m)
+	}
+	return resp, nil
+}
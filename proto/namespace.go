@@ -0,0 +1,192 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CommandNamespaced runs Command in Namespace instead of the namespace the
+// connection selected. It is also how namespaced writes are stored in the
+// raft log.
+type CommandNamespaced struct {
+	Namespace []byte
+	Command   any
+}
+
+func (c *CommandNamespaced) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdNamespaced)
+	writeBytes(buf, c.Namespace)
+	var b []byte
+	if enc, ok := c.Command.(interface{ Bytes() []byte }); ok {
+		b = enc.Bytes()
+	}
+	writeBytes(buf, b)
+	return buf.Bytes()
+}
+
+func parseNamespacedCommand(r io.Reader) (*CommandNamespaced, error) {
+	cmd := &CommandNamespaced{Namespace: readBytes(r)}
+	inner, err := ParseCommand(bytes.NewReader(readBytes(r)))
+	if err != nil {
+		return nil, err
+	}
+	switch inner.(type) {
+	case *CommandNamespaced:
+		return nil, fmt.Errorf("nested namespaced command")
+	case *CommandTraced:
+		return nil, fmt.Errorf("traced command in a namespaced one")
+	}
+	cmd.Command = inner
+	return cmd, nil
+}
+
+// CommandSelect makes the following commands of the connection run in
+// Namespace, an empty one selects the default namespace.
+type CommandSelect struct {
+	Namespace []byte
+}
+
+func (c *CommandSelect) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdSelect)
+	writeBytes(buf, c.Namespace)
+	return buf.Bytes()
+}
+
+// CommandNamespaceConfig creates Namespace or replaces its limits, zero
+// limits are unlimited. DefaultTTL is in seconds and Policy holds a
+// cache.EvictionPolicy.
+type CommandNamespaceConfig struct {
+	Namespace  []byte
+	MaxMemory  int64
+	MaxKeys    int64
+	DefaultTTL int32
+	Policy     byte
+}
+
+func (c *CommandNamespaceConfig) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdNamespaceConfig)
+	writeBytes(buf, c.Namespace)
+	binary.Write(buf, binary.LittleEndian, c.MaxMemory)
+	binary.Write(buf, binary.LittleEndian, c.MaxKeys)
+	binary.Write(buf, binary.LittleEndian, c.DefaultTTL)
+	binary.Write(buf, binary.LittleEndian, c.Policy)
+	return buf.Bytes()
+}
+
+func parseNamespaceConfigCommand(r io.Reader) *CommandNamespaceConfig {
+	cmd := &CommandNamespaceConfig{Namespace: readBytes(r)}
+	binary.Read(r, binary.LittleEndian, &cmd.MaxMemory)
+	binary.Read(r, binary.LittleEndian, &cmd.MaxKeys)
+	binary.Read(r, binary.LittleEndian, &cmd.DefaultTTL)
+	binary.Read(r, binary.LittleEndian, &cmd.Policy)
+	return cmd
+}
+
+// CommandFlush removes every key of Namespace.
+type CommandFlush struct {
+	Namespace []byte
+}
+
+func (c *CommandFlush) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdFlush)
+	writeBytes(buf, c.Namespace)
+	return buf.Bytes()
+}
+
+// ResponseStatus answers the commands that only report whether they
+// succeeded.
+type ResponseStatus struct {
+	Status Status
+}
+
+func (r *ResponseStatus) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	return buf.Bytes()
+}
+
+func ParseStatusResponse(r io.Reader) (*ResponseStatus, error) {
+	resp := &ResponseStatus{}
+	err := binary.Read(r, binary.LittleEndian, &resp.Status)
+	return resp, err
+}
+
+// CommandNamespaceStats asks the node for the stats of Namespaces, or of
+// every namespace when empty.
+type CommandNamespaceStats struct {
+	Namespaces [][]byte
+}
+
+func (c *CommandNamespaceStats) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdNamespaceStats)
+	writeBytesList(buf, c.Namespaces)
+	return buf.Bytes()
+}
+
+type NamespaceStats struct {
+	Namespace   []byte
+	Keys        int64
+	Bytes       int64
+	Evictions   uint64
+	Expirations uint64
+	MaxMemory   int64
+	MaxKeys     int64
+	DefaultTTL  int32
+	Policy      byte
+}
+
+type ResponseNamespaceStats struct {
+	Status Status
+	Stats  []NamespaceStats
+}
+
+func (r *ResponseNamespaceStats) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Stats)))
+	for _, st := range r.Stats {
+		writeBytes(buf, st.Namespace)
+		binary.Write(buf, binary.LittleEndian, st.Keys)
+		binary.Write(buf, binary.LittleEndian, st.Bytes)
+		binary.Write(buf, binary.LittleEndian, st.Evictions)
+		binary.Write(buf, binary.LittleEndian, st.Expirations)
+		binary.Write(buf, binary.LittleEndian, st.MaxMemory)
+		binary.Write(buf, binary.LittleEndian, st.MaxKeys)
+		binary.Write(buf, binary.LittleEndian, st.DefaultTTL)
+		binary.Write(buf, binary.LittleEndian, st.Policy)
+	}
+	return buf.Bytes()
+}
+
+func ParseNamespaceStatsResponse(r io.Reader) (*ResponseNamespaceStats, error) {
+	resp := &ResponseNamespaceStats{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return resp, err
+	}
+	for i := int32(0); i < n; i++ {
+		st := NamespaceStats{Namespace: readBytes(r)}
+		binary.Read(r, binary.LittleEndian, &st.Keys)
+		binary.Read(r, binary.LittleEndian, &st.Bytes)
+		binary.Read(r, binary.LittleEndian, &st.Evictions)
+		binary.Read(r, binary.LittleEndian, &st.Expirations)
+		binary.Read(r, binary.LittleEndian, &st.MaxMemory)
+		binary.Read(r, binary.LittleEndian, &st.MaxKeys)
+		binary.Read(r, binary.LittleEndian, &st.DefaultTTL)
+		if err := binary.Read(r, binary.LittleEndian, &st.Policy); err != nil {
+			return resp, err
+		}
+		resp.Stats = append(resp.Stats, st)
+	}
+	return resp, nil
+}
@@ -3,10 +3,24 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// Limits of a frame, a peer sending more is refused before anything is
+// allocated for it.
+const (
+	// MaxFrame bounds the bytes of one command
+	MaxFrame = 64 << 20
+	// MaxElement bounds one key, value or other string of a frame
+	MaxElement = MaxFrame
+	// MaxList bounds the number of strings of a list
+	MaxList = 1 << 16
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
 type Status byte
 
 func (s Status) String() string {
@@ -17,6 +31,18 @@ func (s Status) String() string {
 		return "OK"
 	case StatusKeyNotFound:
 		return "KEYNOTFOUND"
+	case StatusAborted:
+		return "ABORTED"
+	case StatusNoScript:
+		return "NOSCRIPT"
+	case StatusFull:
+		return "FULL"
+	case StatusStale:
+		return "STALE"
+	case StatusNotLeader:
+		return "NOT_LEADER"
+	case StatusUnauthorized:
+		return "UNAUTHORIZED"
 	default:
 		return "NONE"
 	}
@@ -27,6 +53,18 @@ const (
 	StatusOK
 	StatusError
 	StatusKeyNotFound
+	StatusAborted
+	StatusNoScript
+	StatusFull
+	// StatusStale refuses a read on a node that lost contact with the
+	// leader for longer than the staleness it allows
+	StatusStale
+	// StatusNotLeader redirects a JOIN, the message holds the leader's
+	// client address when the node knows it
+	StatusNotLeader
+	// StatusUnauthorized refuses a command the connection is not allowed
+	// to run, or a failed AUTH
+	StatusUnauthorized
 )
 
 type CommandB byte
@@ -37,6 +75,38 @@ const (
 	CmdGet
 	CmdDel
 	CmdJoin
+	CmdExpire
+	CmdSubscribe
+	CmdPSubscribe
+	CmdUnsubscribe
+	CmdPUnsubscribe
+	CmdPublish
+	CmdChanges
+	CmdWatch
+	CmdExec
+	CmdEval
+	CmdEvalSha
+	CmdScriptLoad
+	CmdNamespaced
+	CmdSelect
+	CmdNamespaceConfig
+	CmdFlush
+	CmdNamespaceStats
+	CmdInvalidate
+	CmdLeave
+	CmdRemove
+	CmdDemote
+	CmdMember
+	CmdMembers
+	CmdPromote
+	CmdTransfer
+	CmdAuth
+	CmdACLSetUser
+	CmdACLDelUser
+	CmdACLList
+	CmdACLUser
+	CmdSlowlog
+	CmdTraced
 )
 
 type ResponseSet struct {
@@ -75,15 +145,29 @@ func ParseGetResponse(r io.Reader) (*ResponseGet, error) {
 	resp := &ResponseGet{}
 	err := binary.Read(r, binary.LittleEndian, &resp.Status)
 	// fmt.Printf("[PROTO] Status %v %v", resp.Status, err)
-	var valueLen int32
-	binary.Read(r, binary.LittleEndian, &valueLen)
-
-	resp.Value = make([]byte, valueLen)
-	err = binary.Read(r, binary.LittleEndian, &resp.Value)
-	return resp, err
+	if err != nil {
+		return resp, err
+	}
+	fr := &frameReader{r: r, left: MaxFrame}
+	resp.Value = readBytes(fr)
+	return resp, fr.err
 }
 
+// ParseCommand reads one command of at most MaxFrame bytes, a short or
+// malformed frame is an error.
 func ParseCommand(r io.Reader) (any, error) {
+	fr := &frameReader{r: r, left: MaxFrame}
+	cmd, err := parseCommand(fr)
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func parseCommand(r io.Reader) (any, error) {
 	var cmd CommandB
 	if err := binary.Read(r, binary.LittleEndian, &cmd); err != nil {
 		return nil, err
@@ -93,8 +177,82 @@ func ParseCommand(r io.Reader) (any, error) {
 		return parseSetCommnad(r), nil
 	case CmdGet:
 		return parseGetCommnad(r), nil
+	case CmdDel:
+		return parseDelCommand(r), nil
 	case CmdJoin:
 		return parseJoinCommnad(r), nil
+	case CmdExpire:
+		return parseExpireCommand(r), nil
+	case CmdSubscribe:
+		return &CommandSubscribe{Channels: readBytesList(r)}, nil
+	case CmdPSubscribe:
+		return &CommandPSubscribe{Patterns: readBytesList(r)}, nil
+	case CmdUnsubscribe:
+		return &CommandUnsubscribe{Channels: readBytesList(r)}, nil
+	case CmdPUnsubscribe:
+		return &CommandPUnsubscribe{Patterns: readBytesList(r)}, nil
+	case CmdPublish:
+		return parsePublishCommand(r), nil
+	case CmdChanges:
+		return parseChangesCommand(r), nil
+	case CmdWatch:
+		return &CommandWatch{Keys: readBytesList(r)}, nil
+	case CmdExec:
+		return parseExecCommand(r), nil
+	case CmdEval:
+		return parseEvalCommand(r), nil
+	case CmdEvalSha:
+		return parseEvalShaCommand(r), nil
+	case CmdScriptLoad:
+		return &CommandScriptLoad{Script: readBytes(r)}, nil
+	case CmdNamespaced:
+		cmd, err := parseNamespacedCommand(r)
+		if err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	case CmdSelect:
+		return &CommandSelect{Namespace: readBytes(r)}, nil
+	case CmdNamespaceConfig:
+		return parseNamespaceConfigCommand(r), nil
+	case CmdFlush:
+		return &CommandFlush{Namespace: readBytes(r)}, nil
+	case CmdNamespaceStats:
+		return &CommandNamespaceStats{Namespaces: readBytesList(r)}, nil
+	case CmdInvalidate:
+		return &CommandInvalidate{Tags: readBytesList(r)}, nil
+	case CmdLeave:
+		return &CommandLeave{}, nil
+	case CmdRemove:
+		return &CommandRemove{NodeId: readBytes(r)}, nil
+	case CmdDemote:
+		return &CommandDemote{NodeId: readBytes(r)}, nil
+	case CmdMember:
+		return parseMemberCommand(r), nil
+	case CmdMembers:
+		return &CommandMembers{}, nil
+	case CmdPromote:
+		return &CommandPromote{NodeId: readBytes(r)}, nil
+	case CmdTransfer:
+		return &CommandTransfer{NodeId: readBytes(r)}, nil
+	case CmdAuth:
+		return &CommandAuth{Username: readBytes(r), Password: readBytes(r)}, nil
+	case CmdACLSetUser:
+		return parseACLSetUserCommand(r), nil
+	case CmdACLDelUser:
+		return &CommandACLDelUser{Username: readBytes(r)}, nil
+	case CmdACLList:
+		return &CommandACLList{}, nil
+	case CmdACLUser:
+		return parseACLUserCommand(r), nil
+	case CmdSlowlog:
+		return parseSlowlogCommand(r), nil
+	case CmdTraced:
+		cmd, err := parseTracedCommand(r)
+		if err != nil {
+			return nil, err
+		}
+		return cmd, nil
 	default:
 		return nil, fmt.Errorf("invalid command")
 	}
@@ -104,6 +262,9 @@ type CommandSet struct {
 	Key   []byte
 	Value []byte
 	TTL   int32
+	// Tags let INVALIDATE delete the key, a SET replaces the tags of the
+	// previous value
+	Tags [][]byte
 }
 
 func (c *CommandSet) Bytes() []byte {
@@ -115,6 +276,7 @@ func (c *CommandSet) Bytes() []byte {
 	binary.Write(buf, binary.LittleEndian, v)
 	binary.Write(buf, binary.LittleEndian, c.Value)
 	binary.Write(buf, binary.LittleEndian, c.TTL)
+	writeBytesList(buf, c.Tags)
 
 	return buf.Bytes()
 }
@@ -122,15 +284,8 @@ func (c *CommandSet) Bytes() []byte {
 func parseSetCommnad(r io.Reader) *CommandSet {
 	cmd := &CommandSet{}
 
-	var k, v int32
-
-	binary.Read(r, binary.LittleEndian, &k)
-	key := make([]byte, k)
-	binary.Read(r, binary.LittleEndian, &key)
-
-	binary.Read(r, binary.LittleEndian, &v)
-	value := make([]byte, v)
-	binary.Read(r, binary.LittleEndian, &value)
+	key := readBytes(r)
+	value := readBytes(r)
 
 	var TTL int32
 	binary.Read(r, binary.LittleEndian, &TTL)
@@ -138,6 +293,7 @@ func parseSetCommnad(r io.Reader) *CommandSet {
 	cmd.TTL = TTL
 	cmd.Key = key
 	cmd.Value = value
+	cmd.Tags = readBytesList(r)
 	return cmd
 }
 
@@ -155,20 +311,70 @@ func (c *CommandGet) Bytes() []byte {
 }
 
 func parseGetCommnad(r io.Reader) *CommandGet {
-	cmd := &CommandGet{}
+	return &CommandGet{Key: readBytes(r)}
+}
 
-	var k int32
+type ResponseDel struct {
+	Status Status
+}
 
-	binary.Read(r, binary.LittleEndian, &k)
-	key := make([]byte, k)
-	binary.Read(r, binary.LittleEndian, &key)
-	cmd.Key = key
-	return cmd
+func (r *ResponseDel) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	return buf.Bytes()
+}
+
+func ParseDelResponse(r io.Reader) (*ResponseDel, error) {
+	resp := &ResponseDel{}
+	err := binary.Read(r, binary.LittleEndian, &resp.Status)
+	return resp, err
+}
+
+type CommandDel struct {
+	Key []byte
+}
+
+func (c *CommandDel) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdDel)
+	writeBytes(buf, c.Key)
+	return buf.Bytes()
+}
+
+func parseDelCommand(r io.Reader) *CommandDel {
+	return &CommandDel{Key: readBytes(r)}
+}
+
+// CommandExpire is never sent by clients, the leader appends it to the raft
+// log once a key's TTL elapses so that every replica removes the key at the
+// same index.
+type CommandExpire struct {
+	Key []byte
+}
+
+func (c *CommandExpire) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdExpire)
+	writeBytes(buf, c.Key)
+	return buf.Bytes()
+}
+
+func parseExpireCommand(r io.Reader) *CommandExpire {
+	return &CommandExpire{Key: readBytes(r)}
 }
 
 type CommandJoin struct {
 	NodeId      []byte
 	RaftAddress []byte
+	// ClientAddress is where the node serves clients, the leader stores it
+	// in the replicated member list
+	ClientAddress []byte
+	Role          Role
+	// Timestamp (unix nanoseconds), Nonce and Mac authenticate the join,
+	// see the join package
+	Timestamp int64
+	Nonce     []byte
+	Mac       []byte
 }
 
 func (c *CommandJoin) Bytes() []byte {
@@ -179,20 +385,116 @@ func (c *CommandJoin) Bytes() []byte {
 	binary.Write(buf, binary.LittleEndian, c.NodeId)
 	binary.Write(buf, binary.LittleEndian, v)
 	binary.Write(buf, binary.LittleEndian, c.RaftAddress)
+	writeBytes(buf, c.ClientAddress)
+	binary.Write(buf, binary.LittleEndian, c.Role)
+	binary.Write(buf, binary.LittleEndian, c.Timestamp)
+	writeBytes(buf, c.Nonce)
+	writeBytes(buf, c.Mac)
 	return buf.Bytes()
 }
 
 func parseJoinCommnad(r io.Reader) *CommandJoin {
 	cmd := &CommandJoin{}
-	var k, v int32
-	binary.Read(r, binary.LittleEndian, &k)
-	nodeId := make([]byte, k)
-	binary.Read(r, binary.LittleEndian, &nodeId)
-	binary.Read(r, binary.LittleEndian, &v)
-	raftAddr := make([]byte, v)
-	binary.Read(r, binary.LittleEndian, &raftAddr)
-
-	cmd.NodeId = nodeId
-	cmd.RaftAddress = raftAddr
+	cmd.NodeId = readBytes(r)
+	cmd.RaftAddress = readBytes(r)
+	cmd.ClientAddress = readBytes(r)
+	binary.Read(r, binary.LittleEndian, &cmd.Role)
+	binary.Read(r, binary.LittleEndian, &cmd.Timestamp)
+	cmd.Nonce = readBytes(r)
+	cmd.Mac = readBytes(r)
 	return cmd
 }
+
+func writeBytes(w io.Writer, b []byte) {
+	binary.Write(w, binary.LittleEndian, int32(len(b)))
+	binary.Write(w, binary.LittleEndian, b)
+}
+
+// frameReader reads at most left bytes and keeps the first error, every
+// read after it fails with that error so a bad frame stops the parsing.
+type frameReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	if fr.err != nil {
+		return 0, fr.err
+	}
+	if fr.left <= 0 {
+		fr.err = ErrFrameTooLarge
+		return 0, fr.err
+	}
+	if int64(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= int64(n)
+	if err != nil {
+		fr.err = err
+	}
+	return n, err
+}
+
+// fail keeps err as the error of the frame being read from r.
+func fail(r io.Reader, err error) {
+	if fr, ok := r.(*frameReader); ok && fr.err == nil {
+		fr.err = err
+	}
+}
+
+// readLength reads the length of a string or list, at most max.
+func readLength(r io.Reader, max int32) (int32, bool) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		fail(r, err)
+		return 0, false
+	}
+	if n < 0 || n > max {
+		fail(r, fmt.Errorf("invalid length %d", n))
+		return 0, false
+	}
+	return n, true
+}
+
+func readBytes(r io.Reader) []byte {
+	n, ok := readLength(r, MaxElement)
+	if !ok {
+		return nil
+	}
+	// the buffer grows with the bytes actually received, not with the
+	// length announced
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err == nil && len(b) < int(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		fail(r, err)
+		return nil
+	}
+	return b
+}
+
+func writeBytesList(w io.Writer, list [][]byte) {
+	binary.Write(w, binary.LittleEndian, int32(len(list)))
+	for _, b := range list {
+		writeBytes(w, b)
+	}
+}
+
+func readBytesList(r io.Reader) [][]byte {
+	n, ok := readLength(r, MaxList)
+	if !ok || n == 0 {
+		return nil
+	}
+	var list [][]byte
+	for i := int32(0); i < n; i++ {
+		b := readBytes(r)
+		if b == nil {
+			return nil
+		}
+		list = append(list, b)
+	}
+	return list
+}
@@ -2,6 +2,8 @@ package proto
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +21,18 @@ func TestParseSetCommand(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestParseSetCommandWithTags(t *testing.T) {
+	cmd := &CommandSet{
+		Key:   []byte("Foo"),
+		Value: []byte("Bar"),
+		Tags:  [][]byte{[]byte("user:1"), []byte("page")},
+	}
+	r := bytes.NewReader(cmd.Bytes())
+	pcmd, err := ParseCommand(r)
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+}
+
 func TestParseGetCommand(t *testing.T) {
 	cmd := &CommandGet{
 		Key: []byte("Foo"),
@@ -41,3 +55,147 @@ func BenchmarkParseCommand(b *testing.B) {
 		r.Seek(0, 0)
 	}
 }
+
+func TestParseDelCommand(t *testing.T) {
+	cmd := &CommandDel{
+		Key: []byte("Foo"),
+	}
+	r := bytes.NewReader(cmd.Bytes())
+	pcmd, err := ParseCommand(r)
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+}
+
+func TestParseSubscribeCommand(t *testing.T) {
+	cmd := &CommandPSubscribe{
+		Patterns: [][]byte{[]byte("__keyspace__:*"), []byte("news.*")},
+	}
+	r := bytes.NewReader(cmd.Bytes())
+	pcmd, err := ParseCommand(r)
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+}
+
+func TestParseMessage(t *testing.T) {
+	m := &Message{
+		Kind:    MessagePublished,
+		Pattern: []byte("news.*"),
+		Channel: []byte("news.tech"),
+		Payload: []byte("hello"),
+	}
+	pm, err := ParseMessage(bytes.NewReader(m.Bytes()))
+	assert.Equal(t, m, pm)
+	assert.Nil(t, err)
+}
+
+func TestParseExecCommand(t *testing.T) {
+	cmd := &CommandExec{
+		Watches: []WatchedKey{{Key: []byte("Foo"), Version: 7}},
+		Ops: []any{
+			&CommandSet{Key: []byte("Foo"), Value: []byte("Bar")},
+			&CommandDel{Key: []byte("Baz")},
+			&CommandGet{Key: []byte("Foo")},
+		},
+	}
+	r := bytes.NewReader(cmd.Bytes())
+	pcmd, err := ParseCommand(r)
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+}
+
+func TestParseSlowlog(t *testing.T) {
+	cmd := &CommandSlowlog{Count: 10, Reset: true}
+	pcmd, err := ParseCommand(bytes.NewReader(cmd.Bytes()))
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+
+	resp := &ResponseSlowlog{
+		Status: StatusOK,
+		Entries: []SlowlogEntry{{
+			ID:        3,
+			Time:      1700000000000000000,
+			Command:   []byte("SET"),
+			Namespace: []byte("default"),
+			Remote:    []byte("127.0.0.1:5000"),
+			Parse:     1,
+			Queue:     2,
+			Raft:      3,
+			FSM:       4,
+			Exec:      5,
+			Write:     6,
+		}},
+	}
+	presp, err := ParseSlowlogResponse(bytes.NewReader(resp.Bytes()))
+	assert.Equal(t, resp, presp)
+	assert.Nil(t, err)
+}
+
+func TestParseTracedCommand(t *testing.T) {
+	cmd := &CommandTraced{
+		TraceParent: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"),
+		TraceState:  []byte("vendor=1"),
+		Command: &CommandNamespaced{
+			Namespace: []byte("app"),
+			Command:   &CommandGet{Key: []byte("Foo")},
+		},
+	}
+	pcmd, err := ParseCommand(bytes.NewReader(cmd.Bytes()))
+	assert.Equal(t, cmd, pcmd)
+	assert.Nil(t, err)
+
+	nested := &CommandTraced{Command: cmd}
+	_, err = ParseCommand(bytes.NewReader(nested.Bytes()))
+	assert.NotNil(t, err)
+	inside := &CommandNamespaced{Namespace: []byte("app"), Command: cmd}
+	_, err = ParseCommand(bytes.NewReader(inside.Bytes()))
+	assert.NotNil(t, err)
+}
+
+func TestParseHostileLengths(t *testing.T) {
+	frame := func(cmd CommandB, ints ...int32) []byte {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, cmd)
+		for _, n := range ints {
+			binary.Write(buf, binary.LittleEndian, n)
+		}
+		return buf.Bytes()
+	}
+	for name, b := range map[string][]byte{
+		"huge list":       frame(CmdSubscribe, 0x7fffffff),
+		"missing strings": frame(CmdSubscribe, 3),
+		"huge string":     frame(CmdGet, 0x7fffffff),
+		"negative string": frame(CmdGet, -1),
+		"short string":    append(frame(CmdGet, 10), "abc"...),
+		"truncated set":   append(frame(CmdSet, 3), "key"...),
+		"no length":       frame(CmdDel),
+	} {
+		cmd, err := ParseCommand(bytes.NewReader(b))
+		assert.NotNil(t, err, name)
+		assert.Nil(t, cmd, name)
+	}
+
+	// a frame ends after MaxFrame bytes whatever its lengths say
+	fr := &frameReader{r: bytes.NewReader(make([]byte, 16)), left: 8}
+	_, err := io.ReadAll(fr)
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
+
+func TestParseTruncatedExec(t *testing.T) {
+	cmd := &CommandExec{
+		Watches: []WatchedKey{{Key: []byte("Foo"), Version: 7}},
+		Ops:     []any{&CommandSet{Key: []byte("Foo"), Value: []byte("Bar")}},
+	}
+	b := cmd.Bytes()
+	for _, end := range []int{1, 5, 12, 16, len(b) - 1} {
+		pcmd, err := ParseCommand(bytes.NewReader(b[:end]))
+		assert.NotNil(t, err, end)
+		assert.Nil(t, pcmd, end)
+	}
+
+	// counts past MaxOps are refused before reading on
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdExec)
+	binary.Write(buf, binary.LittleEndian, int32(0x7fffffff))
+	_, err := ParseCommand(buf)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+type CommandSubscribe struct {
+	Channels [][]byte
+}
+
+func (c *CommandSubscribe) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdSubscribe)
+	writeBytesList(buf, c.Channels)
+	return buf.Bytes()
+}
+
+type CommandPSubscribe struct {
+	Patterns [][]byte
+}
+
+func (c *CommandPSubscribe) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdPSubscribe)
+	writeBytesList(buf, c.Patterns)
+	return buf.Bytes()
+}
+
+// CommandUnsubscribe drops the given channels, or every channel when empty.
+type CommandUnsubscribe struct {
+	Channels [][]byte
+}
+
+func (c *CommandUnsubscribe) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdUnsubscribe)
+	writeBytesList(buf, c.Channels)
+	return buf.Bytes()
+}
+
+// CommandPUnsubscribe drops the given patterns, or every pattern when empty.
+type CommandPUnsubscribe struct {
+	Patterns [][]byte
+}
+
+func (c *CommandPUnsubscribe) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdPUnsubscribe)
+	writeBytesList(buf, c.Patterns)
+	return buf.Bytes()
+}
+
+type CommandPublish struct {
+	Channel []byte
+	Payload []byte
+}
+
+func (c *CommandPublish) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdPublish)
+	writeBytes(buf, c.Channel)
+	writeBytes(buf, c.Payload)
+	return buf.Bytes()
+}
+
+func parsePublishCommand(r io.Reader) *CommandPublish {
+	cmd := &CommandPublish{}
+	cmd.Channel = readBytes(r)
+	cmd.Payload = readBytes(r)
+	return cmd
+}
+
+type ResponsePublish struct {
+	Status Status
+}
+
+func (r *ResponsePublish) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	return buf.Bytes()
+}
+
+func ParsePublishResponse(r io.Reader) (*ResponsePublish, error) {
+	resp := &ResponsePublish{}
+	err := binary.Read(r, binary.LittleEndian, &resp.Status)
+	return resp, err
+}
+
+type MessageKind byte
+
+const (
+	MessageNone MessageKind = iota
+	MessageSubscribe
+	MessagePSubscribe
+	MessageUnsubscribe
+	MessagePUnsubscribe
+	MessagePublished
+	// MessageError refuses a command sent on a subscribed connection, the
+	// reason is in Payload and the server closes the connection after it
+	MessageError
+)
+
+// Message is the only frame a server writes to a connection once it has
+// subscribed. Acknowledgements carry the subscribed channel (or pattern) in
+// Channel and the connection's subscription count in Count, published
+// messages carry the matching Pattern (if any), Channel and Payload.
+type Message struct {
+	Kind    MessageKind
+	Pattern []byte
+	Channel []byte
+	Payload []byte
+	Count   int32
+}
+
+func (m *Message) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, m.Kind)
+	writeBytes(buf, m.Pattern)
+	writeBytes(buf, m.Channel)
+	writeBytes(buf, m.Payload)
+	binary.Write(buf, binary.LittleEndian, m.Count)
+	return buf.Bytes()
+}
+
+func ParseMessage(r io.Reader) (*Message, error) {
+	m := &Message{}
+	if err := binary.Read(r, binary.LittleEndian, &m.Kind); err != nil {
+		return nil, err
+	}
+	m.Pattern = readBytes(r)
+	m.Channel = readBytes(r)
+	m.Payload = readBytes(r)
+	err := binary.Read(r, binary.LittleEndian, &m.Count)
+	return m, err
+}
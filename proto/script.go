@@ -0,0 +1,112 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandEval runs Script inside the FSM with Keys and Args, the script is
+// cached under its sha1 for later CommandEvalSha calls.
+type CommandEval struct {
+	Script []byte
+	Keys   [][]byte
+	Args   [][]byte
+}
+
+func (c *CommandEval) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdEval)
+	writeBytes(buf, c.Script)
+	writeBytesList(buf, c.Keys)
+	writeBytesList(buf, c.Args)
+	return buf.Bytes()
+}
+
+func parseEvalCommand(r io.Reader) *CommandEval {
+	cmd := &CommandEval{}
+	cmd.Script = readBytes(r)
+	cmd.Keys = readBytesList(r)
+	cmd.Args = readBytesList(r)
+	return cmd
+}
+
+// CommandEvalSha runs a cached script, Sha is its hex encoded sha1.
+type CommandEvalSha struct {
+	Sha  []byte
+	Keys [][]byte
+	Args [][]byte
+}
+
+func (c *CommandEvalSha) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdEvalSha)
+	writeBytes(buf, c.Sha)
+	writeBytesList(buf, c.Keys)
+	writeBytesList(buf, c.Args)
+	return buf.Bytes()
+}
+
+func parseEvalShaCommand(r io.Reader) *CommandEvalSha {
+	cmd := &CommandEvalSha{}
+	cmd.Sha = readBytes(r)
+	cmd.Keys = readBytesList(r)
+	cmd.Args = readBytesList(r)
+	return cmd
+}
+
+// ResponseEval carries the flattened result of the script, or the error
+// message as the only value when Status is StatusError.
+type ResponseEval struct {
+	Status Status
+	Values [][]byte
+}
+
+func (r *ResponseEval) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	writeBytesList(buf, r.Values)
+	return buf.Bytes()
+}
+
+func ParseEvalResponse(r io.Reader) (*ResponseEval, error) {
+	resp := &ResponseEval{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	resp.Values = readBytesList(r)
+	return resp, nil
+}
+
+// CommandScriptLoad caches Script on every replica without running it.
+type CommandScriptLoad struct {
+	Script []byte
+}
+
+func (c *CommandScriptLoad) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdScriptLoad)
+	writeBytes(buf, c.Script)
+	return buf.Bytes()
+}
+
+type ResponseScriptLoad struct {
+	Status Status
+	Sha    []byte
+}
+
+func (r *ResponseScriptLoad) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	writeBytes(buf, r.Sha)
+	return buf.Bytes()
+}
+
+func ParseScriptLoadResponse(r io.Reader) (*ResponseScriptLoad, error) {
+	resp := &ResponseScriptLoad{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	resp.Sha = readBytes(r)
+	return resp, nil
+}
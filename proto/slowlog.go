@@ -0,0 +1,92 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandSlowlog returns the Count most recent slow commands of the node
+// it is sent to, all of them when Count is zero. Reset empties the log
+// instead.
+type CommandSlowlog struct {
+	Count int32
+	Reset bool
+}
+
+func (c *CommandSlowlog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdSlowlog)
+	binary.Write(buf, binary.LittleEndian, c.Count)
+	binary.Write(buf, binary.LittleEndian, c.Reset)
+	return buf.Bytes()
+}
+
+func parseSlowlogCommand(r io.Reader) *CommandSlowlog {
+	cmd := &CommandSlowlog{}
+	binary.Read(r, binary.LittleEndian, &cmd.Count)
+	binary.Read(r, binary.LittleEndian, &cmd.Reset)
+	return cmd
+}
+
+// SlowlogEntry times are unix nanoseconds and spans nanoseconds, see
+// slowlog.Spans.
+type SlowlogEntry struct {
+	ID        uint64
+	Time      int64
+	Command   []byte
+	Namespace []byte
+	Remote    []byte
+	Parse     int64
+	Queue     int64
+	Raft      int64
+	FSM       int64
+	Exec      int64
+	Write     int64
+}
+
+type ResponseSlowlog struct {
+	Status  Status
+	Entries []SlowlogEntry
+}
+
+func (r *ResponseSlowlog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Entries)))
+	for _, e := range r.Entries {
+		binary.Write(buf, binary.LittleEndian, e.ID)
+		binary.Write(buf, binary.LittleEndian, e.Time)
+		writeBytes(buf, e.Command)
+		writeBytes(buf, e.Namespace)
+		writeBytes(buf, e.Remote)
+		binary.Write(buf, binary.LittleEndian, [6]int64{e.Parse, e.Queue, e.Raft, e.FSM, e.Exec, e.Write})
+	}
+	return buf.Bytes()
+}
+
+func ParseSlowlogResponse(r io.Reader) (*ResponseSlowlog, error) {
+	resp := &ResponseSlowlog{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return resp, err
+	}
+	for i := int32(0); i < n; i++ {
+		e := SlowlogEntry{}
+		binary.Read(r, binary.LittleEndian, &e.ID)
+		binary.Read(r, binary.LittleEndian, &e.Time)
+		e.Command = readBytes(r)
+		e.Namespace = readBytes(r)
+		e.Remote = readBytes(r)
+		var spans [6]int64
+		if err := binary.Read(r, binary.LittleEndian, &spans); err != nil {
+			return resp, err
+		}
+		e.Parse, e.Queue, e.Raft, e.FSM, e.Exec, e.Write = spans[0], spans[1], spans[2], spans[3], spans[4], spans[5]
+		resp.Entries = append(resp.Entries, e)
+	}
+	return resp, nil
+}
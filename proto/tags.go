@@ -0,0 +1,42 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandInvalidate deletes every key carrying any of Tags in one raft
+// entry.
+type CommandInvalidate struct {
+	Tags [][]byte
+}
+
+func (c *CommandInvalidate) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdInvalidate)
+	writeBytesList(buf, c.Tags)
+	return buf.Bytes()
+}
+
+// ResponseInvalidate holds how many keys were deleted.
+type ResponseInvalidate struct {
+	Status Status
+	Count  int32
+}
+
+func (r *ResponseInvalidate) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, r.Count)
+	return buf.Bytes()
+}
+
+func ParseInvalidateResponse(r io.Reader) (*ResponseInvalidate, error) {
+	resp := &ResponseInvalidate{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	err := binary.Read(r, binary.LittleEndian, &resp.Count)
+	return resp, err
+}
@@ -0,0 +1,43 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CommandTraced carries the W3C trace context of Command, the metadata
+// section of a command. It wraps any command, a namespaced one included,
+// and is never replicated.
+type CommandTraced struct {
+	TraceParent []byte
+	TraceState  []byte
+	Command     any
+}
+
+func (c *CommandTraced) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdTraced)
+	writeBytes(buf, c.TraceParent)
+	writeBytes(buf, c.TraceState)
+	var b []byte
+	if enc, ok := c.Command.(interface{ Bytes() []byte }); ok {
+		b = enc.Bytes()
+	}
+	writeBytes(buf, b)
+	return buf.Bytes()
+}
+
+func parseTracedCommand(r io.Reader) (*CommandTraced, error) {
+	cmd := &CommandTraced{TraceParent: readBytes(r), TraceState: readBytes(r)}
+	inner, err := ParseCommand(bytes.NewReader(readBytes(r)))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := inner.(*CommandTraced); ok {
+		return nil, fmt.Errorf("nested traced command")
+	}
+	cmd.Command = inner
+	return cmd, nil
+}
@@ -0,0 +1,159 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// CommandWatch asks for the current version of keys, a missing key has
+// version zero.
+type CommandWatch struct {
+	Keys [][]byte
+}
+
+func (c *CommandWatch) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdWatch)
+	writeBytesList(buf, c.Keys)
+	return buf.Bytes()
+}
+
+type ResponseWatch struct {
+	Status   Status
+	Versions []uint64
+}
+
+func (r *ResponseWatch) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Versions)))
+	binary.Write(buf, binary.LittleEndian, r.Versions)
+	return buf.Bytes()
+}
+
+func ParseWatchResponse(r io.Reader) (*ResponseWatch, error) {
+	resp := &ResponseWatch{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	binary.Read(r, binary.LittleEndian, &n)
+	if n < 0 {
+		n = 0
+	}
+	resp.Versions = make([]uint64, n)
+	err := binary.Read(r, binary.LittleEndian, &resp.Versions)
+	return resp, err
+}
+
+type WatchedKey struct {
+	Key     []byte
+	Version uint64
+}
+
+// CommandExec runs Ops (*CommandSet, *CommandDel and *CommandGet) as one
+// raft entry, only if every watched key still has the watched version.
+type CommandExec struct {
+	Watches []WatchedKey
+	Ops     []any
+}
+
+func (c *CommandExec) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, CmdExec)
+	binary.Write(buf, binary.LittleEndian, int32(len(c.Watches)))
+	for _, w := range c.Watches {
+		writeBytes(buf, w.Key)
+		binary.Write(buf, binary.LittleEndian, w.Version)
+	}
+	binary.Write(buf, binary.LittleEndian, int32(len(c.Ops)))
+	for _, op := range c.Ops {
+		var b []byte
+		if enc, ok := op.(interface{ Bytes() []byte }); ok {
+			b = enc.Bytes()
+		}
+		writeBytes(buf, b)
+	}
+	return buf.Bytes()
+}
+
+// MaxOps bounds the watched keys and the ops of a transaction.
+const MaxOps = 1 << 12
+
+// parseExecCommand leaves an op nil when it can not be parsed, the FSM
+// refuses the whole transaction then. A short frame stops at the first
+// read error.
+func parseExecCommand(r io.Reader) *CommandExec {
+	cmd := &CommandExec{}
+	n, ok := readLength(r, MaxOps)
+	if !ok {
+		return cmd
+	}
+	for i := int32(0); i < n; i++ {
+		w := WatchedKey{Key: readBytes(r)}
+		if w.Key == nil {
+			return cmd
+		}
+		if err := binary.Read(r, binary.LittleEndian, &w.Version); err != nil {
+			fail(r, err)
+			return cmd
+		}
+		cmd.Watches = append(cmd.Watches, w)
+	}
+	if n, ok = readLength(r, MaxOps); !ok {
+		return cmd
+	}
+	for i := int32(0); i < n; i++ {
+		b := readBytes(r)
+		if b == nil {
+			return cmd
+		}
+		op, _ := ParseCommand(bytes.NewReader(b))
+		cmd.Ops = append(cmd.Ops, op)
+	}
+	return cmd
+}
+
+type OpResult struct {
+	Status Status
+	Value  []byte
+}
+
+// ResponseExec has one result per op when Status is StatusOK, none when
+// the transaction was aborted or refused.
+type ResponseExec struct {
+	Status  Status
+	Results []OpResult
+}
+
+func (r *ResponseExec) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, r.Status)
+	binary.Write(buf, binary.LittleEndian, int32(len(r.Results)))
+	for _, res := range r.Results {
+		binary.Write(buf, binary.LittleEndian, res.Status)
+		writeBytes(buf, res.Value)
+	}
+	return buf.Bytes()
+}
+
+func ParseExecResponse(r io.Reader) (*ResponseExec, error) {
+	resp := &ResponseExec{}
+	if err := binary.Read(r, binary.LittleEndian, &resp.Status); err != nil {
+		return resp, err
+	}
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return resp, err
+	}
+	for i := int32(0); i < n; i++ {
+		res := OpResult{}
+		if err := binary.Read(r, binary.LittleEndian, &res.Status); err != nil {
+			return resp, err
+		}
+		res.Value = readBytes(r)
+		resp.Results = append(resp.Results, res)
+	}
+	return resp, nil
+}
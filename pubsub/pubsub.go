@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"sync"
+
+	"y3cache/cache"
+	"y3cache/fsm"
+	"y3cache/glob"
+)
+
+const (
+	KeyspacePrefix = "__keyspace__:"
+	KeyeventPrefix = "__keyevent__:"
+
+	subscriberBuffer = 128
+)
+
+type Message struct {
+	Pattern string
+	Channel string
+	Payload []byte
+}
+
+// Subscriber receives the messages of the channels and patterns it is
+// subscribed to on C. Delivery never blocks the publisher, messages are
+// dropped when the subscriber falls behind.
+type Subscriber struct {
+	C chan *Message
+
+	broker   *Broker
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	closed   bool
+}
+
+// Count returns the number of channels and patterns s is subscribed to.
+func (s *Subscriber) Count() int {
+	s.broker.lock.RLock()
+	defer s.broker.lock.RUnlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+func (s *Subscriber) Subscribe(channels ...string) {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ch := range channels {
+		s.channels[ch] = struct{}{}
+		if b.channels[ch] == nil {
+			b.channels[ch] = make(map[*Subscriber]struct{})
+		}
+		b.channels[ch][s] = struct{}{}
+	}
+}
+
+func (s *Subscriber) PSubscribe(patterns ...string) {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, p := range patterns {
+		s.patterns[p] = struct{}{}
+		if b.patterns[p] == nil {
+			b.patterns[p] = make(map[*Subscriber]struct{})
+		}
+		b.patterns[p][s] = struct{}{}
+	}
+}
+
+// Unsubscribe removes channels, or every channel when called without any,
+// and returns the channels that were removed.
+func (s *Subscriber) Unsubscribe(channels ...string) []string {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return unsubscribe(b.channels, s.channels, s, channels)
+}
+
+// PUnsubscribe is Unsubscribe for patterns.
+func (s *Subscriber) PUnsubscribe(patterns ...string) []string {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return unsubscribe(b.patterns, s.patterns, s, patterns)
+}
+
+// Close drops every subscription and closes C.
+func (s *Subscriber) Close() {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s.closed {
+		return
+	}
+	unsubscribe(b.channels, s.channels, s, nil)
+	unsubscribe(b.patterns, s.patterns, s, nil)
+	s.closed = true
+	close(s.C)
+}
+
+func unsubscribe(
+	index map[string]map[*Subscriber]struct{},
+	own map[string]struct{},
+	s *Subscriber,
+	names []string,
+) []string {
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+	removed := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; !ok {
+			continue
+		}
+		delete(own, name)
+		delete(index[name], s)
+		if len(index[name]) == 0 {
+			delete(index, name)
+		}
+		removed = append(removed, name)
+	}
+	return removed
+}
+
+type Broker struct {
+	lock     sync.RWMutex
+	channels map[string]map[*Subscriber]struct{}
+	patterns map[string]map[*Subscriber]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		channels: make(map[string]map[*Subscriber]struct{}),
+		patterns: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+func (b *Broker) NewSubscriber() *Subscriber {
+	return &Subscriber{
+		C:        make(chan *Message, subscriberBuffer),
+		broker:   b,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// Publish delivers payload to the subscribers of channel and of every
+// pattern matching it and returns how many deliveries were made.
+func (b *Broker) Publish(channel string, payload []byte) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	n := 0
+	for s := range b.channels[channel] {
+		if deliver(s, &Message{Channel: channel, Payload: payload}) {
+			n++
+		}
+	}
+	for p, subs := range b.patterns {
+		if !glob.Match(p, channel) {
+			continue
+		}
+		for s := range subs {
+			m := &Message{Pattern: p, Channel: channel, Payload: payload}
+			if deliver(s, m) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func deliver(s *Subscriber, m *Message) bool {
+	select {
+	case s.C <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// Notify is an fsm.Hook publishing applied changes. Keyspace changes are
+// published twice, the event name on __keyspace__:<key> and the key on
+// __keyevent__:<event>. Outside the default namespace the channels are
+// __keyspace@<namespace>__:<key> and __keyevent@<namespace>__:<event>.
+func (b *Broker) Notify(ev fsm.Event) {
+	switch ev.Type {
+	case fsm.EventPublish:
+		b.Publish(string(ev.Key), ev.Value)
+	case fsm.EventSet, fsm.EventDel, fsm.EventExpire, fsm.EventEvict:
+		keyspace, keyevent := KeyspacePrefix, KeyeventPrefix
+		if ev.Namespace != "" && ev.Namespace != cache.DefaultNamespace {
+			keyspace = "__keyspace@" + ev.Namespace + "__:"
+			keyevent = "__keyevent@" + ev.Namespace + "__:"
+		}
+		event := ev.Type.String()
+		b.Publish(keyspace+string(ev.Key), []byte(event))
+		b.Publish(keyevent+event, ev.Key)
+	}
+}
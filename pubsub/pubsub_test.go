@@ -0,0 +1,43 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"y3cache/fsm"
+)
+
+func TestPublish(t *testing.T) {
+	b := NewBroker()
+	s := b.NewSubscriber()
+	s.Subscribe("news")
+	p := b.NewSubscriber()
+	p.PSubscribe("news.*")
+
+	assert.Equal(t, 1, b.Publish("news", []byte("a")))
+	assert.Equal(t, 1, b.Publish("news.tech", []byte("b")))
+	assert.Equal(t, 0, b.Publish("sports", []byte("c")))
+
+	assert.Equal(t, &Message{Channel: "news", Payload: []byte("a")}, <-s.C)
+	assert.Equal(t, &Message{Pattern: "news.*", Channel: "news.tech", Payload: []byte("b")}, <-p.C)
+
+	assert.Equal(t, []string{"news"}, s.Unsubscribe())
+	assert.Equal(t, 0, b.Publish("news", []byte("d")))
+}
+
+func TestNotify(t *testing.T) {
+	b := NewBroker()
+	s := b.NewSubscriber()
+	s.PSubscribe("__key*__:*")
+	b.Notify(fsm.Event{Type: fsm.EventExpire, Key: []byte("foo")})
+
+	assert.Equal(t, "__keyspace__:foo", (<-s.C).Channel)
+	m := <-s.C
+	assert.Equal(t, "__keyevent__:expired", m.Channel)
+	assert.Equal(t, []byte("foo"), m.Payload)
+
+	s.Close()
+	_, ok := <-s.C
+	assert.False(t, ok)
+}
@@ -0,0 +1,282 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type builtin struct {
+	// arity is the exact number of arguments, -1 for variadic
+	arity int
+	call  func(in *interp, args []Value) (Value, error)
+}
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"+":  {-1, arith(func(a, b int64) (int64, error) { return a + b, nil })},
+		"-":  {-1, arith(func(a, b int64) (int64, error) { return a - b, nil })},
+		"*":  {-1, arith(func(a, b int64) (int64, error) { return a * b, nil })},
+		"/":  {-1, arith(divide(func(a, b int64) int64 { return a / b }))},
+		"%":  {-1, arith(divide(func(a, b int64) int64 { return a % b }))},
+		"<":  {2, compare(func(a, b int64) bool { return a < b })},
+		"<=": {2, compare(func(a, b int64) bool { return a <= b })},
+		">":  {2, compare(func(a, b int64) bool { return a > b })},
+		">=": {2, compare(func(a, b int64) bool { return a >= b })},
+		"=": {2, func(in *interp, args []Value) (Value, error) {
+			return equal(args[0], args[1]), nil
+		}},
+		"!=": {2, func(in *interp, args []Value) (Value, error) {
+			return !equal(args[0], args[1]), nil
+		}},
+		"not": {1, func(in *interp, args []Value) (Value, error) {
+			return !truthy(args[0]), nil
+		}},
+		"error": {1, func(in *interp, args []Value) (Value, error) {
+			return nil, fmt.Errorf("%s", toBytes(args[0]))
+		}},
+
+		"str": {1, func(in *interp, args []Value) (Value, error) {
+			b := toBytes(args[0])
+			return b, in.alloc(len(b))
+		}},
+		"int": {1, func(in *interp, args []Value) (Value, error) {
+			return toInt(args[0])
+		}},
+		"concat": {-1, func(in *interp, args []Value) (Value, error) {
+			var buf []byte
+			for _, a := range args {
+				buf = append(buf, toBytes(a)...)
+			}
+			return buf, in.alloc(len(buf))
+		}},
+		"len": {1, func(in *interp, args []Value) (Value, error) {
+			if l, ok := args[0].([]Value); ok {
+				return int64(len(l)), nil
+			}
+			return int64(len(toBytes(args[0]))), nil
+		}},
+		"substr": {3, func(in *interp, args []Value) (Value, error) {
+			b := toBytes(args[0])
+			start, end, err := bounds(len(b), args[1], args[2])
+			if err != nil {
+				return nil, err
+			}
+			return b[start:end:end], nil
+		}},
+		"split": {2, func(in *interp, args []Value) (Value, error) {
+			b := toBytes(args[0])
+			if len(b) == 0 {
+				return []Value{}, nil
+			}
+			parts := bytes.Split(b, toBytes(args[1]))
+			list := make([]Value, len(parts))
+			for i, p := range parts {
+				list[i] = p
+			}
+			return list, in.alloc(len(b) + 16*len(list))
+		}},
+		"join": {2, func(in *interp, args []Value) (Value, error) {
+			list, err := toList(args[0])
+			if err != nil {
+				return nil, err
+			}
+			parts := make([][]byte, len(list))
+			for i, e := range list {
+				parts[i] = toBytes(e)
+			}
+			b := bytes.Join(parts, toBytes(args[1]))
+			return b, in.alloc(len(b))
+		}},
+
+		"list": {-1, func(in *interp, args []Value) (Value, error) {
+			list := append([]Value{}, args...)
+			return list, in.alloc(16 * len(list))
+		}},
+		"append": {-1, func(in *interp, args []Value) (Value, error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("expects a list")
+			}
+			list, err := toList(args[0])
+			if err != nil {
+				return nil, err
+			}
+			out := append(append([]Value{}, list...), args[1:]...)
+			return out, in.alloc(16 * len(out))
+		}},
+		"nth": {2, func(in *interp, args []Value) (Value, error) {
+			list, err := toList(args[0])
+			if err != nil {
+				return nil, err
+			}
+			i, err := toInt(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if i < 0 {
+				i += int64(len(list))
+			}
+			if i < 0 || i >= int64(len(list)) {
+				return nil, nil
+			}
+			return list[i], nil
+		}},
+		"slice": {3, func(in *interp, args []Value) (Value, error) {
+			list, err := toList(args[0])
+			if err != nil {
+				return nil, err
+			}
+			start, end, err := bounds(len(list), args[1], args[2])
+			if err != nil {
+				return nil, err
+			}
+			return list[start:end:end], nil
+		}},
+
+		"key": {1, func(in *interp, args []Value) (Value, error) {
+			return nth(in.env.Keys, args[0])
+		}},
+		"arg": {1, func(in *interp, args []Value) (Value, error) {
+			return nth(in.env.Args, args[0])
+		}},
+		"now": {0, func(in *interp, args []Value) (Value, error) {
+			return in.env.Now.UnixMilli(), nil
+		}},
+		"index": {0, func(in *interp, args []Value) (Value, error) {
+			return int64(in.env.Index), nil
+		}},
+
+		"get": {1, func(in *interp, args []Value) (Value, error) {
+			v, _, ok := in.lookup(toBytes(args[0]))
+			if !ok {
+				return nil, nil
+			}
+			return v, nil
+		}},
+		"exists": {1, func(in *interp, args []Value) (Value, error) {
+			_, _, ok := in.lookup(toBytes(args[0]))
+			return ok, nil
+		}},
+		"ttl": {1, func(in *interp, args []Value) (Value, error) {
+			_, expiresAt, ok := in.lookup(toBytes(args[0]))
+			switch {
+			case !ok:
+				return int64(-2), nil
+			case expiresAt.IsZero():
+				return int64(-1), nil
+			}
+			return int64(expiresAt.Sub(in.env.Now).Seconds()), nil
+		}},
+		"set": {-1, func(in *interp, args []Value) (Value, error) {
+			if len(args) != 2 && len(args) != 3 {
+				return nil, fmt.Errorf("expects a key, a value and an optional ttl")
+			}
+			w := Write{Key: toBytes(args[0]), Value: toBytes(args[1])}
+			if len(args) == 3 {
+				ttl, err := toInt(args[2])
+				if err != nil {
+					return nil, err
+				}
+				w.TTL = int32(ttl)
+			}
+			in.write(w)
+			return true, in.alloc(len(w.Key) + len(w.Value))
+		}},
+		"del": {1, func(in *interp, args []Value) (Value, error) {
+			key := toBytes(args[0])
+			_, _, ok := in.lookup(key)
+			if ok {
+				in.write(Write{Key: key, Delete: true})
+			}
+			return ok, in.alloc(len(key))
+		}},
+	}
+}
+
+func arith(op func(a, b int64) (int64, error)) func(*interp, []Value) (Value, error) {
+	return func(in *interp, args []Value) (Value, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expects at least one argument")
+		}
+		acc, err := toInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range args[1:] {
+			n, err := toInt(a)
+			if err != nil {
+				return nil, err
+			}
+			if acc, err = op(acc, n); err != nil {
+				return nil, err
+			}
+		}
+		return acc, nil
+	}
+}
+
+func divide(op func(a, b int64) int64) func(a, b int64) (int64, error) {
+	return func(a, b int64) (int64, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return op(a, b), nil
+	}
+}
+
+func compare(op func(a, b int64) bool) func(*interp, []Value) (Value, error) {
+	return func(in *interp, args []Value) (Value, error) {
+		a, err := toInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return op(a, b), nil
+	}
+}
+
+// bounds resolves a start/end pair, negative values count from the end.
+func bounds(n int, startV, endV Value) (int, int, error) {
+	start, err := toInt(startV)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := toInt(endV)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 0 {
+		start += int64(n)
+	}
+	if end < 0 {
+		end += int64(n)
+	}
+	start = clamp(start, 0, int64(n))
+	end = clamp(end, start, int64(n))
+	return int(start), int(end), nil
+}
+
+func clamp(v, lo, hi int64) int64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func nth(list [][]byte, iV Value) (Value, error) {
+	i, err := toInt(iV)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= int64(len(list)) {
+		return nil, nil
+	}
+	return list[i], nil
+}
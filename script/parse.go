@@ -0,0 +1,155 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// MaxSource bounds the size of a script in bytes
+	MaxSource = 64 << 10
+	// MaxDepth bounds how deep lists nest, eval recurses as deep
+	MaxDepth = 64
+)
+
+// node is either an atom (a value or a symbol) or a list of nodes.
+type node struct {
+	list   []*node
+	isList bool
+	symbol string
+	value  Value
+}
+
+// Parse turns source into its top level forms.
+func Parse(source string) ([]*node, error) {
+	if len(source) > MaxSource {
+		return nil, fmt.Errorf("script is %d bytes, more than %d", len(source), MaxSource)
+	}
+	p := &parser{src: source}
+	var forms []*node
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return forms, nil
+		}
+		n, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		forms = append(forms, n)
+	}
+}
+
+type parser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ';':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) parse() (*node, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("unexpected end of script")
+	}
+	switch c := p.src[p.pos]; c {
+	case '(':
+		if p.depth >= MaxDepth {
+			return nil, fmt.Errorf("lists nested deeper than %d at %d", MaxDepth, p.pos)
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		p.pos++
+		n := &node{isList: true}
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.src) {
+				return nil, fmt.Errorf("missing )")
+			}
+			if p.src[p.pos] == ')' {
+				p.pos++
+				return n, nil
+			}
+			child, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, child)
+		}
+	case ')':
+		return nil, fmt.Errorf("unexpected ) at %d", p.pos)
+	case '"':
+		return p.parseString()
+	default:
+		return p.parseAtom()
+	}
+}
+
+func (p *parser) parseString() (*node, error) {
+	p.pos++
+	var buf []byte
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return &node{value: buf}, nil
+		case '\\':
+			if p.pos >= len(p.src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			e := p.src[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			default:
+				buf = append(buf, e)
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return nil, fmt.Errorf("unterminated string")
+}
+
+func (p *parser) parseAtom() (*node, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '(' || c == ')' || c == '"' || c == ';' ||
+			c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			break
+		}
+		p.pos++
+	}
+	tok := p.src[start:p.pos]
+	if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+		return &node{value: n}, nil
+	}
+	switch tok {
+	case "nil":
+		return &node{value: nil}, nil
+	case "true":
+		return &node{value: true}, nil
+	case "false":
+		return &node{value: false}, nil
+	}
+	return &node{symbol: tok}, nil
+}
@@ -0,0 +1,382 @@
+// Package script is the small lisp scripts run inside the FSM with.
+//
+//	(let n (int (arg 0)))        ; variables
+//	(if (> n 3) "big" "small")   ; if, do, while, and, or
+//	(set (key 0) (concat "v" n) 60)
+//
+// Values are nil, integers, booleans, strings and lists. Builtins cover
+// arithmetic (+ - * / %), comparison (= != < <= > >= not), strings (str int
+// concat len substr split join), lists (list append nth slice len), the
+// script inputs (key arg), the log entry (now index), the keyspace (get
+// exists ttl set del) and (error msg) to fail. There is no access to the
+// clock, randomness or I/O, so a script does the same on every replica.
+package script
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Value is what expressions evaluate to: nil, int64, bool, []byte or
+// []Value.
+type Value any
+
+type Limits struct {
+	// Steps bounds the number of evaluated expressions
+	Steps int
+	// Memory bounds the bytes of the strings and lists a script creates
+	Memory int
+}
+
+// DefaultLimits must be the same on every replica, a script hitting a
+// limit fails everywhere at the same step.
+var DefaultLimits = Limits{
+	Steps:  100_000,
+	Memory: 1 << 20,
+}
+
+// Store is the keyspace a script reads. Expired keys are still returned
+// until the FSM expires them, the local clock must never decide a read.
+type Store interface {
+	Lookup(key []byte) (value []byte, expiresAt time.Time, ok bool)
+}
+
+// Write is one change made by a script, applied by the caller only when the
+// whole script succeeded.
+type Write struct {
+	Key    []byte
+	Value  []byte
+	TTL    int32
+	Delete bool
+}
+
+// Env is everything a script can see, Now and Index come from the raft log
+// entry so they are the same on every replica.
+type Env struct {
+	Keys   [][]byte
+	Args   [][]byte
+	Now    time.Time
+	Index  uint64
+	Store  Store
+	Limits Limits
+}
+
+type Script struct {
+	Source string
+	Sha    string
+	forms  []*node
+}
+
+func Sha(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+func Compile(source string) (*Script, error) {
+	forms, err := Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{Source: source, Sha: Sha(source), forms: forms}, nil
+}
+
+// Run evaluates the script and returns its last value along with the
+// writes it made. Nothing is written when it fails.
+func (s *Script) Run(env Env) (Value, []Write, error) {
+	in := &interp{
+		env:     env,
+		vars:    make(map[string]Value),
+		overlay: make(map[string]int),
+	}
+	var (
+		result Value
+		err    error
+	)
+	for _, f := range s.forms {
+		if result, err = in.eval(f); err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, in.writes, nil
+}
+
+// Encode flattens a result into the values returned to the client.
+func Encode(v Value) [][]byte {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []Value:
+		var out [][]byte
+		for _, e := range t {
+			out = append(out, Encode(e)...)
+		}
+		return out
+	default:
+		return [][]byte{toBytes(v)}
+	}
+}
+
+type interp struct {
+	env    Env
+	steps  int
+	memory int
+	vars   map[string]Value
+	writes []Write
+	// overlay indexes the last write of every key written so far
+	overlay map[string]int
+}
+
+func (in *interp) alloc(n int) error {
+	in.memory += n
+	if in.memory > in.env.Limits.Memory {
+		return fmt.Errorf("script exceeded memory limit of %d bytes", in.env.Limits.Memory)
+	}
+	return nil
+}
+
+func (in *interp) eval(n *node) (Value, error) {
+	in.steps++
+	if in.steps > in.env.Limits.Steps {
+		return nil, fmt.Errorf("script exceeded step limit of %d", in.env.Limits.Steps)
+	}
+	if !n.isList {
+		if n.symbol == "" {
+			return n.value, nil
+		}
+		v, ok := in.vars[n.symbol]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable %s", n.symbol)
+		}
+		return v, nil
+	}
+	if len(n.list) == 0 {
+		return nil, nil
+	}
+	head := n.list[0]
+	if head.isList || head.symbol == "" {
+		return nil, fmt.Errorf("expected a function name")
+	}
+	args := n.list[1:]
+	switch head.symbol {
+	case "let":
+		if len(args) != 2 || args[0].isList || args[0].symbol == "" {
+			return nil, fmt.Errorf("let expects a name and a value")
+		}
+		v, err := in.eval(args[1])
+		if err != nil {
+			return nil, err
+		}
+		in.vars[args[0].symbol] = v
+		return v, nil
+	case "if":
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf("if expects a condition and one or two branches")
+		}
+		c, err := in.eval(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(c) {
+			return in.eval(args[1])
+		}
+		if len(args) == 3 {
+			return in.eval(args[2])
+		}
+		return nil, nil
+	case "do":
+		return in.evalBody(args)
+	case "while":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("while expects a condition")
+		}
+		var result Value
+		for {
+			c, err := in.eval(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(c) {
+				return result, nil
+			}
+			if result, err = in.evalBody(args[1:]); err != nil {
+				return nil, err
+			}
+		}
+	case "and":
+		var v Value = true
+		for _, a := range args {
+			var err error
+			if v, err = in.eval(a); err != nil || !truthy(v) {
+				return v, err
+			}
+		}
+		return v, nil
+	case "or":
+		var v Value
+		for _, a := range args {
+			var err error
+			if v, err = in.eval(a); err != nil || truthy(v) {
+				return v, err
+			}
+		}
+		return v, nil
+	}
+	vals := make([]Value, len(args))
+	for i, a := range args {
+		v, err := in.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return in.call(head.symbol, vals)
+}
+
+func (in *interp) evalBody(body []*node) (Value, error) {
+	var (
+		result Value
+		err    error
+	)
+	for _, n := range body {
+		if result, err = in.eval(n); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (in *interp) call(name string, args []Value) (Value, error) {
+	fn, ok := builtins[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	if fn.arity >= 0 && len(args) != fn.arity {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, fn.arity, len(args))
+	}
+	v, err := fn.call(in, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return v, nil
+}
+
+func (in *interp) lookup(key []byte) ([]byte, time.Time, bool) {
+	if i, ok := in.overlay[string(key)]; ok {
+		w := in.writes[i]
+		if w.Delete {
+			return nil, time.Time{}, false
+		}
+		var expiresAt time.Time
+		if w.TTL > 0 {
+			expiresAt = in.env.Now.Add(time.Duration(w.TTL) * time.Second)
+		}
+		return w.Value, expiresAt, true
+	}
+	return in.env.Store.Lookup(key)
+}
+
+func (in *interp) write(w Write) {
+	in.overlay[string(w.Key)] = len(in.writes)
+	in.writes = append(in.writes, w)
+}
+
+func truthy(v Value) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	}
+	return true
+}
+
+func toBytes(v Value) []byte {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return t
+	case int64:
+		return []byte(strconv.FormatInt(t, 10))
+	case bool:
+		if t {
+			return []byte("1")
+		}
+		return []byte("0")
+	case []Value:
+		parts := make([][]byte, len(t))
+		for i, e := range t {
+			parts[i] = toBytes(e)
+		}
+		return bytes.Join(parts, []byte(" "))
+	}
+	return nil
+}
+
+func toInt(v Value) (int64, error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case []byte:
+		n, err := strconv.ParseInt(string(t), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", t)
+		}
+		return n, nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("a list is not an integer")
+}
+
+func toList(v Value) ([]Value, error) {
+	switch t := v.(type) {
+	case []Value:
+		return t, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("expected a list")
+}
+
+func equal(a, b Value) bool {
+	switch ta := a.(type) {
+	case nil:
+		return b == nil
+	case []Value:
+		tb, ok := b.([]Value)
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !equal(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	case int64:
+		if tb, ok := b.(int64); ok {
+			return ta == tb
+		}
+	case bool:
+		if tb, ok := b.(bool); ok {
+			return ta == tb
+		}
+	}
+	if b == nil {
+		return false
+	}
+	if _, ok := b.([]Value); ok {
+		return false
+	}
+	return bytes.Equal(toBytes(a), toBytes(b))
+}
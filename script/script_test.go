@@ -0,0 +1,82 @@
+package script
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapStore map[string][]byte
+
+func (m mapStore) Lookup(key []byte) ([]byte, time.Time, bool) {
+	v, ok := m[string(key)]
+	return v, time.Time{}, ok
+}
+
+func run(t *testing.T, source string, env Env) (Value, []Write, error) {
+	sc, err := Compile(source)
+	assert.Nil(t, err)
+	if env.Store == nil {
+		env.Store = mapStore{}
+	}
+	if env.Limits == (Limits{}) {
+		env.Limits = DefaultLimits
+	}
+	return sc.Run(env)
+}
+
+func TestAppendAndTrim(t *testing.T) {
+	source := `
+; append (arg 0) to the list in (key 0), keep the last (arg 1) items
+(let items (split (get (key 0)) ","))
+(let items (append items (arg 0)))
+(let n (int (arg 1)))
+(if (> (len items) n)
+    (let items (slice items (- 0 n) (len items))))
+(set (key 0) (join items ",") 60)
+items`
+	v, writes, err := run(t, source, Env{
+		Keys:  [][]byte{[]byte("recent")},
+		Args:  [][]byte{[]byte("d"), []byte("3")},
+		Store: mapStore{"recent": []byte("a,b,c")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("d")}, Encode(v))
+	assert.Equal(t, []Write{{Key: []byte("recent"), Value: []byte("b,c,d"), TTL: 60}}, writes)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	v, writes, err := run(t, `(set "a" 1) (del "a") (exists "a")`, Env{})
+	assert.Nil(t, err)
+	assert.Equal(t, false, v)
+	assert.Len(t, writes, 2)
+}
+
+func TestLimits(t *testing.T) {
+	_, writes, err := run(t, `(set "a" 1) (while true 1)`, Env{})
+	assert.ErrorContains(t, err, "step limit")
+	assert.Nil(t, writes)
+
+	_, _, err = run(t, `(let s "x") (while true (let s (concat s s)))`, Env{})
+	assert.ErrorContains(t, err, "memory limit")
+}
+
+func TestParseLimits(t *testing.T) {
+	deep := strings.Repeat("(list ", MaxDepth) + strings.Repeat(")", MaxDepth)
+	_, err := Compile(deep)
+	assert.Nil(t, err)
+	_, err = Compile("(list " + deep + ")")
+	assert.ErrorContains(t, err, "nested deeper")
+
+	_, err = Compile(`"` + strings.Repeat("x", MaxSource) + `"`)
+	assert.ErrorContains(t, err, "more than")
+}
+
+func TestDeterministicTime(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	v, _, err := run(t, `(list (now) (index))`, Env{Now: now, Index: 42})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("1700000000000"), []byte("42")}, Encode(v))
+}
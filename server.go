@@ -1,154 +1,649 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
 
+	"y3cache/acl"
+	"y3cache/audit"
 	"y3cache/cache"
+	"y3cache/cdc"
 	"y3cache/client"
+	"y3cache/cluster"
+	"y3cache/fsm"
+	"y3cache/join"
+	"y3cache/logging"
+	"y3cache/metrics"
 	"y3cache/proto"
+	"y3cache/pubsub"
+	"y3cache/slowlog"
+	"y3cache/tlsutil"
+	"y3cache/trace"
+)
+
+const (
+	expireInterval = 100 * time.Millisecond
+	expireBatch    = 64
+	// handshakeTimeout bounds the TLS handshake of a new connection
+	handshakeTimeout = 10 * time.Second
 )
 
 type ServerOpts struct {
-	NodeID      string
+	NodeID string
+	// RaftAddress is the address of the node in the raft configuration,
+	// the one other nodes dial
 	RaftAddress string
-	ListenAddr  string
-	IsLeader    bool
-	LeaderAddr  string
+	// ListenAddr is the address the client listener binds
+	ListenAddr string
+	// AdvertiseAddr is the client address other nodes forward and redirect
+	// to, registered in the members of the cluster. ListenAddr when empty
+	AdvertiseAddr string
+	IsLeader      bool
+	// Seeds are client addresses of cluster members, a node that is not
+	// the leader joins the cluster through them
+	Seeds []string
+	// JoinSecret is shared by every node of the cluster, joins signed
+	// with another secret are refused
+	JoinSecret []byte
+	// Role is the role asked for when joining the leader
+	Role proto.Role
+	// MaxStaleness refuses reads on a follower that heard from the leader
+	// longer ago than this, zero serves them whatever the lag
+	MaxStaleness time.Duration
+	// TransferOnShutdown makes a leader hand leadership over before it
+	// shuts down
+	TransferOnShutdown bool
+	// TLS serves clients over TLS when set, with ClientAuth requiring
+	// client certificates for mutual TLS
+	TLS *tls.Config
+	// PeerTLS dials the client port of other nodes, to join or forward to
+	// the leader. Needed when they serve TLS
+	PeerTLS *tls.Config
+	// Pending gets the identity of every node a join is sent to, raft
+	// over TLS lets them in until the node has a configuration
+	Pending *cluster.Pending
+	// NodeToken authenticates the node to the others once users are
+	// defined, see acl. Not needed when the certificate of the node
+	// names a user
+	NodeToken []byte
+	// Audit records the mutating and admin commands, nil records nothing
+	Audit *audit.Logger
+	// Metrics is where the server registers its metrics, served by
+	// Handler. A registry of its own when nil
+	Metrics *metrics.Registry
+	// Logger is the root logger of the node, nothing is logged when nil
+	Logger *zap.Logger
+	// ReadyMaxLag is how many committed entries the node may not have
+	// applied yet and still be ready, see Handler
+	ReadyMaxLag uint64
+	// Slowlog records the commands over its threshold, nil records nothing
+	Slowlog *slowlog.Log
+	// ApplyTimings are filled by the FSM wrapped with fsm.Timed, they
+	// split the FSM time out of the raft span. nil counts it in raft's
+	ApplyTimings *fsm.Timings
+	// Tracer exports the spans of commands sent with a trace context, nil
+	// exports nothing
+	Tracer *trace.Tracer
+	// MaxConns closes new connections once this many are open, zero
+	// accepts any number. Other nodes count too
+	MaxConns int
 }
 
 type Server struct {
 	ServerOpts
 	members map[*client.Client]struct{}
-	cache   cache.Cacher
+	cluster *cluster.Members
+	users   *acl.Store
+	spaces  *cache.Namespaces
 	raft    *raft.Raft
+	broker  *pubsub.Broker
+	changes *cdc.Hub
+	joins   *join.Verifier
+	metrics *serverMetrics
 	// logger  *zap.Logger
 	logger *zap.SugaredLogger
+
+	// lock guards the fields below, see Shutdown
+	lock     sync.Mutex
+	cancel   context.CancelFunc
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	connSeq  uint64
+	closing  bool
+	inflight sync.WaitGroup
 }
 
-func NewServer(opts ServerOpts, c cache.Cacher, r *raft.Raft) *Server {
-	ll, _ := zap.NewProduction()
-	l := ll.Sugar()
-	fmt.Println(
-		"node:",
-		opts.NodeID,
-		"leader:",
-		opts.LeaderAddr,
-		"raft address:",
+func NewServer(
+	opts ServerOpts,
+	spaces *cache.Namespaces,
+	m *cluster.Members,
+	u *acl.Store,
+	r *raft.Raft,
+	b *pubsub.Broker,
+	h *cdc.Hub,
+) *Server {
+	l := logging.OrNop(opts.Logger).Named("server").Sugar()
+	l.Infow(
+		"server created",
+		"seeds",
+		opts.Seeds,
+		"raft_address",
 		opts.RaftAddress,
-		"Listening on.. ",
+		"addr",
 		opts.ListenAddr,
+		"advertise",
+		opts.AdvertiseAddr,
 	)
-	return &Server{
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
+	s := &Server{
 		ServerOpts: opts,
 		// TODO: only allocate when server is the leader
 		members: make(map[*client.Client]struct{}),
 		raft:    r,
-		cache:   c,
+		spaces:  spaces,
+		cluster: m,
+		users:   u,
+		broker:  b,
+		changes: h,
+		joins:   join.NewVerifier(opts.JoinSecret, join.DefaultWindow),
 		logger:  l,
+		conns:   make(map[net.Conn]struct{}),
+		metrics: newServerMetrics(opts.Metrics),
 	}
+	opts.Metrics.Register(metrics.CollectorFunc(s.collect))
+	return s
 }
 
-func (s *Server) Start() error {
+func (s *Server) Start(ctx context.Context) error {
 	ln, err := net.Listen("tcp", s.ListenAddr)
 	if err != nil {
 		return fmt.Errorf("listen error: %s", err)
 	}
+	return s.Serve(ctx, ln)
+}
 
-	if !s.IsLeader && len(s.LeaderAddr) != 0 {
-		if err := s.dialLeader(); err != nil {
-			log.Println(err)
-		}
+// Serve accepts client connections on ln until Shutdown, the background
+// loops of the server stop with ctx.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		cancel()
+		ln.Close()
+		return errServerClosed
 	}
+	if s.TLS != nil {
+		ln = tls.NewListener(ln, s.TLS)
+	}
+	s.ln, s.cancel = ln, cancel
+	s.lock.Unlock()
+
+	if !s.IsLeader && len(s.Seeds) != 0 {
+		go s.joinCluster(ctx)
+	}
+	go s.expireLoop(ctx)
+	go s.memberLoop(ctx)
 	s.logger.Infow(
 		"server starting",
 		"addr",
 		s.ListenAddr,
 		"leader",
 		s.IsLeader,
+		"tls",
+		s.TLS != nil,
 	)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("accept error: %s\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				if s.isClosing() {
+					return errServerClosed
+				}
+				return err
+			}
+			s.logger.Warnw("accept error", "error", err)
 			continue
 		}
 		go s.handleConn(conn)
 	}
 }
 
-func (s *Server) dialLeader() error {
-	conn, err := net.Dial("tcp", s.LeaderAddr)
-	if err != nil {
-		return fmt.Errorf("failed to dial leader [%s]", s.LeaderAddr)
+// expireLoop makes the leader replicate the expiry of keys whose TTL has
+// elapsed, followers only hide them from readers until the entry arrives.
+func (s *Server) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() != raft.Leader {
+			continue
+		}
+		for _, ns := range s.spaces.Names() {
+			c, ok := s.spaces.Get(ns)
+			if !ok {
+				continue
+			}
+			for _, key := range c.ExpiredKeys(expireBatch) {
+				cmd := &proto.CommandExpire{Key: key}
+				if err := s.apply(ns, cmd).Error(); err != nil {
+					s.logger.Warnw(
+						"error expiring key",
+						"namespace",
+						ns,
+						logging.FieldKeyHash,
+						logging.HashKey(key),
+						"error",
+						err,
+					)
+					break
+				}
+			}
+		}
 	}
-	defer conn.Close()
-	log.Println("connected to leader:", s.LeaderAddr)
-	j := &proto.CommandJoin{
-		NodeId:      []byte(s.NodeID),
-		RaftAddress: []byte(s.RaftAddress),
+}
+
+// apply replicates cmd to run in namespace ns, commands of the default
+// namespace are logged as they are.
+func (s *Server) apply(ns string, cmd interface{ Bytes() []byte }) raft.ApplyFuture {
+	if ns != "" && ns != cache.DefaultNamespace {
+		cmd = &proto.CommandNamespaced{Namespace: []byte(ns), Command: cmd}
+	}
+	return s.raft.Apply(cmd.Bytes(), 500*time.Millisecond)
+}
+
+// handshake completes the TLS handshake of conn and returns the identity
+// of its client certificate, "" on plain connections.
+func (s *Server) handshake(conn net.Conn) (string, error) {
+	if s.TLS == nil {
+		return "", nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	return tlsutil.Identity(conn)
+}
+
+// dialPeer opens a connection to the client port of another node.
+func (s *Server) dialPeer(addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.PeerTLS != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, tlsutil.ForAddr(s.PeerTLS, addr))
+	} else {
+		conn, err = d.Dial("tcp", addr)
 	}
-	_, err = conn.Write(j.Bytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if err := s.authenticatePeer(conn, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	logger := s.logger.With(logging.FieldConn, s.nextConnID(), "remote", conn.RemoteAddr().String())
+	identity, err := s.handshake(conn)
+	if err != nil {
+		logger.Warnw("tls handshake failed", "error", err)
+		return
+	}
+	if identity != "" {
+		logger.Debugw("client authenticated", "identity", identity)
+	}
+	sess := s.newSession(logger, identity)
+	// the replies of the commands still running are written before the
+	// connection is closed, Shutdown only stops the read loop
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	var sub *pubsub.Subscriber
+	selected := cache.DefaultNamespace
+	defer func() {
+		if sub != nil {
+			sub.Close()
+		}
+	}()
+	reader := &readTimer{Reader: conn}
 	for {
-		cmd, err := proto.ParseCommand(conn)
+		reader.first = time.Time{}
+		cmd, err := proto.ParseCommand(reader)
+		parsed := received{start: reader.first, end: time.Now()}
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || s.isClosing() {
 				break
 			}
-			log.Println("parse command error:", err)
+			logger.Warnw("parse command error", "error", err)
 			break
 		}
-		go s.handleCommand(conn, cmd)
+		if v, ok := cmd.(*proto.CommandTraced); ok {
+			parsed.parent = traceParent(logger, v.TraceParent, v.TraceState)
+			cmd = v.Command
+		}
+		if v, ok := cmd.(*proto.CommandAuth); ok {
+			s.run(conn, sess, selected, v, parsed, func(conn net.Conn) {
+				s.handleAuthCommand(conn, sess, v)
+			})
+			continue
+		}
+		ns := selected
+		if v, ok := cmd.(*proto.CommandNamespaced); ok {
+			if len(v.Namespace) > 0 {
+				ns = string(v.Namespace)
+			}
+			cmd = v.Command
+		}
+		if !s.authorized(sess, ns, cmd) {
+			commandLogger(logger, ns, cmd).Warnw("unauthorized command", "user", sess.user)
+			if sub != nil || isSubscriptionCommand(cmd) {
+				// subscriptions have no status to answer with
+				break
+			}
+			s.run(conn, sess, ns, cmd, parsed, func(conn net.Conn) {
+				if _, err := conn.Write(unauthorized(cmd).Bytes()); err != nil {
+					s.log(conn).Warnw("error while responding to client", "error", err)
+				}
+			})
+			continue
+		}
+		if v, ok := cmd.(*proto.CommandChanges); ok && sub == nil {
+			s.streamChanges(conn, v)
+			return
+		}
+		if isSubscriptionCommand(cmd) {
+			if sub == nil {
+				sub = s.broker.NewSubscriber()
+				go s.forwardMessages(conn, sub)
+			}
+			s.handleSubscriptionCommand(conn, sub, cmd)
+			continue
+		}
+		if sub != nil {
+			// the client waits for a reply a Message can not carry
+			logger.Warnw("only (P)(UN)SUBSCRIBE allowed on a subscribed connection")
+			m := &proto.Message{
+				Kind:    proto.MessageError,
+				Payload: []byte("only (P)(UN)SUBSCRIBE allowed on a subscribed connection"),
+			}
+			if _, err := conn.Write(m.Bytes()); err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			break
+		}
+		if v, ok := cmd.(*proto.CommandSelect); ok {
+			selected = cache.DefaultNamespace
+			if len(v.Namespace) > 0 {
+				selected = string(v.Namespace)
+			}
+			resp := &proto.ResponseStatus{Status: proto.StatusOK}
+			if _, err := conn.Write(resp.Bytes()); err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			continue
+		}
+		if !s.startCommand() {
+			break
+		}
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			defer s.inflight.Done()
+			s.run(conn, sess, ns, cmd, parsed, func(conn net.Conn) {
+				s.handleCommand(conn, ns, cmd)
+			})
+		}()
 	}
 }
 
-func (s *Server) handleCommand(conn net.Conn, cmd any) {
-	fmt.Println("[SERV LEADER] Recieved Command, Handling...")
+func (s *Server) handleCommand(conn net.Conn, ns string, cmd any) {
 	switch v := cmd.(type) {
 	case *proto.CommandSet:
 		if s.raft.State() != raft.Leader {
-			log.Println("[SERV FOLLOWER] recieving SET command, ERR!")
+			s.log(conn).Debugw("refusing write on a follower")
 			rs := &proto.ResponseSet{
 				Status: proto.StatusError,
 			}
 			_, err := conn.Write(rs.Bytes())
 			if err != nil {
-				log.Println("[SERV FOLLOWER] error while responding to client")
+				s.log(conn).Warnw("error while responding to client", "error", err)
 			}
 			return
 		}
-		s.handleSetCommand(conn, v)
+		s.handleSetCommand(conn, ns, v)
 
 	case *proto.CommandGet:
-		s.handleGetCommand(conn, v)
+		s.handleGetCommand(conn, ns, v)
+
+	case *proto.CommandDel:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseDel{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handleDelCommand(conn, ns, v)
+
+	case *proto.CommandInvalidate:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseInvalidate{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handleInvalidateCommand(conn, ns, v)
+
+	case *proto.CommandWatch:
+		s.handleWatchCommand(conn, ns, v)
+
+	case *proto.CommandExec:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseExec{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handleExecCommand(conn, ns, v)
+
+	case *proto.CommandEval, *proto.CommandEvalSha:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseEval{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handleEvalCommand(conn, ns, v.(interface{ Bytes() []byte }))
+
+	case *proto.CommandScriptLoad:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseScriptLoad{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handleScriptLoadCommand(conn, v)
+
+	case *proto.CommandPublish:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponsePublish{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		s.handlePublishCommand(conn, v)
 
 	case *proto.CommandJoin:
 		if s.raft.State() != raft.Leader {
-			log.Println("[SERV FOLLOWER] recieving JOIN command, ERR!")
-			rs := &proto.ResponseSet{
+			s.log(conn).Debugw("redirecting join to the leader")
+			// the joining node retries on the leader's address, or on
+			// its next seed when it is not known yet
+			_, leader := s.raft.LeaderWithID()
+			m, _ := s.cluster.Get(string(leader))
+			rs := &proto.ResponseMembership{
+				Status:  proto.StatusNotLeader,
+				Message: []byte(m.ClientAddress),
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		if err := s.handleJoinCommnad(conn, v); err != nil {
+			s.log(conn).Warnw(
+				"join rejected",
+				"node",
+				string(v.NodeId),
+				"raft_address",
+				string(v.RaftAddress),
+				"remote",
+				conn.RemoteAddr().String(),
+				"error",
+				err,
+			)
+			rs := &proto.ResponseMembership{
+				Status:  proto.StatusError,
+				Message: []byte(err.Error()),
+			}
+			if _, err := conn.Write(rs.Bytes()); err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		rs := &proto.ResponseMembership{Status: proto.StatusOK}
+		if _, err := conn.Write(rs.Bytes()); err != nil {
+			s.log(conn).Warnw("error while responding to client", "error", err)
+		}
+
+	case *proto.CommandNamespaceConfig:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseStatus{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		if err := fsm.NamespaceLimits(v).Validate(); err != nil {
+			s.log(conn).Debugw("refusing namespace config", "error", err)
+			rs := &proto.ResponseStatus{Status: proto.StatusError}
+			if _, err := conn.Write(rs.Bytes()); err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		if len(v.Namespace) == 0 {
+			v.Namespace = []byte(ns)
+		}
+		s.handleStatusCommand(conn, v)
+
+	case *proto.CommandFlush:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseStatus{
+				Status: proto.StatusError,
+			}
+			_, err := conn.Write(rs.Bytes())
+			if err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+			return
+		}
+		if len(v.Namespace) == 0 {
+			v.Namespace = []byte(ns)
+		}
+		s.handleStatusCommand(conn, v)
+
+	case *proto.CommandNamespaceStats:
+		s.handleNamespaceStatsCommand(conn, v)
+
+	case *proto.CommandLeave, *proto.CommandRemove,
+		*proto.CommandPromote, *proto.CommandDemote, *proto.CommandTransfer:
+		s.handleMembershipCommand(conn, v)
+
+	case *proto.CommandMembers:
+		s.handleMembersCommand(conn)
+
+	case *proto.CommandACLSetUser, *proto.CommandACLDelUser:
+		if s.raft.State() != raft.Leader {
+			s.log(conn).Debugw("refusing write on a follower")
+			rs := &proto.ResponseStatus{
 				Status: proto.StatusError,
 			}
 			_, err := conn.Write(rs.Bytes())
 			if err != nil {
-				log.Println("[SERV FOLLOWER] error while responding to client")
+				s.log(conn).Warnw("error while responding to client", "error", err)
 			}
 			return
 		}
-		s.handleJoinCommnad(conn, v)
+		if err := s.handleACLCommand(conn, v); err != nil {
+			s.logger.Warnw("acl change rejected", "error", err)
+			rs := &proto.ResponseStatus{Status: proto.StatusError}
+			if _, err := conn.Write(rs.Bytes()); err != nil {
+				s.log(conn).Warnw("error while responding to client", "error", err)
+			}
+		}
+
+	case *proto.CommandACLList:
+		s.handleACLListCommand(conn)
+
+	case *proto.CommandSlowlog:
+		s.handleSlowlogCommand(conn, v)
 	}
 }
 
@@ -156,71 +651,113 @@ func (s *Server) handleJoinCommnad(
 	conn net.Conn,
 	cmd *proto.CommandJoin,
 ) error {
-	fmt.Printf(
-		"[SERV J] %s,addr: %s\n",
-		string(cmd.NodeId),
-		string(cmd.RaftAddress),
-	)
 	if s.raft.State() != raft.Leader {
 		return fmt.Errorf("not the leader")
 	}
+	if err := s.joins.Verify(cmd, time.Now()); err != nil {
+		return err
+	}
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return fmt.Errorf("failed to get raft conf %s", err.Error())
 	}
-	f := s.raft.AddVoter(
-		raft.ServerID(cmd.NodeId),
-		raft.ServerAddress(cmd.RaftAddress),
-		0,
-		0,
-	)
+	id, addr := raft.ServerID(cmd.NodeId), raft.ServerAddress(cmd.RaftAddress)
+	role := cmd.Role
+	for _, srv := range configFuture.Configuration().Servers {
+		switch {
+		case srv.ID == id && srv.Address == addr:
+			// a retried join, only PROMOTE and DEMOTE change the role
+			s.logger.Infow("node is already a member", "node", string(id))
+			if m, _ := s.cluster.Get(string(id)); m.ClientAddress != string(cmd.ClientAddress) {
+				s.setMember(cmd.NodeId, cmd.ClientAddress)
+			}
+			return nil
+		case srv.ID == id:
+			s.logger.Infow(
+				"node rejoining with a new address",
+				"node",
+				string(id),
+				"old",
+				string(srv.Address),
+				"new",
+				string(addr),
+			)
+			role = proto.RoleVoter
+			if srv.Suffrage != raft.Voter {
+				role = proto.RoleReplica
+			}
+		case srv.Address == addr:
+			// a node that left its address behind, two servers can't
+			// share one
+			s.logger.Infow(
+				"removing stale server",
+				"node",
+				string(srv.ID),
+				"address",
+				string(addr),
+			)
+			if err := s.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return fmt.Errorf("error remove stale server: %s", err)
+			}
+			s.removeMember(srv.ID)
+		}
+	}
+	add := s.raft.AddVoter
+	if role == proto.RoleReplica {
+		add = s.raft.AddNonvoter
+	}
+	f := add(id, addr, 0, 0)
 	if f.Error() != nil {
-		return fmt.Errorf("error add voter: %s", f.Error().Error())
+		return fmt.Errorf("error add %s: %s", role, f.Error().Error())
 	}
-	fmt.Printf(
-		"node %s at %s joined successfully\n",
-		cmd.NodeId,
-		cmd.RaftAddress,
+	s.setMember(cmd.NodeId, cmd.ClientAddress)
+	s.logger.Infow(
+		"node joined",
+		"node",
+		string(cmd.NodeId),
+		"raft_address",
+		string(cmd.RaftAddress),
+		"role",
+		role.String(),
+		logging.FieldRaftIndex,
+		f.Index(),
 	)
-	pp(s.raft.Stats())
 	return nil
 }
 
-func pp(d map[string]string) {
-	fmt.Printf("{\n")
-	for k, v := range d {
-		fmt.Printf("%s: %s.\n", k, v)
-	}
-	fmt.Printf("}\n")
-}
-
-func (s *Server) handleSetCommand(conn net.Conn, cmd *proto.CommandSet) error {
-	fmt.Printf("applying.. %s\n", string(cmd.Key))
-	applyFuture := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond)
-	fmt.Printf("applied %s\n", string(cmd.Key))
+func (s *Server) handleSetCommand(conn net.Conn, ns string, cmd *proto.CommandSet) error {
+	applyFuture := s.apply(ns, cmd)
 	if err := applyFuture.Error(); err != nil {
-		fmt.Println("error while applying: ", err)
+		s.log(conn).Warnw("error applying command", "error", err)
 		return fmt.Errorf(
 			"error persisting data in raft cluster: %s",
 			err.Error(),
 		)
 	}
-
-	fmt.Printf("applied with no errors %s\n", string(cmd.Key))
+	recordIndex(conn, applyFuture.Index())
 	r, ok := applyFuture.Response().(*proto.ResponseSet)
 	if !ok {
 		return fmt.Errorf("error response is not match apply response\n")
 	}
-
-	log.Printf("[SERV] SET %s to %s\n", cmd.Key, cmd.Value)
-	log.Printf("[SERV] sucess persisting data\n")
+	s.log(conn).Debugw("command applied", logging.FieldRaftIndex, applyFuture.Index())
 	conn.Write(r.Bytes())
 	return nil
 }
 
-func (s *Server) handleGetCommand(conn net.Conn, cmd *proto.CommandGet) error {
+func (s *Server) handleGetCommand(conn net.Conn, ns string, cmd *proto.CommandGet) error {
 	resp := proto.ResponseGet{}
-	value, err := s.cache.Get(cmd.Key)
+	if s.tooStale() {
+		resp.Status = proto.StatusStale
+		_, err := conn.Write(resp.Bytes())
+		return err
+	}
+	c, ok := s.spaces.Get(ns)
+	if !ok {
+		resp.Status = proto.StatusKeyNotFound
+		_, err := conn.Write(resp.Bytes())
+		return err
+	}
+	value, err := c.Get(cmd.Key)
 	if err != nil {
 		resp.Status = proto.StatusKeyNotFound
 		_, err := conn.Write(resp.Bytes())
@@ -231,3 +768,44 @@ func (s *Server) handleGetCommand(conn net.Conn, cmd *proto.CommandGet) error {
 	_, err = conn.Write(resp.Bytes())
 	return err
 }
+
+func (s *Server) handleDelCommand(conn net.Conn, ns string, cmd *proto.CommandDel) error {
+	applyFuture := s.apply(ns, cmd)
+	if err := applyFuture.Error(); err != nil {
+		conn.Write((&proto.ResponseDel{Status: proto.StatusError}).Bytes())
+		return fmt.Errorf(
+			"error persisting data in raft cluster: %s",
+			err.Error(),
+		)
+	}
+	recordIndex(conn, applyFuture.Index())
+	r, ok := applyFuture.Response().(*proto.ResponseDel)
+	if !ok {
+		return fmt.Errorf("error response is not match apply response\n")
+	}
+	_, err := conn.Write(r.Bytes())
+	return err
+}
+
+func (s *Server) handleInvalidateCommand(conn net.Conn, ns string, cmd *proto.CommandInvalidate) error {
+	applyFuture := s.apply(ns, cmd)
+	resp := &proto.ResponseInvalidate{Status: proto.StatusError}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error invalidating tags", "error", err)
+	} else if r, ok := applyFuture.Response().(*proto.ResponseInvalidate); ok {
+		recordIndex(conn, applyFuture.Index())
+		resp = r
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+// tooStale tells whether a follower lost contact with the leader for longer
+// than MaxStaleness, voters and read replicas follow the same rule.
+func (s *Server) tooStale() bool {
+	if s.MaxStaleness == 0 || s.raft.State() == raft.Leader {
+		return false
+	}
+	last := s.raft.LastContact()
+	return last.IsZero() || time.Since(last) > s.MaxStaleness
+}
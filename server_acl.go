@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"y3cache/acl"
+	"y3cache/cache"
+	"y3cache/proto"
+)
+
+// session is who a connection is authenticated as, by AUTH or by the
+// identity of its client certificate when a user has that name.
+type session struct {
+	user     string
+	identity string
+	// logger has the conn_id of the connection
+	logger *zap.SugaredLogger
+}
+
+func (s *Server) newSession(logger *zap.SugaredLogger, identity string) *session {
+	sess := &session{identity: identity, logger: logger}
+	if identity == "" {
+		return sess
+	}
+	if _, ok := s.users.Get(identity); ok {
+		sess.user = identity
+	}
+	return sess
+}
+
+// handleAuthCommand is answered right away, the connection stays
+// authenticated as the user until another AUTH.
+func (s *Server) handleAuthCommand(conn net.Conn, sess *session, cmd *proto.CommandAuth) {
+	resp := &proto.ResponseStatus{Status: proto.StatusUnauthorized}
+	if u, ok := s.users.Authenticate(string(cmd.Username), cmd.Password); ok {
+		sess.user = u.Name
+		resp.Status = proto.StatusOK
+	} else {
+		sess.logger.Warnw(
+			"authentication failed",
+			"user",
+			string(cmd.Username),
+			"remote",
+			conn.RemoteAddr().String(),
+		)
+	}
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		s.log(conn).Warnw("error while responding to client", "error", err)
+	}
+}
+
+// access is what running a command takes: the permission, the namespace
+// and the keys it touches. nil keys are unknown in advance and need a
+// user allowed every key.
+func access(ns string, cmd any) (acl.Perm, string, [][]byte) {
+	none := [][]byte{}
+	switch v := cmd.(type) {
+	case *proto.CommandGet:
+		return acl.PermRead, ns, [][]byte{v.Key}
+	case *proto.CommandWatch:
+		return acl.PermRead, ns, v.Keys
+	case *proto.CommandNamespaceStats, *proto.CommandMembers:
+		return acl.PermRead, ns, none
+	case *proto.CommandSubscribe, *proto.CommandPSubscribe, *proto.CommandChanges:
+		// keyspace notifications and changes carry any key
+		return acl.PermRead, ns, nil
+	case *proto.CommandSet:
+		return acl.PermWrite, ns, [][]byte{v.Key}
+	case *proto.CommandDel:
+		return acl.PermWrite, ns, [][]byte{v.Key}
+	case *proto.CommandExec:
+		keys := [][]byte{}
+		for _, w := range v.Watches {
+			keys = append(keys, w.Key)
+		}
+		for _, op := range v.Ops {
+			switch op := op.(type) {
+			case *proto.CommandSet:
+				keys = append(keys, op.Key)
+			case *proto.CommandGet:
+				keys = append(keys, op.Key)
+			case *proto.CommandDel:
+				keys = append(keys, op.Key)
+			}
+		}
+		return acl.PermWrite, ns, keys
+	case *proto.CommandPublish:
+		return acl.PermWrite, ns, none
+	case *proto.CommandEval, *proto.CommandEvalSha:
+		// get, set and del take any key at run time, the declared keys
+		// bound nothing
+		return acl.PermWrite, ns, nil
+	case *proto.CommandScriptLoad, *proto.CommandInvalidate:
+		return acl.PermWrite, ns, nil
+	case *proto.CommandNamespaceConfig:
+		return acl.PermAdmin, namespaceOr(v.Namespace, ns), none
+	case *proto.CommandFlush:
+		return acl.PermAdmin, namespaceOr(v.Namespace, ns), none
+	case *proto.CommandSelect:
+		// an empty namespace goes back to the default one
+		return acl.PermRead, namespaceOr(v.Namespace, cache.DefaultNamespace), none
+	case *proto.CommandJoin:
+		return acl.PermJoin, ns, none
+	}
+	// membership, users and the commands only the leader appends
+	return acl.PermAdmin, ns, none
+}
+
+func namespaceOr(namespace []byte, ns string) string {
+	if len(namespace) > 0 {
+		return string(namespace)
+	}
+	return ns
+}
+
+// authorized tells whether sess may run cmd in namespace ns, anything goes
+// until users are defined.
+func (s *Server) authorized(sess *session, ns string, cmd any) bool {
+	switch cmd.(type) {
+	case *proto.CommandUnsubscribe, *proto.CommandPUnsubscribe:
+		return true
+	}
+	if !s.users.Enabled() {
+		return true
+	}
+	u, ok := s.users.Get(sess.user)
+	if !ok {
+		return false
+	}
+	perm, ns, keys := access(ns, cmd)
+	return u.Allowed(perm, ns, keys...)
+}
+
+// unauthorized answers cmd with StatusUnauthorized in the response its
+// client waits for.
+func unauthorized(cmd any) interface{ Bytes() []byte } {
+	status := proto.StatusUnauthorized
+	switch cmd.(type) {
+	case *proto.CommandSet:
+		return &proto.ResponseSet{Status: status}
+	case *proto.CommandGet:
+		return &proto.ResponseGet{Status: status}
+	case *proto.CommandDel:
+		return &proto.ResponseDel{Status: status}
+	case *proto.CommandInvalidate:
+		return &proto.ResponseInvalidate{Status: status}
+	case *proto.CommandWatch:
+		return &proto.ResponseWatch{Status: status}
+	case *proto.CommandExec:
+		return &proto.ResponseExec{Status: status}
+	case *proto.CommandEval, *proto.CommandEvalSha:
+		return &proto.ResponseEval{Status: status}
+	case *proto.CommandScriptLoad:
+		return &proto.ResponseScriptLoad{Status: status}
+	case *proto.CommandPublish:
+		return &proto.ResponsePublish{Status: status}
+	case *proto.CommandNamespaceStats:
+		return &proto.ResponseNamespaceStats{Status: status}
+	case *proto.CommandMembers:
+		return &proto.ResponseMembers{Status: status}
+	case *proto.CommandACLList:
+		return &proto.ResponseACLList{Status: status}
+	case *proto.CommandSlowlog:
+		return &proto.ResponseSlowlog{Status: status}
+	case *proto.CommandJoin, *proto.CommandLeave, *proto.CommandRemove,
+		*proto.CommandPromote, *proto.CommandDemote, *proto.CommandTransfer:
+		return &proto.ResponseMembership{
+			Status:  status,
+			Message: []byte("unauthorized"),
+		}
+	case *proto.CommandChanges:
+		return &proto.Change{Type: proto.ChangeError, Value: []byte("unauthorized")}
+	}
+	return &proto.ResponseStatus{Status: status}
+}
+
+// handleACLCommand changes users on the leader, secrets are hashed before
+// they reach the log. Invalid changes are returned unanswered.
+func (s *Server) handleACLCommand(conn net.Conn, cmd any) error {
+	var entry *proto.CommandACLUser
+	switch v := cmd.(type) {
+	case *proto.CommandACLSetUser:
+		if len(v.Username) == 0 || len(v.Password) == 0 && len(v.Token) == 0 {
+			return fmt.Errorf("a user needs a name and a password or a token")
+		}
+		if !s.users.Enabled() && acl.Perm(v.Rule.Perms)&acl.PermAdmin == 0 {
+			// whoever connects may create the first user, it must be
+			// able to manage the others
+			return fmt.Errorf("the first user must have the admin permission")
+		}
+		entry = &proto.CommandACLUser{Username: v.Username, Rule: v.Rule}
+		if len(v.Password) > 0 {
+			salt, hash, err := acl.HashPassword(v.Password)
+			if err != nil {
+				return err
+			}
+			entry.Salt, entry.PasswordHash = salt, hash
+		}
+		if len(v.Token) > 0 {
+			entry.TokenHash = acl.HashToken(v.Token)
+		}
+	case *proto.CommandACLDelUser:
+		if _, ok := s.users.Get(string(v.Username)); !ok {
+			return fmt.Errorf("no such user %q", v.Username)
+		}
+		entry = &proto.CommandACLUser{Username: v.Username, Remove: true}
+	}
+	if err := s.handleStatusCommand(conn, entry); err != nil {
+		s.log(conn).Warnw("error while responding to client", "error", err)
+	}
+	return nil
+}
+
+func (s *Server) handleACLListCommand(conn net.Conn) error {
+	resp := &proto.ResponseACLList{Status: proto.StatusOK}
+	for _, u := range s.users.Users() {
+		resp.Users = append(resp.Users, proto.ACLUser{
+			Username: []byte(u.Name),
+			Rule: proto.ACLRule{
+				Perms:      byte(u.Perms),
+				Keys:       toBytes(u.Keys),
+				Namespaces: toBytes(u.Namespaces),
+			},
+		})
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+// authenticatePeer sends NodeToken on a connection to another node, for
+// clusters with ACLs where nodes are not recognized by their certificate.
+func (s *Server) authenticatePeer(conn net.Conn, timeout time.Duration) error {
+	if len(s.NodeToken) == 0 {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	cmd := &proto.CommandAuth{Password: s.NodeToken}
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		return err
+	}
+	resp, err := proto.ParseStatusResponse(conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != proto.StatusOK {
+		return fmt.Errorf("node authentication failed [%s]", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"y3cache/audit"
+	"y3cache/proto"
+)
+
+// replyConn remembers what a command was answered, every response starts
+// with its status, the raft index of what it committed and how long the
+// answer took to write.
+type replyConn struct {
+	net.Conn
+	status proto.Status
+	index  atomic.Uint64
+	logger *zap.SugaredLogger
+	// wrote is the time spent writing the response
+	wrote time.Duration
+	// applied is when the raft apply of the command returned
+	applied time.Time
+}
+
+func (c *replyConn) Write(p []byte) (int, error) {
+	if c.status == proto.StatusNone && len(p) > 0 {
+		c.status = proto.Status(p[0])
+	}
+	start := time.Now()
+	n, err := c.Conn.Write(p)
+	c.wrote += time.Since(start)
+	return n, err
+}
+
+// recordIndex tells the audit log and traces of conn the index a command
+// committed at, once its apply returned.
+func recordIndex(conn net.Conn, index uint64) {
+	if c, ok := conn.(*replyConn); ok {
+		c.index.Store(index)
+		c.applied = time.Now()
+	}
+}
+
+// describe returns the audit entry of cmd without its outcome, false for
+// the commands that are not audited.
+func (s *Server) describe(ns string, cmd any) (audit.Entry, bool) {
+	e := audit.Entry{Namespace: ns, Command: commandName(cmd)}
+	keys := func(keys ...[]byte) {
+		for _, k := range keys {
+			e.Keys = append(e.Keys, s.Audit.Key(k))
+		}
+	}
+	switch v := cmd.(type) {
+	case *proto.CommandSet:
+		e.Class = audit.ClassWrite
+		keys(v.Key)
+		e.Value = s.Audit.Value(v.Value)
+	case *proto.CommandDel:
+		e.Class = audit.ClassWrite
+		keys(v.Key)
+	case *proto.CommandInvalidate:
+		e.Class = audit.ClassWrite
+		e.Target = strings.Join(toStrings(v.Tags), ",")
+	case *proto.CommandExec:
+		e.Class = audit.ClassWrite
+		_, _, k := access(ns, v)
+		keys(k...)
+	case *proto.CommandEval:
+		e.Class = audit.ClassWrite
+		keys(v.Keys...)
+	case *proto.CommandEvalSha:
+		e.Class = audit.ClassWrite
+		keys(v.Keys...)
+	case *proto.CommandJoin:
+		e.Class, e.Target = audit.ClassMembership, string(v.NodeId)
+	case *proto.CommandLeave:
+		e.Class, e.Target = audit.ClassMembership, s.NodeID
+	case *proto.CommandRemove:
+		e.Class, e.Target = audit.ClassMembership, string(v.NodeId)
+	case *proto.CommandPromote:
+		e.Class, e.Target = audit.ClassMembership, string(v.NodeId)
+	case *proto.CommandDemote:
+		e.Class, e.Target = audit.ClassMembership, string(v.NodeId)
+	case *proto.CommandTransfer:
+		e.Class, e.Target = audit.ClassMembership, string(v.NodeId)
+	case *proto.CommandAuth:
+		e.Class, e.Target = audit.ClassACL, string(v.Username)
+	case *proto.CommandACLSetUser:
+		e.Class, e.Target = audit.ClassACL, string(v.Username)
+	case *proto.CommandACLDelUser:
+		e.Class, e.Target = audit.ClassACL, string(v.Username)
+	case *proto.CommandNamespaceConfig:
+		e.Class, e.Namespace = audit.ClassAdmin, namespaceOr(v.Namespace, ns)
+	case *proto.CommandFlush:
+		e.Class, e.Namespace = audit.ClassAdmin, namespaceOr(v.Namespace, ns)
+	default:
+		return e, false
+	}
+	if e.Class != audit.ClassWrite {
+		e.Keys = nil
+	}
+	return e, s.Audit.Enabled(e.Class)
+}
+
+// audit logs cmd once conn answered it, when cmd is audited.
+func (s *Server) audit(conn *replyConn, sess *session, ns string, cmd any) {
+	if s.Audit == nil {
+		return
+	}
+	e, ok := s.describe(ns, cmd)
+	if !ok {
+		return
+	}
+	e.Node = s.NodeID
+	e.Principal = sess.principal()
+	e.Remote = conn.RemoteAddr().String()
+	e.Status = conn.status.String()
+	e.Index = conn.index.Load()
+	if e.Index == 0 && e.Class == audit.ClassMembership && conn.status == proto.StatusOK {
+		// configuration changes have no apply future of their own
+		e.Index = s.raft.GetConfiguration().Index()
+	}
+	if err := s.Audit.Log(e); err != nil {
+		s.logger.Errorw("audit log failed", "command", e.Command, "error", err)
+	}
+}
+
+func (sess *session) principal() string {
+	if sess.user != "" {
+		return sess.user
+	}
+	if sess.identity != "" {
+		return fmt.Sprintf("cert:%s", sess.identity)
+	}
+	return ""
+}
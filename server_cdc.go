@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net"
+
+	"y3cache/proto"
+)
+
+// streamChanges takes over conn and writes every applied change from
+// cmd.FromIndex on until the client goes away.
+func (s *Server) streamChanges(conn net.Conn, cmd *proto.CommandChanges) {
+	stream, err := s.changes.Open(cmd.FromIndex)
+	if err != nil {
+		s.log(conn).Warnw("error opening change stream", "error", err)
+		c := &proto.Change{Type: proto.ChangeError, Value: []byte(err.Error())}
+		conn.Write(c.Bytes())
+		return
+	}
+	defer stream.Close()
+	// the client sends nothing else, reading only detects it going away
+	go func() {
+		io.Copy(io.Discard, conn)
+		stream.Close()
+	}()
+	for {
+		c, err := stream.Next()
+		if err != nil {
+			c = &proto.Change{Type: proto.ChangeError, Value: []byte(err.Error())}
+			conn.Write(c.Bytes())
+			return
+		}
+		if _, err := conn.Write(c.Bytes()); err != nil {
+			s.log(conn).Warnw("error writing change", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+)
+
+// Handler serves the metrics, health and status endpoints:
+//
+//	/metrics  the Prometheus metrics
+//	/healthz  200 while the process runs
+//	/readyz   200 once the node can take traffic, 503 with the reason
+//	/status   the node's view of the cluster in JSON
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := s.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		st, err := s.status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+	return mux
+}
+
+// ready tells why the node can't take traffic yet: its listener is not
+// accepting, there is no leader, or it lags the commit index by more than
+// ReadyMaxLag entries.
+func (s *Server) ready() error {
+	s.lock.Lock()
+	listening := s.ln != nil && !s.closing
+	s.lock.Unlock()
+	if !listening {
+		return fmt.Errorf("not accepting connections")
+	}
+	if _, id := s.raft.LeaderWithID(); id == "" {
+		return fmt.Errorf("no known leader")
+	}
+	stats := s.raft.Stats()
+	commit, applied := statUint(stats, "commit_index"), statUint(stats, "applied_index")
+	if commit > applied && commit-applied > s.ReadyMaxLag {
+		return fmt.Errorf("applied index %d lags commit index %d", applied, commit)
+	}
+	return nil
+}
+
+type nodeStatus struct {
+	NodeID       string       `json:"node_id"`
+	Role         string       `json:"role"`
+	State        string       `json:"state"`
+	Leader       string       `json:"leader"`
+	Term         uint64       `json:"term"`
+	CommitIndex  uint64       `json:"commit_index"`
+	AppliedIndex uint64       `json:"applied_index"`
+	LastContact  string       `json:"last_contact"`
+	Peers        []peerStatus `json:"peers"`
+	Snapshot     struct {
+		Index uint64 `json:"index"`
+		Term  uint64 `json:"term"`
+	} `json:"snapshot"`
+}
+
+type peerStatus struct {
+	NodeID        string `json:"node_id"`
+	RaftAddress   string `json:"raft_address"`
+	ClientAddress string `json:"client_address,omitempty"`
+	Suffrage      string `json:"suffrage"`
+	Leader        bool   `json:"leader"`
+}
+
+func (s *Server) status() (*nodeStatus, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, fmt.Errorf("failed to get raft conf %s", err.Error())
+	}
+	stats := s.raft.Stats()
+	_, leader := s.raft.LeaderWithID()
+	st := &nodeStatus{
+		NodeID:       s.NodeID,
+		State:        s.raft.State().String(),
+		Leader:       string(leader),
+		Term:         statUint(stats, "term"),
+		CommitIndex:  statUint(stats, "commit_index"),
+		AppliedIndex: statUint(stats, "applied_index"),
+		LastContact:  stats["last_contact"],
+	}
+	st.Snapshot.Index = statUint(stats, "last_snapshot_index")
+	st.Snapshot.Term = statUint(stats, "last_snapshot_term")
+	for _, srv := range configFuture.Configuration().Servers {
+		m, _ := s.cluster.Get(string(srv.ID))
+		st.Peers = append(st.Peers, peerStatus{
+			NodeID:        string(srv.ID),
+			RaftAddress:   string(srv.Address),
+			ClientAddress: m.ClientAddress,
+			Suffrage:      srv.Suffrage.String(),
+			Leader:        srv.ID == leader,
+		})
+		if srv.ID == raft.ServerID(s.NodeID) {
+			st.Role = "voter"
+			if srv.Suffrage != raft.Voter {
+				st.Role = "replica"
+			}
+		}
+	}
+	if st.Leader == s.NodeID {
+		st.Role = "leader"
+	}
+	return st, nil
+}
+
+// statUint reads a counter of raft.Stats, zero when it is missing.
+func statUint(stats map[string]string, key string) uint64 {
+	v, _ := strconv.ParseUint(stats[key], 10, 64)
+	return v
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"y3cache/join"
+	"y3cache/proto"
+	"y3cache/tlsutil"
+)
+
+const (
+	joinMinBackoff   = 200 * time.Millisecond
+	joinMaxBackoff   = 10 * time.Second
+	joinTimeout      = 10 * time.Second
+	joinMaxRedirects = 3
+)
+
+var errNotLeader = errors.New("not the leader")
+
+// joinCluster tries the seeds in turn until one of them, or the leader it
+// redirects to, confirms the join. Rounds are spaced by an exponential
+// backoff with jitter. It gives up when ctx is done.
+func (s *Server) joinCluster(ctx context.Context) {
+	backoff := joinMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.joinSeeds()
+		if err == nil {
+			s.logger.Infow("joined the cluster", "attempt", attempt)
+			return
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		s.logger.Warnw(
+			"join failed, retrying",
+			"attempt",
+			attempt,
+			"retry_in",
+			wait,
+			"error",
+			err,
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > joinMaxBackoff {
+			backoff = joinMaxBackoff
+		}
+	}
+}
+
+// joinSeeds makes one round over the seeds and returns the last error.
+func (s *Server) joinSeeds() error {
+	err := errors.New("no seeds")
+	for _, seed := range s.Seeds {
+		addr := seed
+		for i := 0; i <= joinMaxRedirects; i++ {
+			var leader string
+			leader, err = s.requestJoin(addr)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, errNotLeader) || leader == "" || leader == addr {
+				break
+			}
+			s.logger.Infow("seed is not the leader, redirected", "seed", addr, "leader", leader)
+			addr = leader
+		}
+	}
+	return err
+}
+
+// requestJoin sends a signed join to addr and waits for its answer. A
+// NOT_LEADER answer returns errNotLeader along with the leader's address
+// when addr knows it.
+func (s *Server) requestJoin(addr string) (string, error) {
+	conn, err := s.dialPeer(addr, joinTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to dial [%s]: %s", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(joinTimeout))
+	if s.Pending != nil {
+		// the node accepting the join replicates to us right after
+		id, err := tlsutil.Identity(conn)
+		if err != nil {
+			return "", err
+		}
+		if id != "" {
+			s.Pending.Add(raft.ServerID(id))
+		}
+	}
+	j := &proto.CommandJoin{
+		NodeId:        []byte(s.NodeID),
+		RaftAddress:   []byte(s.RaftAddress),
+		ClientAddress: []byte(s.clientAddress()),
+		Role:          s.Role,
+	}
+	if err := join.Sign(s.JoinSecret, j, time.Now()); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(j.Bytes()); err != nil {
+		return "", err
+	}
+	resp, err := proto.ParseMembershipResponse(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read join response from [%s]: %s", addr, err)
+	}
+	switch resp.Status {
+	case proto.StatusOK:
+		return "", nil
+	case proto.StatusNotLeader:
+		return string(resp.Message), fmt.Errorf("[%s]: %w", addr, errNotLeader)
+	}
+	return "", fmt.Errorf("join refused by [%s]: %s", addr, resp.Message)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+
+	"y3cache/logging"
+)
+
+// log is the logger of the command conn answers, with its conn_id and cmd,
+// or the server's for connections that are not running a command.
+func (s *Server) log(conn net.Conn) *zap.SugaredLogger {
+	if c, ok := conn.(*replyConn); ok && c.logger != nil {
+		return c.logger
+	}
+	return s.logger
+}
+
+// commandLogger names the command cmd and the key it touches when it
+// touches a single one, values are never logged.
+func commandLogger(l *zap.SugaredLogger, ns string, cmd any) *zap.SugaredLogger {
+	l = l.With(logging.FieldCmd, commandName(cmd))
+	if _, _, keys := access(ns, cmd); len(keys) == 1 {
+		l = l.With(logging.FieldKeyHash, logging.HashKey(keys[0]))
+	}
+	return l
+}
+
+func (s *Server) nextConnID() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connSeq++
+	return s.connSeq
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"y3cache/proto"
+)
+
+const (
+	memberInterval = time.Second
+	forwardTimeout = 10 * time.Second
+)
+
+// memberLoop makes the leader register its own client address, the other
+// nodes are registered by the leader accepting their join.
+func (s *Server) memberLoop(ctx context.Context) {
+	ticker := time.NewTicker(memberInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() != raft.Leader {
+			continue
+		}
+		if m, ok := s.cluster.Get(s.NodeID); ok && m.ClientAddress == s.clientAddress() {
+			continue
+		}
+		s.setMember([]byte(s.NodeID), []byte(s.clientAddress()))
+	}
+}
+
+// clientAddress is where the other nodes reach the client listener.
+func (s *Server) clientAddress() string {
+	if s.AdvertiseAddr != "" {
+		return s.AdvertiseAddr
+	}
+	return s.ListenAddr
+}
+
+func (s *Server) setMember(id, clientAddress []byte) {
+	cmd := &proto.CommandMember{NodeId: id, ClientAddress: clientAddress}
+	if err := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond).Error(); err != nil {
+		s.logger.Warnw("error registering member", "node", string(id), "error", err)
+	}
+}
+
+// handleMembershipCommand runs LEAVE, REMOVE, PROMOTE, DEMOTE and TRANSFER
+// on the leader, followers forward them.
+func (s *Server) handleMembershipCommand(conn net.Conn, cmd any) error {
+	if _, ok := cmd.(*proto.CommandLeave); ok {
+		// resolved here, the leader would remove itself otherwise
+		cmd = &proto.CommandRemove{NodeId: []byte(s.NodeID)}
+	}
+	var resp *proto.ResponseMembership
+	if s.raft.State() != raft.Leader {
+		resp = s.forwardToLeader(cmd.(interface{ Bytes() []byte }))
+	} else if err := s.leaderMembership(cmd); err != nil {
+		s.logger.Warnw("membership change failed", "error", err)
+		resp = &proto.ResponseMembership{
+			Status:  proto.StatusError,
+			Message: []byte(err.Error()),
+		}
+	} else {
+		resp = &proto.ResponseMembership{Status: proto.StatusOK}
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+func (s *Server) leaderMembership(cmd any) error {
+	switch v := cmd.(type) {
+	case *proto.CommandTransfer:
+		return s.transferLeadership(raft.ServerID(v.NodeId))
+	case *proto.CommandRemove:
+		if string(v.NodeId) != s.NodeID {
+			break
+		}
+		// a leaving leader hands over first, the new leader removes it
+		// without waiting for an election
+		if err := s.transferLeadership(""); err != nil {
+			return err
+		}
+		if resp := s.forwardToLeader(v); resp.Status != proto.StatusOK {
+			return fmt.Errorf("%s", resp.Message)
+		}
+		return nil
+	}
+	return s.changeMembership(cmd)
+}
+
+// transferLeadership hands leadership over to the voter id, or to the most
+// up to date voter when id is empty, and waits until the new leader can be
+// forwarded to.
+func (s *Server) transferLeadership(id raft.ServerID) error {
+	var f raft.Future
+	if id == "" {
+		f = s.raft.LeadershipTransfer()
+	} else {
+		configFuture := s.raft.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			return fmt.Errorf("failed to get raft conf %s", err.Error())
+		}
+		var addr raft.ServerAddress
+		for _, srv := range configFuture.Configuration().Servers {
+			if srv.ID == id && srv.Suffrage == raft.Voter {
+				addr = srv.Address
+			}
+		}
+		if addr == "" {
+			return fmt.Errorf("node %s is not a voter", id)
+		}
+		f = s.raft.LeadershipTransferToServer(id, addr)
+	}
+	if err := f.Error(); err != nil {
+		return fmt.Errorf("error transfer leadership: %s", err)
+	}
+	deadline := time.Now().Add(forwardTimeout)
+	for time.Now().Before(deadline) {
+		// the new leader is only reachable once it registered its
+		// client address
+		_, leader := s.raft.LeaderWithID()
+		if _, ok := s.cluster.Get(string(leader)); ok && string(leader) != s.NodeID {
+			s.logger.Infow("leadership transferred", "to", string(leader))
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("no new leader after transferring leadership")
+}
+
+func (s *Server) changeMembership(cmd any) error {
+	var id raft.ServerID
+	switch v := cmd.(type) {
+	case *proto.CommandRemove:
+		id = raft.ServerID(v.NodeId)
+	case *proto.CommandPromote:
+		id = raft.ServerID(v.NodeId)
+	case *proto.CommandDemote:
+		id = raft.ServerID(v.NodeId)
+	}
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return fmt.Errorf("failed to get raft conf %s", err.Error())
+	}
+	var member *raft.Server
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == id {
+			srv := srv
+			member = &srv
+		}
+	}
+	if member == nil {
+		return fmt.Errorf("node %s is not a member", id)
+	}
+
+	switch cmd.(type) {
+	case *proto.CommandRemove:
+		if err := s.raft.RemoveServer(id, 0, 0).Error(); err != nil {
+			return fmt.Errorf("error remove server: %s", err)
+		}
+		s.removeMember(id)
+		s.logger.Infow("node removed", "node", string(id))
+	case *proto.CommandPromote:
+		if member.Suffrage == raft.Voter {
+			return fmt.Errorf("node %s is already a voter", id)
+		}
+		if err := s.raft.AddVoter(id, member.Address, 0, 0).Error(); err != nil {
+			return fmt.Errorf("error promote nonvoter: %s", err)
+		}
+		s.logger.Infow("node promoted", "node", string(id))
+	case *proto.CommandDemote:
+		if member.Suffrage != raft.Voter {
+			return fmt.Errorf("node %s is not a voter", id)
+		}
+		if err := s.raft.DemoteVoter(id, 0, 0).Error(); err != nil {
+			return fmt.Errorf("error demote voter: %s", err)
+		}
+		s.logger.Infow("node demoted", "node", string(id))
+	}
+	return nil
+}
+
+func (s *Server) removeMember(id raft.ServerID) {
+	cmd := &proto.CommandMember{NodeId: []byte(id), Remove: true}
+	if err := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond).Error(); err != nil {
+		s.logger.Warnw("error unregistering member", "node", string(id), "error", err)
+	}
+}
+
+// forwardToLeader sends cmd to the leader's client address and returns its
+// answer.
+func (s *Server) forwardToLeader(cmd interface{ Bytes() []byte }) *proto.ResponseMembership {
+	fail := func(format string, args ...any) *proto.ResponseMembership {
+		return &proto.ResponseMembership{
+			Status:  proto.StatusError,
+			Message: []byte(fmt.Sprintf(format, args...)),
+		}
+	}
+	_, id := s.raft.LeaderWithID()
+	m, ok := s.cluster.Get(string(id))
+	if id == "" || !ok {
+		return fail("no known leader to forward to")
+	}
+	conn, err := s.dialPeer(m.ClientAddress, forwardTimeout)
+	if err != nil {
+		return fail("failed to dial leader [%s]", m.ClientAddress)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		return fail("failed to forward to leader: %s", err)
+	}
+	resp, err := proto.ParseMembershipResponse(conn)
+	if err != nil {
+		return fail("failed to read leader response: %s", err)
+	}
+	return resp
+}
+
+// handleMembersCommand answers from the local raft configuration.
+func (s *Server) handleMembersCommand(conn net.Conn) error {
+	resp := &proto.ResponseMembers{Status: proto.StatusOK}
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		resp.Status = proto.StatusError
+	} else {
+		_, leader := s.raft.LeaderWithID()
+		for _, srv := range configFuture.Configuration().Servers {
+			m, _ := s.cluster.Get(string(srv.ID))
+			resp.Members = append(resp.Members, proto.Member{
+				NodeId:        []byte(srv.ID),
+				RaftAddress:   []byte(srv.Address),
+				ClientAddress: []byte(m.ClientAddress),
+				Voter:         srv.Suffrage == raft.Voter,
+				Leader:        srv.ID == leader,
+			})
+		}
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
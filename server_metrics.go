@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"y3cache/cache"
+	"y3cache/metrics"
+	"y3cache/proto"
+	"y3cache/slowlog"
+)
+
+// serverMetrics are updated as commands run, the gauges are read from the
+// server on every scrape, see collect.
+type serverMetrics struct {
+	commands *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	spans    *metrics.HistogramVec
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	m := &serverMetrics{
+		commands: metrics.NewCounterVec(
+			"y3cache_commands_total",
+			"Commands run, by command and answered status.",
+			"command", "status",
+		),
+		latency: metrics.NewHistogramVec(
+			"y3cache_command_duration_seconds",
+			"Time to run and answer a command, by command and answered status.",
+			metrics.DefaultBuckets,
+			"command", "status",
+		),
+		spans: metrics.NewHistogramVec(
+			"y3cache_command_span_seconds",
+			"Time commands spent parsing, queued, in raft, in the FSM, running locally and writing.",
+			metrics.DefaultBuckets,
+			"command", "span",
+		),
+	}
+	r.Register(m.commands)
+	r.Register(m.latency)
+	r.Register(m.spans)
+	return m
+}
+
+// run handles cmd, then measures, logs and audits it by what it was
+// answered. Commands over the slowlog threshold are recorded.
+func (s *Server) run(conn net.Conn, sess *session, ns string, cmd any, parsed received, handle func(net.Conn)) {
+	start := time.Now()
+	rc := &replyConn{Conn: conn, logger: commandLogger(sess.logger, ns, cmd)}
+	if parsed.parent.IsValid() {
+		rc.logger = rc.logger.With("trace_id", parsed.parent.TraceIDHex())
+	}
+	handle(rc)
+	done := time.Now()
+	name, status, took := commandName(cmd), rc.status.String(), done.Sub(start)
+	s.metrics.commands.Inc(name, status)
+	s.metrics.latency.Observe(took.Seconds(), name, status)
+	sp := s.spans(parsed, start, done, rc)
+	for _, span := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"parse", sp.Parse}, {"queue", sp.Queue}, {"raft", sp.Raft},
+		{"fsm", sp.FSM}, {"exec", sp.Exec}, {"write", sp.Write},
+	} {
+		s.metrics.spans.Observe(span.d.Seconds(), name, span.name)
+	}
+	rc.logger.Debugw("command handled", "status", status, "duration", took)
+	e := slowlog.Entry{
+		Time:      parsed.end,
+		Command:   name,
+		Namespace: ns,
+		Remote:    conn.RemoteAddr().String(),
+		Spans:     sp,
+	}
+	if s.Slowlog != nil && s.Slowlog.Record(e) {
+		rc.logger.Warnw(
+			"slow command",
+			"status",
+			status,
+			"duration",
+			sp.Total(),
+			"parse",
+			sp.Parse,
+			"queue",
+			sp.Queue,
+			"raft",
+			sp.Raft,
+			"fsm",
+			sp.FSM,
+			"exec",
+			sp.Exec,
+			"write",
+			sp.Write,
+		)
+	}
+	s.exportSpans(parsed.parent, ns, cmd, rc, start, done)
+	s.audit(rc, sess, ns, cmd)
+}
+
+// collect writes the gauges read from the server.
+func (s *Server) collect(w *metrics.Writer) {
+	s.lock.Lock()
+	conns := len(s.conns)
+	s.lock.Unlock()
+	w.Gauge("y3cache_connections", "Open client connections.", float64(conns))
+
+	// the samples of a family go together, so namespaces are read first
+	var (
+		labels []metrics.Label
+		stats  []cache.Stats
+	)
+	for _, name := range s.spaces.Names() {
+		if c, ok := s.spaces.Get(name); ok {
+			labels = append(labels, metrics.Label{Name: "namespace", Value: name})
+			stats = append(stats, c.Stats())
+		}
+	}
+	for i, st := range stats {
+		w.Gauge("y3cache_keys", "Keys in the namespace.", float64(st.Keys), labels[i])
+	}
+	for i, st := range stats {
+		w.Gauge("y3cache_bytes", "Bytes of keys and values in the namespace.", float64(st.Bytes), labels[i])
+	}
+	for i, st := range stats {
+		w.Counter("y3cache_evictions_total", "Keys evicted to make room.", float64(st.Evictions), labels[i])
+	}
+	for i, st := range stats {
+		w.Counter("y3cache_expirations_total", "Keys expired by their TTL.", float64(st.Expirations), labels[i])
+	}
+
+	state := s.raft.State()
+	for _, st := range []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown} {
+		v := 0.
+		if st == state {
+			v = 1
+		}
+		w.Gauge("y3cache_raft_state", "Raft state of the node, 1 for the current one.", v,
+			metrics.Label{Name: "state", Value: st.String()})
+	}
+	raftStats := s.raft.Stats()
+	for _, g := range []struct{ key, name, help string }{
+		{"term", "y3cache_raft_term", "Current raft term."},
+		{"commit_index", "y3cache_raft_commit_index", "Index of the last committed entry."},
+		{"applied_index", "y3cache_raft_applied_index", "Index of the last entry applied to the cache."},
+	} {
+		if _, ok := raftStats[g.key]; ok {
+			w.Gauge(g.name, g.help, float64(statUint(raftStats, g.key)))
+		}
+	}
+	// "0" on the leader, "never" before the first contact
+	if d, err := time.ParseDuration(raftStats["last_contact"]); err == nil {
+		w.Gauge("y3cache_raft_last_contact_seconds", "Time since the leader was last heard from.", d.Seconds())
+	} else if raftStats["last_contact"] == "0" {
+		w.Gauge("y3cache_raft_last_contact_seconds", "Time since the leader was last heard from.", 0)
+	}
+}
+
+// commandName is how cmd is named in metrics and the audit log.
+func commandName(cmd any) string {
+	switch cmd.(type) {
+	case *proto.CommandSet:
+		return "SET"
+	case *proto.CommandGet:
+		return "GET"
+	case *proto.CommandDel:
+		return "DEL"
+	case *proto.CommandJoin:
+		return "JOIN"
+	case *proto.CommandExpire:
+		return "EXPIRE"
+	case *proto.CommandSubscribe:
+		return "SUBSCRIBE"
+	case *proto.CommandPSubscribe:
+		return "PSUBSCRIBE"
+	case *proto.CommandUnsubscribe:
+		return "UNSUBSCRIBE"
+	case *proto.CommandPUnsubscribe:
+		return "PUNSUBSCRIBE"
+	case *proto.CommandPublish:
+		return "PUBLISH"
+	case *proto.CommandChanges:
+		return "CHANGES"
+	case *proto.CommandWatch:
+		return "WATCH"
+	case *proto.CommandExec:
+		return "EXEC"
+	case *proto.CommandEval:
+		return "EVAL"
+	case *proto.CommandEvalSha:
+		return "EVALSHA"
+	case *proto.CommandScriptLoad:
+		return "SCRIPTLOAD"
+	case *proto.CommandSelect:
+		return "SELECT"
+	case *proto.CommandNamespaceConfig:
+		return "NSCONFIG"
+	case *proto.CommandFlush:
+		return "FLUSH"
+	case *proto.CommandNamespaceStats:
+		return "NSSTATS"
+	case *proto.CommandInvalidate:
+		return "INVALIDATE"
+	case *proto.CommandLeave:
+		return "LEAVE"
+	case *proto.CommandRemove:
+		return "REMOVE"
+	case *proto.CommandDemote:
+		return "DEMOTE"
+	case *proto.CommandMember:
+		return "MEMBER"
+	case *proto.CommandMembers:
+		return "MEMBERS"
+	case *proto.CommandPromote:
+		return "PROMOTE"
+	case *proto.CommandTransfer:
+		return "TRANSFER"
+	case *proto.CommandAuth:
+		return "AUTH"
+	case *proto.CommandACLSetUser:
+		return "ACLSETUSER"
+	case *proto.CommandACLDelUser:
+		return "ACLDELUSER"
+	case *proto.CommandACLList:
+		return "ACLLIST"
+	case *proto.CommandACLUser:
+		return "ACLUSER"
+	case *proto.CommandSlowlog:
+		return "SLOWLOG"
+	}
+	return "UNKNOWN"
+}
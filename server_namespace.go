@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"y3cache/proto"
+)
+
+// handleStatusCommand applies the namespace admin commands, they name their
+// namespace themselves so they are never wrapped.
+func (s *Server) handleStatusCommand(conn net.Conn, cmd interface{ Bytes() []byte }) error {
+	applyFuture := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond)
+	resp := &proto.ResponseStatus{Status: proto.StatusError}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error applying namespace command", "error", err)
+	} else if r, ok := applyFuture.Response().(*proto.ResponseStatus); ok {
+		recordIndex(conn, applyFuture.Index())
+		resp = r
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+// handleNamespaceStatsCommand answers from the local node, followers may
+// lag behind the leader.
+func (s *Server) handleNamespaceStatsCommand(conn net.Conn, cmd *proto.CommandNamespaceStats) error {
+	names := toStrings(cmd.Namespaces)
+	if len(names) == 0 {
+		names = s.spaces.Names()
+	}
+	resp := &proto.ResponseNamespaceStats{Status: proto.StatusOK}
+	for _, name := range names {
+		c, ok := s.spaces.Get(name)
+		if !ok {
+			continue
+		}
+		st, limits := c.Stats(), c.Limits()
+		resp.Stats = append(resp.Stats, proto.NamespaceStats{
+			Namespace:   []byte(name),
+			Keys:        st.Keys,
+			Bytes:       st.Bytes,
+			Evictions:   st.Evictions,
+			Expirations: st.Expirations,
+			MaxMemory:   limits.MaxMemory,
+			MaxKeys:     limits.MaxKeys,
+			DefaultTTL:  int32(limits.DefaultTTL / time.Second),
+			Policy:      byte(limits.Policy),
+		})
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"y3cache/proto"
+	"y3cache/pubsub"
+)
+
+func isSubscriptionCommand(cmd any) bool {
+	switch cmd.(type) {
+	case *proto.CommandSubscribe, *proto.CommandPSubscribe,
+		*proto.CommandUnsubscribe, *proto.CommandPUnsubscribe:
+		return true
+	}
+	return false
+}
+
+// handleSubscriptionCommand runs on the connection's read loop so that the
+// subscription state changes in the order the client sent them.
+func (s *Server) handleSubscriptionCommand(
+	conn net.Conn,
+	sub *pubsub.Subscriber,
+	cmd any,
+) {
+	var (
+		kind  proto.MessageKind
+		names []string
+	)
+	switch v := cmd.(type) {
+	case *proto.CommandSubscribe:
+		kind, names = proto.MessageSubscribe, toStrings(v.Channels)
+		sub.Subscribe(names...)
+	case *proto.CommandPSubscribe:
+		kind, names = proto.MessagePSubscribe, toStrings(v.Patterns)
+		sub.PSubscribe(names...)
+	case *proto.CommandUnsubscribe:
+		kind, names = proto.MessageUnsubscribe, sub.Unsubscribe(toStrings(v.Channels)...)
+	case *proto.CommandPUnsubscribe:
+		kind, names = proto.MessagePUnsubscribe, sub.PUnsubscribe(toStrings(v.Patterns)...)
+	}
+	count := int32(sub.Count())
+	for _, name := range names {
+		m := &proto.Message{Kind: kind, Channel: []byte(name), Count: count}
+		if _, err := conn.Write(m.Bytes()); err != nil {
+			s.log(conn).Warnw("error while acknowledging subscription", "error", err)
+			return
+		}
+	}
+}
+
+// forwardMessages writes everything published to sub to conn until sub is
+// closed.
+func (s *Server) forwardMessages(conn net.Conn, sub *pubsub.Subscriber) {
+	for msg := range sub.C {
+		m := &proto.Message{
+			Kind:    proto.MessagePublished,
+			Pattern: []byte(msg.Pattern),
+			Channel: []byte(msg.Channel),
+			Payload: msg.Payload,
+		}
+		if _, err := conn.Write(m.Bytes()); err != nil {
+			s.log(conn).Warnw("error while forwarding message", "error", err)
+			sub.Close()
+			return
+		}
+	}
+}
+
+func (s *Server) handlePublishCommand(conn net.Conn, cmd *proto.CommandPublish) error {
+	applyFuture := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond)
+	resp := &proto.ResponsePublish{Status: proto.StatusOK}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error publishing", "error", err)
+		resp.Status = proto.StatusError
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+func toBytes(list []string) [][]byte {
+	out := make([][]byte, len(list))
+	for i, s := range list {
+		out[i] = []byte(s)
+	}
+	return out
+}
+
+func toStrings(list [][]byte) []string {
+	out := make([]string, len(list))
+	for i, b := range list {
+		out[i] = string(b)
+	}
+	return out
+}
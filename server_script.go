@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"y3cache/proto"
+	"y3cache/script"
+)
+
+// handleEvalCommand applies both EVAL and EVALSHA, the script runs inside
+// the FSM on every replica. A script that does not compile is refused
+// before it reaches the log.
+func (s *Server) handleEvalCommand(conn net.Conn, ns string, cmd interface{ Bytes() []byte }) error {
+	if eval, ok := cmd.(*proto.CommandEval); ok {
+		if _, err := script.Compile(string(eval.Script)); err != nil {
+			s.log(conn).Debugw("refusing script", "error", err)
+			resp := &proto.ResponseEval{
+				Status: proto.StatusError,
+				Values: [][]byte{[]byte(err.Error())},
+			}
+			_, err := conn.Write(resp.Bytes())
+			return err
+		}
+	}
+	applyFuture := s.apply(ns, cmd)
+	resp := &proto.ResponseEval{Status: proto.StatusError}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error applying script", "error", err)
+	} else if r, ok := applyFuture.Response().(*proto.ResponseEval); ok {
+		recordIndex(conn, applyFuture.Index())
+		resp = r
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+func (s *Server) handleScriptLoadCommand(conn net.Conn, cmd *proto.CommandScriptLoad) error {
+	if _, err := script.Compile(string(cmd.Script)); err != nil {
+		s.log(conn).Debugw("refusing script", "error", err)
+		resp := &proto.ResponseScriptLoad{Status: proto.StatusError}
+		_, err := conn.Write(resp.Bytes())
+		return err
+	}
+	applyFuture := s.raft.Apply(cmd.Bytes(), 500*time.Millisecond)
+	resp := &proto.ResponseScriptLoad{Status: proto.StatusError}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error loading script", "error", err)
+	} else if r, ok := applyFuture.Response().(*proto.ResponseScriptLoad); ok {
+		resp = r
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
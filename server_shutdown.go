@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var errServerClosed = errors.New("server closed")
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// track counts conn as open, false when it must be closed right away.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		s.logger.Warnw(
+			"too many connections, closing",
+			"remote",
+			conn.RemoteAddr().String(),
+			"max",
+			s.MaxConns,
+		)
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// startCommand counts a command as in-flight, it refuses new ones once
+// Shutdown started.
+func (s *Server) startCommand() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// Shutdown stops accepting connections and commands, waits for the
+// in-flight commands until ctx is done, closes the connections, hands
+// leadership over when TransferOnShutdown is set, takes a final snapshot
+// and shuts raft down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return errServerClosed
+	}
+	s.closing = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		// unblocks the read loops, a connection is closed once its
+		// in-flight commands replied
+		conn.SetReadDeadline(time.Now())
+	}
+	s.lock.Unlock()
+	s.logger.Infow("shutting down", "node", s.NodeID)
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+	var drainErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		drainErr = fmt.Errorf("in-flight commands were cut off: %w", ctx.Err())
+	}
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	if s.TransferOnShutdown && s.raft.State() == raft.Leader {
+		if err := s.transferLeadership(""); err != nil {
+			s.logger.Warnw("leadership transfer failed", "error", err)
+		}
+	}
+	err := s.raft.Snapshot().Error()
+	if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		s.logger.Warnw("final snapshot failed", "error", err)
+	}
+	if err := s.raft.Shutdown().Error(); err != nil {
+		return fmt.Errorf("raft shutdown: %s", err)
+	}
+	s.logger.Infow("shut down", "node", s.NodeID)
+	return drainErr
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"y3cache/proto"
+	"y3cache/slowlog"
+	"y3cache/trace"
+)
+
+// readTimer remembers when the first byte of a command arrived, parsing
+// is timed from there rather than from when the connection went idle.
+type readTimer struct {
+	io.Reader
+	first time.Time
+}
+
+func (r *readTimer) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.first.IsZero() {
+		r.first = time.Now()
+	}
+	return n, err
+}
+
+// received is when a command started arriving and when it was parsed,
+// and the span of its caller when it was traced.
+type received struct {
+	start  time.Time
+	end    time.Time
+	parent trace.SpanContext
+}
+
+// spans splits the time of a command handled from started to done. The
+// handler time left once writes and the FSM are taken out is raft's for
+// replicated commands, local work for the others.
+func (s *Server) spans(parsed received, started, done time.Time, conn *replyConn) slowlog.Spans {
+	sp := slowlog.Spans{
+		Parse: parsed.end.Sub(parsed.start),
+		Queue: started.Sub(parsed.end),
+		Write: conn.wrote,
+	}
+	if parsed.start.IsZero() {
+		sp.Parse = 0
+	}
+	rest := done.Sub(started) - conn.wrote
+	if index := conn.index.Load(); index != 0 {
+		if _, took, ok := s.ApplyTimings.Get(index); ok && took < rest {
+			sp.FSM = took
+		}
+		sp.Raft = rest - sp.FSM
+	} else {
+		sp.Exec = rest
+	}
+	if sp.Raft < 0 {
+		sp.Raft = 0
+	}
+	if sp.Exec < 0 {
+		sp.Exec = 0
+	}
+	return sp
+}
+
+// handleSlowlogCommand answers from the local node, every node keeps the
+// slow commands it handled.
+func (s *Server) handleSlowlogCommand(conn net.Conn, cmd *proto.CommandSlowlog) error {
+	resp := &proto.ResponseSlowlog{Status: proto.StatusOK}
+	switch {
+	case s.Slowlog == nil:
+	case cmd.Reset:
+		s.Slowlog.Reset()
+	default:
+		for _, e := range s.Slowlog.Entries(int(cmd.Count)) {
+			resp.Entries = append(resp.Entries, proto.SlowlogEntry{
+				ID:        e.ID,
+				Time:      e.Time.UnixNano(),
+				Command:   []byte(e.Command),
+				Namespace: []byte(e.Namespace),
+				Remote:    []byte(e.Remote),
+				Parse:     int64(e.Spans.Parse),
+				Queue:     int64(e.Spans.Queue),
+				Raft:      int64(e.Spans.Raft),
+				FSM:       int64(e.Spans.FSM),
+				Exec:      int64(e.Spans.Exec),
+				Write:     int64(e.Spans.Write),
+			})
+		}
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
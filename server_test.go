@@ -0,0 +1,926 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"y3cache/acl"
+	"y3cache/audit"
+	"y3cache/cache"
+	"y3cache/cdc"
+	"y3cache/client"
+	"y3cache/cluster"
+	"y3cache/fsm"
+	"y3cache/join"
+	"y3cache/logging"
+	"y3cache/proto"
+	"y3cache/pubsub"
+	"y3cache/slowlog"
+	"y3cache/tlsutil"
+	"y3cache/trace"
+)
+
+const testJoinSecret = "test-secret"
+
+type testNode struct {
+	id        string
+	addr      raft.ServerAddress
+	transport *raft.InmemTransport
+	raft      *raft.Raft
+	snapshots *raft.InmemSnapshotStore
+	server    *Server
+	// hook is called by the FSM on every event when set before start
+	hook fsm.Hook
+}
+
+// newTestCluster starts n servers over an in-memory raft transport, every
+// node serving clients on a local port.
+func newTestCluster(t *testing.T, n int) []*testNode {
+	nodes := make([]*testNode, n)
+	configuration := raft.Configuration{}
+	for i := range nodes {
+		nodes[i] = newTestNode(fmt.Sprintf("node%d", i+1), nodes[:i])
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(nodes[i].id),
+			Address: nodes[i].addr,
+		})
+	}
+	for _, node := range nodes {
+		startTestNode(t, node, &configuration, ServerOpts{IsLeader: true})
+	}
+	return nodes
+}
+
+// newTestNode creates the transport of a node and connects it to peers.
+func newTestNode(id string, peers []*testNode) *testNode {
+	n := &testNode{id: id}
+	n.addr, n.transport = raft.NewInmemTransport("")
+	for _, p := range peers {
+		p.transport.Connect(n.addr, n.transport)
+		n.transport.Connect(p.addr, p.transport)
+	}
+	return n
+}
+
+// startTestNode starts raft and the server of n, bootstrapping the
+// configuration when given one.
+func startTestNode(t *testing.T, n *testNode, bootstrap *raft.Configuration, opts ServerOpts) {
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.id)
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = io.Discard
+
+	store := raft.NewInmemStore()
+	spaces, members, users := cache.NewNamespaces(), cluster.NewMembers(), acl.NewStore()
+	changes := cdc.NewHub(store, spaces)
+	n.snapshots = raft.NewInmemSnapshotStore()
+	broker := pubsub.NewBroker()
+	hooks := []fsm.Hook{broker.Notify, changes.Notify}
+	if n.hook != nil {
+		hooks = append(hooks, n.hook)
+	}
+	f := fsm.NewY3CacheFSM(spaces, members, users, nil, hooks...)
+	if opts.ApplyTimings != nil {
+		f = fsm.Timed(f, opts.ApplyTimings)
+	}
+	r, err := raft.NewRaft(
+		conf,
+		f,
+		store,
+		store,
+		n.snapshots,
+		n.transport,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bootstrap != nil {
+		if err := r.BootstrapCluster(*bootstrap).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.NodeID = n.id
+	opts.RaftAddress = string(n.addr)
+	opts.ListenAddr = ln.Addr().String()
+	if opts.AdvertiseAddr != "" {
+		// tests advertise a host, on the port the listener got
+		_, port, _ := net.SplitHostPort(opts.ListenAddr)
+		opts.AdvertiseAddr = net.JoinHostPort(opts.AdvertiseAddr, port)
+	}
+	opts.JoinSecret = []byte(testJoinSecret)
+	s := NewServer(opts, spaces, members, users, r, broker, changes)
+	n.raft, n.server = r, s
+	go s.Serve(context.Background(), ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+}
+
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	var leader *testNode
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.raft.State() == raft.Leader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func dialNode(t *testing.T, n *testNode) *client.Client {
+	c, err := client.New(n.server.ListenAddr, client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestShrinkCluster(t *testing.T) {
+	ctx := context.Background()
+	nodes := newTestCluster(t, 5)
+	leader := waitLeader(t, nodes)
+	var followers []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+	// followers forward to the address the leader registers
+	assert.Eventually(t, func() bool {
+		_, ok := followers[0].server.cluster.Get(leader.id)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c := dialNode(t, followers[0])
+	assert.NotNil(t, c.RemoveNode(ctx, "nope"))
+
+	demoted, removed := followers[1], followers[2]
+	assert.Nil(t, c.DemoteNode(ctx, demoted.id))
+	assert.Nil(t, dialNode(t, demoted).Leave(ctx))
+	assert.Nil(t, c.RemoveNode(ctx, removed.id))
+
+	assert.Eventually(t, func() bool {
+		members, err := c.Members(ctx)
+		if err != nil || len(members) != 3 {
+			return false
+		}
+		for _, m := range members {
+			if !m.Voter || string(m.NodeId) == demoted.id || string(m.NodeId) == removed.id {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the remaining three still commit writes
+	assert.Nil(t, dialNode(t, leader).Set(ctx, []byte("k"), []byte("v")))
+}
+
+func suffrage(t *testing.T, n *testNode, id string) raft.ServerSuffrage {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.ID) == id {
+			return srv.Suffrage
+		}
+	}
+	return -1
+}
+
+func TestReadReplica(t *testing.T) {
+	ctx := context.Background()
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+
+	replica := newTestNode("replica", nodes)
+	startTestNode(t, replica, nil, ServerOpts{
+		Role:  proto.RoleReplica,
+		Seeds: []string{leader.server.ListenAddr},
+	})
+	assert.Eventually(t, func() bool {
+		return suffrage(t, leader, replica.id) == raft.Nonvoter
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, dialNode(t, leader).Set(ctx, []byte("k"), []byte("v")))
+	c := dialNode(t, replica)
+	assert.Eventually(t, func() bool {
+		v, err := c.Get(ctx, []byte("k"))
+		return err == nil && string(v) == "v"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the replica forwards its own promotion to the leader
+	assert.Eventually(t, func() bool {
+		_, ok := replica.server.cluster.Get(leader.id)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, c.PromoteNode(ctx, replica.id))
+	assert.Equal(t, raft.Voter, suffrage(t, leader, replica.id))
+	assert.NotNil(t, c.PromoteNode(ctx, replica.id))
+	assert.Nil(t, c.DemoteNode(ctx, replica.id))
+	assert.Equal(t, raft.Nonvoter, suffrage(t, leader, replica.id))
+}
+
+func TestJoinRetry(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	// the follower redirects to the address the leader registers
+	assert.Eventually(t, func() bool {
+		_, ok := follower.server.cluster.Get(leader.id)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	late := newTestNode("late", nodes)
+	startTestNode(t, late, nil, ServerOpts{
+		Role:  proto.RoleReplica,
+		Seeds: []string{dead.Addr().String(), follower.server.ListenAddr},
+	})
+	assert.Eventually(t, func() bool {
+		return suffrage(t, leader, late.id) == raft.Nonvoter
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// joining again with the same address changes nothing
+	_, err = late.server.requestJoin(leader.server.ListenAddr)
+	assert.Nil(t, err)
+	assert.Len(t, leader.raft.GetConfiguration().Configuration().Servers, 4)
+
+	// coming back with another address replaces the old one
+	conn, err := net.Dial("tcp", leader.server.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	j := &proto.CommandJoin{
+		NodeId:        []byte(late.id),
+		RaftAddress:   []byte("moved"),
+		ClientAddress: []byte(late.server.ListenAddr),
+	}
+	assert.Nil(t, join.Sign([]byte(testJoinSecret), j, time.Now()))
+	conn.Write(j.Bytes())
+	resp, err := proto.ParseMembershipResponse(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, proto.StatusOK, resp.Status)
+	servers := leader.raft.GetConfiguration().Configuration().Servers
+	assert.Len(t, servers, 4)
+	for _, srv := range servers {
+		if string(srv.ID) == late.id {
+			assert.Equal(t, raft.ServerAddress("moved"), srv.Address)
+			assert.Equal(t, raft.Nonvoter, srv.Suffrage)
+		}
+	}
+}
+
+func TestLeadershipTransfer(t *testing.T) {
+	ctx := context.Background()
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	var followers []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		_, ok := followers[0].server.cluster.Get(leader.id)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// forwarded by a follower, to a given node
+	assert.Nil(t, dialNode(t, followers[0]).TransferLeadership(ctx, followers[1].id))
+	assert.Equal(t, raft.Leader, followers[1].raft.State())
+
+	// a leaving leader hands over before it is removed
+	leader = followers[1]
+	assert.Nil(t, dialNode(t, leader).Leave(ctx))
+	assert.NotEqual(t, raft.Leader, leader.raft.State())
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n != leader && n.raft.State() == raft.Leader {
+				return suffrage(t, n, leader.id) == -1
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	c := dialNode(t, leader)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+
+	leader.server.TransferOnShutdown = true
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// Shutdown only returns nil once raft shut down
+	assert.Nil(t, leader.server.Shutdown(shutdownCtx))
+	assert.Equal(t, errServerClosed, leader.server.Shutdown(shutdownCtx))
+
+	snapshots, err := leader.snapshots.List()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 1)
+	// the connection was closed and leadership already moved on
+	_, err = c.Get(ctx, []byte("k"))
+	assert.NotNil(t, err)
+	var leaders int
+	for _, n := range nodes {
+		if n != leader && n.raft.State() == raft.Leader {
+			leaders++
+		}
+	}
+	assert.Equal(t, 1, leaders)
+}
+
+func TestShutdownInflight(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode("node1", nil)
+	applying, release := make(chan struct{}), make(chan struct{})
+	n.hook = func(ev fsm.Event) {
+		if ev.Type == fsm.EventSet && string(ev.Key) == "slow" {
+			close(applying)
+			<-release
+		}
+	}
+	startTestNode(t, n, &raft.Configuration{Servers: []raft.Server{{
+		ID:      raft.ServerID(n.id),
+		Address: n.addr,
+	}}}, ServerOpts{IsLeader: true})
+	leader := waitLeader(t, []*testNode{n})
+	c := dialNode(t, leader)
+
+	set := make(chan error)
+	go func() { set <- c.Set(ctx, []byte("slow"), []byte("v")) }()
+	<-applying
+	shutdown := make(chan error)
+	go func() { shutdown <- leader.server.Shutdown(ctx) }()
+	assert.Eventually(t, leader.server.isClosing, 5*time.Second, time.Millisecond)
+	// the SET applies and replies although the read loop stopped
+	close(release)
+	assert.Nil(t, <-set)
+	assert.Nil(t, <-shutdown)
+}
+
+func TestTLS(t *testing.T) {
+	ctx := context.Background()
+	ca, err := tlsutil.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(name string) tls.Certificate {
+		cert, err := ca.Issue(name, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	opts := func(id string) ServerOpts {
+		cert := issue(id)
+		return ServerOpts{
+			TLS: tlsutil.ServerConfig(cert, ca.Pool(), true),
+			PeerTLS: &tls.Config{
+				RootCAs:      ca.Pool(),
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+	leader := newTestNode("node1", nil)
+	o := opts(leader.id)
+	o.IsLeader = true
+	startTestNode(t, leader, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(leader.id), Address: leader.addr},
+	}}, o)
+	waitLeader(t, []*testNode{leader})
+
+	app := issue("app")
+	c, err := client.New(leader.server.ListenAddr, client.Options{TLS: &tls.Config{
+		RootCAs:      ca.Pool(),
+		Certificates: []tls.Certificate{app},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+
+	// no client certificate, no service
+	anon, err := client.New(leader.server.ListenAddr, client.Options{TLS: &tls.Config{
+		RootCAs: ca.Pool(),
+	}})
+	if err == nil {
+		defer anon.Close()
+		_, err = anon.Get(ctx, []byte("k"))
+	}
+	assert.NotNil(t, err)
+
+	// nodes join over mutual TLS too
+	replica := newTestNode("replica", []*testNode{leader})
+	o = opts(replica.id)
+	o.Role = proto.RoleReplica
+	o.Seeds = []string{leader.server.ListenAddr}
+	startTestNode(t, replica, nil, o)
+	assert.Eventually(t, func() bool {
+		return suffrage(t, leader, replica.id) == raft.Nonvoter
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestACL(t *testing.T) {
+	ctx := context.Background()
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	admin := dialNode(t, leader)
+
+	// the first user must be able to manage the others
+	assert.NotNil(t, admin.SetUser(ctx, "app", client.UserOptions{Password: "p", Perms: acl.PermRead}))
+	assert.Nil(t, admin.SetUser(ctx, "root", client.UserOptions{Token: "root-token", Perms: acl.PermAll}))
+	// the connection that created it has no user yet
+	assert.Equal(t, client.ErrUnauthorized, admin.SetUser(ctx, "app", client.UserOptions{}))
+	assert.Nil(t, admin.AuthToken(ctx, "root-token"))
+	assert.Nil(t, admin.SetUser(ctx, "app", client.UserOptions{
+		Password: "p",
+		Perms:    acl.PermRead | acl.PermWrite,
+		Keys:     []string{"app:*"},
+	}))
+	users, err := admin.Users(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+
+	anon := dialNode(t, leader)
+	assert.NotNil(t, anon.Set(ctx, []byte("app:1"), []byte("v")))
+	assert.Equal(t, client.ErrUnauthorized, anon.Auth(ctx, "app", "wrong"))
+
+	app, err := client.New(leader.server.ListenAddr, client.Options{Username: "app", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	assert.Nil(t, app.Set(ctx, []byte("app:1"), []byte("v")))
+	assert.NotNil(t, app.Set(ctx, []byte("other"), []byte("v")))
+	assert.Equal(t, client.ErrUnauthorized, app.Flush(ctx, ""))
+	// scripts reach any key whatever they declare
+	_, err = app.Eval(ctx, `(set "other" "v")`, [][]byte{[]byte("app:1")})
+	assert.Equal(t, client.ErrUnauthorized, err)
+	_, err = admin.Get(ctx, []byte("other"))
+	assert.NotNil(t, err)
+
+	// a user restricted to namespaces may only select those
+	assert.Nil(t, admin.SetUser(ctx, "tenant", client.UserOptions{
+		Password:   "p",
+		Perms:      acl.PermRead | acl.PermWrite,
+		Namespaces: []string{"tenant"},
+	}))
+	tenant, err := client.New(leader.server.ListenAddr, client.Options{Username: "tenant", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.Close()
+	assert.Nil(t, tenant.Select(ctx, "tenant"))
+	assert.Nil(t, tenant.Set(ctx, []byte("k"), []byte("v")))
+	assert.Equal(t, client.ErrUnauthorized, tenant.Select(ctx, "other"))
+	assert.Equal(t, client.ErrUnauthorized, tenant.Select(ctx, ""))
+
+	// followers enforce the same rules
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	assert.Eventually(t, func() bool {
+		_, ok := follower.server.users.Get("app")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	c := dialNode(t, follower)
+	_, err = c.Get(ctx, []byte("app:1"))
+	assert.NotNil(t, err)
+	assert.Nil(t, c.Auth(ctx, "app", "p"))
+	assert.Eventually(t, func() bool {
+		v, err := c.Get(ctx, []byte("app:1"))
+		return err == nil && string(v) == "v"
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = c.Members(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, c.RemoveNode(ctx, leader.id))
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.New(audit.Options{Path: path, Values: audit.ValuesFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := newTestNode("node1", nil)
+	startTestNode(t, node, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(node.id), Address: node.addr},
+	}}, ServerOpts{IsLeader: true, Audit: auditLog})
+	waitLeader(t, []*testNode{node})
+
+	c := dialNode(t, node)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+	_, err = c.Get(ctx, []byte("k"))
+	assert.Nil(t, err)
+	assert.Nil(t, c.SetUser(ctx, "root", client.UserOptions{Token: "t", Perms: acl.PermAll}))
+	assert.NotNil(t, c.Delete(ctx, []byte("k")))
+	assert.Nil(t, c.AuthToken(ctx, "t"))
+	assert.Nil(t, c.Delete(ctx, []byte("k")))
+
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var e audit.Entry
+		assert.Nil(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+	// GET is not audited
+	if assert.Len(t, entries, 5) {
+		assert.Equal(t, "SET", entries[0].Command)
+		assert.Equal(t, []string{"k"}, entries[0].Keys)
+		assert.Equal(t, "v", entries[0].Value)
+		assert.Equal(t, "OK", entries[0].Status)
+		assert.NotZero(t, entries[0].Index)
+		assert.Equal(t, "ACLSETUSER", entries[1].Command)
+		assert.Equal(t, "DEL", entries[2].Command)
+		assert.Equal(t, "UNAUTHORIZED", entries[2].Status)
+		assert.Zero(t, entries[2].Index)
+		assert.Equal(t, "AUTH", entries[3].Command)
+		assert.Equal(t, "DEL", entries[4].Command)
+		assert.Equal(t, "root", entries[4].Principal)
+		assert.Greater(t, entries[4].Index, entries[0].Index)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	node := newTestNode("node1", nil)
+	startTestNode(t, node, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(node.id), Address: node.addr},
+	}}, ServerOpts{IsLeader: true})
+	waitLeader(t, []*testNode{node})
+
+	c := dialNode(t, node)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+	_, err := c.Get(ctx, []byte("missing"))
+	assert.NotNil(t, err)
+
+	body := getHTTP(node, "/metrics").Body.String()
+	assert.Contains(t, body, `y3cache_commands_total{command="SET",status="OK"} 1`)
+	assert.Contains(t, body, `y3cache_commands_total{command="GET",status="KEYNOTFOUND"} 1`)
+	assert.Contains(t, body, `y3cache_command_duration_seconds_count{command="SET",status="OK"} 1`)
+	assert.Contains(t, body, "y3cache_connections 1")
+	assert.Contains(t, body, `y3cache_keys{namespace="default"} 1`)
+	assert.Contains(t, body, `y3cache_raft_state{state="Leader"} 1`)
+	assert.Contains(t, body, "y3cache_raft_last_contact_seconds 0")
+	assert.Regexp(t, `y3cache_raft_applied_index [1-9]`, body)
+}
+
+func TestLogging(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zapcore.DebugLevel)
+	node := newTestNode("node1", nil)
+	startTestNode(t, node, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(node.id), Address: node.addr},
+	}}, ServerOpts{IsLeader: true, Logger: zap.New(core)})
+	waitLeader(t, []*testNode{node})
+
+	c := dialNode(t, node)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("secret-value")))
+
+	handled := logs.FilterMessage("command handled").AllUntimed()
+	if assert.Len(t, handled, 1) {
+		fields := handled[0].ContextMap()
+		assert.Equal(t, "SET", fields[logging.FieldCmd])
+		assert.Equal(t, logging.HashKey([]byte("k")), fields[logging.FieldKeyHash])
+		assert.Equal(t, "OK", fields["status"])
+		assert.NotZero(t, fields[logging.FieldConn])
+	}
+	assert.Len(t, logs.FilterMessage("command applied").AllUntimed(), 1)
+	for _, e := range logs.AllUntimed() {
+		assert.NotContains(t, fmt.Sprint(e.Message, e.ContextMap()), "secret-value")
+	}
+}
+
+func getHTTP(n *testNode, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	n.server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestHealth(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	for _, n := range nodes {
+		n := n
+		assert.Equal(t, http.StatusOK, getHTTP(n, "/healthz").Code)
+		assert.Eventually(t, func() bool {
+			return getHTTP(n, "/readyz").Code == http.StatusOK
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	rec := getHTTP(follower, "/status")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var st nodeStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &st))
+	assert.Equal(t, follower.id, st.NodeID)
+	assert.Equal(t, "voter", st.Role)
+	assert.Equal(t, "Follower", st.State)
+	assert.Equal(t, leader.id, st.Leader)
+	assert.NotZero(t, st.Term)
+	if assert.Len(t, st.Peers, 3) {
+		for _, p := range st.Peers {
+			assert.Equal(t, "Voter", p.Suffrage)
+			assert.Equal(t, p.NodeID == leader.id, p.Leader)
+		}
+	}
+	assert.Nil(t, json.Unmarshal(getHTTP(leader, "/status").Body.Bytes(), &st))
+	assert.Equal(t, "leader", st.Role)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	follower.server.Shutdown(ctx)
+	rec = getHTTP(follower, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "not accepting connections")
+	assert.Equal(t, http.StatusOK, getHTTP(follower, "/healthz").Code)
+}
+
+func TestSlowlog(t *testing.T) {
+	ctx := context.Background()
+	node := newTestNode("node1", nil)
+	startTestNode(t, node, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(node.id), Address: node.addr},
+	}}, ServerOpts{
+		IsLeader:     true,
+		Slowlog:      slowlog.New(8, time.Nanosecond),
+		ApplyTimings: fsm.NewTimings(16),
+	})
+	waitLeader(t, []*testNode{node})
+
+	c := dialNode(t, node)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+	_, err := c.Get(ctx, []byte("k"))
+	assert.Nil(t, err)
+
+	entries, err := c.Slowlog(ctx, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		get, set := entries[0], entries[1]
+		assert.Equal(t, "GET", string(get.Command))
+		assert.Greater(t, get.ID, set.ID)
+		assert.Zero(t, get.Raft)
+		assert.Greater(t, get.Exec, int64(0))
+		assert.Equal(t, "SET", string(set.Command))
+		assert.Equal(t, "default", string(set.Namespace))
+		assert.NotEmpty(t, set.Remote)
+		assert.Greater(t, set.Raft, int64(0))
+		assert.Greater(t, set.FSM, int64(0))
+		assert.Zero(t, set.Exec)
+		assert.Greater(t, set.Write, int64(0))
+	}
+	latest, err := c.Slowlog(ctx, 1)
+	assert.Nil(t, err)
+	assert.Len(t, latest, 1)
+
+	assert.Nil(t, c.SlowlogReset(ctx))
+	entries, err = c.Slowlog(ctx, 0)
+	assert.Nil(t, err)
+	// the reset itself was slow enough
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "SLOWLOG", string(entries[0].Command))
+	}
+	body := getHTTP(node, "/metrics").Body.String()
+	assert.Contains(t, body, `y3cache_command_span_seconds_count{command="SET",span="raft"} 1`)
+}
+
+func TestTrace(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	exporter, err := trace.NewFileExporter(path)
+	assert.Nil(t, err)
+	node := newTestNode("node1", nil)
+	startTestNode(t, node, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(node.id), Address: node.addr},
+	}}, ServerOpts{
+		IsLeader:     true,
+		ApplyTimings: fsm.NewTimings(16),
+		Tracer:       trace.NewTracer("y3cache", exporter),
+	})
+	waitLeader(t, []*testNode{node})
+
+	c := dialNode(t, node)
+	_, err = c.Get(ctx, []byte("k"))
+	assert.NotNil(t, err)
+	parent, err := trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=1")
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set(trace.ContextWith(ctx, parent), []byte("k"), []byte("v")))
+
+	var spans []trace.Span
+	assert.Eventually(t, func() bool {
+		spans = spans[:0]
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var sp trace.Span
+			if json.Unmarshal([]byte(line), &sp) == nil {
+				spans = append(spans, sp)
+			}
+		}
+		return len(spans) == 3
+	}, time.Second, 10*time.Millisecond)
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	byName := map[string]trace.Span{}
+	for _, sp := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sp.TraceID)
+		assert.Equal(t, "vendor=1", sp.State)
+		byName[sp.Name] = sp
+	}
+	set, apply, exec := byName["SET"], byName["raft.apply"], byName["fsm.apply"]
+	assert.Equal(t, "00f067aa0ba902b7", set.ParentID)
+	assert.Equal(t, set.SpanID, apply.ParentID)
+	assert.Equal(t, apply.SpanID, exec.ParentID)
+	assert.Equal(t, "OK", set.Attributes["status"])
+	assert.Equal(t, logging.HashKey([]byte("k")), set.Attributes[logging.FieldKeyHash])
+	assert.NotEmpty(t, exec.Attributes[logging.FieldRaftIndex])
+	assert.False(t, exec.Start.Before(apply.Start))
+	assert.False(t, exec.End.After(apply.End))
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestNode("node1", nil)
+	startTestNode(t, leader, &raft.Configuration{Servers: []raft.Server{
+		{ID: raft.ServerID(leader.id), Address: leader.addr},
+	}}, ServerOpts{IsLeader: true, AdvertiseAddr: "localhost"})
+	waitLeader(t, []*testNode{leader})
+
+	follower := newTestNode("node2", []*testNode{leader})
+	startTestNode(t, follower, nil, ServerOpts{
+		Seeds:         []string{leader.server.ListenAddr},
+		AdvertiseAddr: "localhost",
+	})
+	assert.Eventually(t, func() bool {
+		m, ok := follower.server.cluster.Get(leader.id)
+		return ok && m.ClientAddress == leader.server.AdvertiseAddr
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, strings.HasPrefix(leader.server.AdvertiseAddr, "localhost:"))
+
+	members, err := dialNode(t, leader).Members(ctx)
+	assert.Nil(t, err)
+	addrs := map[string]string{}
+	for _, m := range members {
+		addrs[string(m.NodeId)] = string(m.ClientAddress)
+	}
+	assert.Equal(t, follower.server.AdvertiseAddr, addrs[follower.id])
+
+	// the follower forwards to the advertised address of the leader
+	c := dialNode(t, follower)
+	assert.Nil(t, c.DemoteNode(ctx, follower.id))
+	assert.Equal(t, raft.Nonvoter, suffrage(t, leader, follower.id))
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	ctx := context.Background()
+	leader := waitLeader(t, newTestCluster(t, 1))
+	c := dialNode(t, leader)
+	sub, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription is registered once a message gets through
+	assert.Eventually(t, func() bool {
+		assert.Nil(t, c.Publish(ctx, "news", []byte("1")))
+		select {
+		case <-sub.C:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+
+	// nobody reads the next messages, Close still ends the subscription
+	// and drops them
+	assert.Nil(t, c.Publish(ctx, "news", []byte("2")))
+	time.Sleep(50 * time.Millisecond)
+	sub.Close()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case m, ok := <-sub.C:
+		assert.False(t, ok, "got %v", m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription still open")
+	}
+}
+
+func TestSubscribedConnection(t *testing.T) {
+	leader := waitLeader(t, newTestCluster(t, 1))
+	conn, err := net.Dial("tcp", leader.server.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write((&proto.CommandSubscribe{Channels: [][]byte{[]byte("news")}}).Bytes())
+	conn.Write((&proto.CommandGet{Key: []byte("k")}).Bytes())
+
+	m, err := proto.ParseMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, proto.MessageSubscribe, m.Kind)
+	// anything else is refused and the connection closed
+	m, err = proto.ParseMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, proto.MessageError, m.Kind)
+	_, err = proto.ParseMessage(conn)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNamespaceConfigRefused(t *testing.T) {
+	ctx := context.Background()
+	leader := waitLeader(t, newTestCluster(t, 1))
+	c := dialNode(t, leader)
+	assert.Nil(t, c.ConfigureNamespace(ctx, "app", client.NamespaceOptions{MaxKeys: 10}))
+
+	// invalid limits never reach the log
+	index := leader.server.raft.LastIndex()
+	for _, opts := range []client.NamespaceOptions{
+		{Policy: cache.EvictionPolicy(9)},
+		{MaxKeys: -1},
+		{MaxMemory: -1},
+	} {
+		assert.NotNil(t, c.ConfigureNamespace(ctx, "app", opts))
+	}
+	assert.Equal(t, index, leader.server.raft.LastIndex())
+}
+
+func TestScriptRefused(t *testing.T) {
+	ctx := context.Background()
+	leader := waitLeader(t, newTestCluster(t, 1))
+	c := dialNode(t, leader)
+	assert.Nil(t, c.Set(ctx, []byte("k"), []byte("v")))
+
+	// a script that does not compile never reaches the log
+	index := leader.server.raft.LastIndex()
+	_, err := c.Eval(ctx, `(list "a"`, nil)
+	assert.ErrorContains(t, err, "missing )")
+	_, err = c.ScriptLoad(ctx, `)`)
+	assert.NotNil(t, err)
+	assert.Equal(t, index, leader.server.raft.LastIndex())
+
+	values, err := c.Eval(ctx, `(get "k")`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("v")}, values)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"y3cache/logging"
+	"y3cache/trace"
+)
+
+// traceParent reads the trace context a command was sent with, commands
+// with an invalid one are run untraced.
+func traceParent(logger *zap.SugaredLogger, traceparent, tracestate []byte) trace.SpanContext {
+	sc, err := trace.Parse(string(traceparent), string(tracestate))
+	if err != nil {
+		logger.Debugw("ignoring trace context", "traceparent", string(traceparent), "error", err)
+	}
+	return sc
+}
+
+// exportSpans exports the span of a traced command from start to done,
+// with a raft.apply span for the wait on its raft entry and an fsm.apply
+// span for applying it on this node.
+func (s *Server) exportSpans(parent trace.SpanContext, ns string, cmd any, conn *replyConn, start, done time.Time) {
+	if s.Tracer == nil || !parent.IsValid() {
+		return
+	}
+	name := commandName(cmd)
+	attrs := map[string]string{
+		logging.FieldNode: s.NodeID,
+		logging.FieldCmd:  name,
+		"namespace":       ns,
+		"status":          conn.status.String(),
+	}
+	index := conn.index.Load()
+	if index != 0 {
+		attrs[logging.FieldRaftIndex] = strconv.FormatUint(index, 10)
+	}
+	if _, _, keys := access(ns, cmd); len(keys) == 1 {
+		attrs[logging.FieldKeyHash] = logging.HashKey(keys[0])
+	}
+	export := func(parent trace.SpanContext, name string, start, end time.Time, attrs map[string]string) trace.SpanContext {
+		sc, err := s.Tracer.Export(parent, name, start, end, attrs)
+		if err != nil {
+			conn.logger.Warnw("exporting span failed", "span", name, "error", err)
+		}
+		return sc
+	}
+	cmdSpan := export(parent, name, start, done, attrs)
+	if index == 0 || conn.applied.IsZero() {
+		return
+	}
+	raftSpan := export(cmdSpan, "raft.apply", start, conn.applied, map[string]string{
+		logging.FieldRaftIndex: attrs[logging.FieldRaftIndex],
+	})
+	if fsmStart, took, ok := s.ApplyTimings.Get(index); ok {
+		export(raftSpan, "fsm.apply", fsmStart, fsmStart.Add(took), map[string]string{
+			logging.FieldRaftIndex: attrs[logging.FieldRaftIndex],
+		})
+	}
+}
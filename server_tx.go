@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+
+	"y3cache/proto"
+)
+
+// handleWatchCommand answers from the local cache, a stale version only
+// makes the transaction abort.
+func (s *Server) handleWatchCommand(conn net.Conn, ns string, cmd *proto.CommandWatch) error {
+	resp := &proto.ResponseWatch{
+		Status:   proto.StatusOK,
+		Versions: make([]uint64, len(cmd.Keys)),
+	}
+	if c, ok := s.spaces.Get(ns); ok {
+		for i, key := range cmd.Keys {
+			resp.Versions[i] = c.Version(key)
+		}
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
+
+func (s *Server) handleExecCommand(conn net.Conn, ns string, cmd *proto.CommandExec) error {
+	applyFuture := s.apply(ns, cmd)
+	resp := &proto.ResponseExec{Status: proto.StatusError}
+	if err := applyFuture.Error(); err != nil {
+		s.log(conn).Warnw("error applying transaction", "error", err)
+	} else if r, ok := applyFuture.Response().(*proto.ResponseExec); ok {
+		recordIndex(conn, applyFuture.Index())
+		resp = r
+	}
+	_, err := conn.Write(resp.Bytes())
+	return err
+}
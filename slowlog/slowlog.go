@@ -0,0 +1,116 @@
+// Package slowlog keeps the last commands that ran over a threshold, with
+// where their time went.
+package slowlog
+
+import (
+	"sync"
+	"time"
+)
+
+// Spans split the time of a command. Raft is the wait for the entry to be
+// committed and applied, FSM excluded, and Exec the local work of commands
+// that are not replicated.
+type Spans struct {
+	Parse time.Duration
+	Queue time.Duration
+	Raft  time.Duration
+	FSM   time.Duration
+	Exec  time.Duration
+	Write time.Duration
+}
+
+// Total is the time from the first byte read to the last byte written.
+func (s Spans) Total() time.Duration {
+	return s.Parse + s.Queue + s.Raft + s.FSM + s.Exec + s.Write
+}
+
+type Entry struct {
+	// ID increases with every entry, it is not reset with the log
+	ID        uint64
+	Time      time.Time
+	Command   string
+	Namespace string
+	Remote    string
+	Spans     Spans
+}
+
+func (e Entry) Duration() time.Duration {
+	return e.Spans.Total()
+}
+
+// Log is a ring buffer of the entries over Threshold.
+type Log struct {
+	lock      sync.Mutex
+	threshold time.Duration
+	entries   []Entry
+	next      int
+	full      bool
+	seq       uint64
+}
+
+// New keeps up to size entries of commands that took threshold or more,
+// a zero threshold records nothing.
+func New(size int, threshold time.Duration) *Log {
+	if size <= 0 {
+		size = 1
+	}
+	return &Log{entries: make([]Entry, size), threshold: threshold}
+}
+
+func (l *Log) Threshold() time.Duration {
+	return l.threshold
+}
+
+// Record adds e when it took Threshold or more, and tells whether it did.
+func (l *Log) Record(e Entry) bool {
+	if l.threshold <= 0 || e.Duration() < l.threshold {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.seq++
+	e.ID = l.seq
+	l.entries[l.next] = e
+	if l.next++; l.next == len(l.entries) {
+		l.next, l.full = 0, true
+	}
+	return true
+}
+
+// Entries returns the n most recent entries, newest first, every one of
+// them when n is zero.
+func (l *Log) Entries(n int) []Entry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	size := l.next
+	if l.full {
+		size = len(l.entries)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	out := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+func (l *Log) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.full {
+		return len(l.entries)
+	}
+	return l.next
+}
+
+// Reset empties the log, IDs keep increasing.
+func (l *Log) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.entries {
+		l.entries[i] = Entry{}
+	}
+	l.next, l.full = 0, false
+}
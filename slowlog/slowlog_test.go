@@ -0,0 +1,51 @@
+package slowlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func entry(cmd string, d time.Duration) Entry {
+	return Entry{Command: cmd, Spans: Spans{Raft: d}}
+}
+
+func TestThreshold(t *testing.T) {
+	l := New(4, 10*time.Millisecond)
+	assert.False(t, l.Record(entry("GET", time.Millisecond)))
+	assert.True(t, l.Record(entry("SET", 10*time.Millisecond)))
+	assert.Equal(t, 1, l.Len())
+
+	off := New(4, 0)
+	assert.False(t, off.Record(entry("SET", time.Second)))
+	assert.Zero(t, off.Len())
+}
+
+func TestRing(t *testing.T) {
+	l := New(3, time.Millisecond)
+	for _, cmd := range []string{"A", "B", "C", "D", "E"} {
+		l.Record(entry(cmd, time.Second))
+	}
+	assert.Equal(t, 3, l.Len())
+	entries := l.Entries(0)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "E", entries[0].Command)
+		assert.Equal(t, uint64(5), entries[0].ID)
+		assert.Equal(t, "C", entries[2].Command)
+	}
+	if latest := l.Entries(1); assert.Len(t, latest, 1) {
+		assert.Equal(t, "E", latest[0].Command)
+	}
+
+	l.Reset()
+	assert.Zero(t, l.Len())
+	assert.Empty(t, l.Entries(0))
+	l.Record(entry("F", time.Second))
+	assert.Equal(t, uint64(6), l.Entries(0)[0].ID)
+}
+
+func TestSpans(t *testing.T) {
+	s := Spans{Parse: 1, Queue: 2, Raft: 3, FSM: 4, Exec: 5, Write: 6}
+	assert.Equal(t, time.Duration(21), s.Total())
+}
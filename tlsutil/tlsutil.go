@@ -0,0 +1,135 @@
+// Package tlsutil builds the TLS configurations shared by the client
+// protocol and the raft transport.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Config points at PEM files. Nodes use one certificate both as server and
+// as client, so it must allow both usages.
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the peers, the system pool is used when empty
+	CAFile string
+	// VerifyClients requires clients to present a certificate signed by
+	// the CA (mutual TLS)
+	VerifyClients bool
+}
+
+// Enabled tells whether TLS is configured at all.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c Config) load() ([]tls.Certificate, *x509.CertPool, error) {
+	var certs []tls.Certificate
+	if c.Enabled() {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	if c.CAFile == "" {
+		return certs, nil, nil
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read ca: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+	}
+	return certs, pool, nil
+}
+
+// Server returns the configuration of a listener, nil when TLS is not
+// enabled.
+func (c Config) Server() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	certs, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return ServerConfig(certs[0], pool, c.VerifyClients), nil
+}
+
+// Client returns the configuration used to dial nodes, presenting the
+// certificate when there is one. nil when TLS is not enabled.
+func (c Config) Client() (*tls.Config, error) {
+	if !c.Enabled() && c.CAFile == "" {
+		return nil, nil
+	}
+	certs, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: certs,
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ServerConfig serves cert, client certificates are verified against pool
+// when given and required with verifyClients.
+func ServerConfig(cert tls.Certificate, pool *x509.CertPool, verifyClients bool) *tls.Config {
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch {
+	case verifyClients:
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	case pool != nil:
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf
+}
+
+// Identity returns the common name of the verified certificate the peer of
+// conn presented, or "" for plain connections and peers without one. It
+// completes the handshake if needed.
+func Identity(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", nil
+	}
+	cert := chains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], nil
+	}
+	return "", errors.New("certificate carries no identity")
+}
+
+// ForAddr returns conf fit to dial addr, ":port" addresses point at the
+// local host and are verified as localhost.
+func ForAddr(conf *tls.Config, addr string) *tls.Config {
+	if host, _, _ := net.SplitHostPort(addr); host != "" || conf.ServerName != "" {
+		return conf
+	}
+	conf = conf.Clone()
+	conf.ServerName = "localhost"
+	return conf
+}
@@ -0,0 +1,139 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve accepts one connection on a local listener and sends the identity
+// of its client, or the handshake error.
+func serve(t *testing.T, conf *tls.Config) (string, <-chan any) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan any, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			out <- err
+			return
+		}
+		defer conn.Close()
+		id, err := Identity(conn)
+		if err != nil {
+			out <- err
+			return
+		}
+		out <- id
+		conn.Write([]byte{1})
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, err := NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.Issue("node1", "127.0.0.1", "localhost")
+	assert.Nil(t, err)
+	clientCert, err := ca.Issue("app")
+	assert.Nil(t, err)
+	conf := ServerConfig(serverCert, ca.Pool(), true)
+
+	addr, out := serve(t, conf)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      ca.Pool(),
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "app", <-out)
+	// the client verified the server as well
+	id, err := Identity(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", id)
+
+	// without a client certificate the handshake fails
+	addr, out = serve(t, conf)
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.Pool()})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+	assert.Error(t, (<-out).(error))
+
+	// nor with one from another CA
+	other, err := NewCA("other-ca")
+	assert.Nil(t, err)
+	rogue, err := other.Issue("app")
+	assert.Nil(t, err)
+	addr, out = serve(t, conf)
+	conn, err = tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      ca.Pool(),
+		Certificates: []tls.Certificate{rogue},
+	})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+	assert.Error(t, (<-out).(error))
+
+	// plain connections carry no identity
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	id, err = Identity(a)
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+}
+
+func TestConfigFiles(t *testing.T) {
+	ca, err := NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue("node1", "localhost")
+	assert.Nil(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	conf := Config{
+		CertFile:      filepath.Join(dir, "cert.pem"),
+		KeyFile:       filepath.Join(dir, "key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		VerifyClients: true,
+	}
+	os.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(conf.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	os.WriteFile(conf.CAFile, ca.PEM(), 0600)
+
+	server, err := conf.Server()
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, server.ClientAuth)
+	client, err := conf.Client()
+	assert.Nil(t, err)
+	assert.Len(t, client.Certificates, 1)
+
+	disabled, err := Config{}.Server()
+	assert.Nil(t, err)
+	assert.Nil(t, disabled)
+
+	conf.CAFile = conf.KeyFile
+	_, err = conf.Server()
+	assert.NotNil(t, err)
+}
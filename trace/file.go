@@ -0,0 +1,34 @@
+package trace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileExporter appends one JSON line per span to a file.
+type FileExporter struct {
+	lock sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *FileExporter) Export(s Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(s)
+}
+
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.f.Close()
+}
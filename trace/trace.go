@@ -0,0 +1,163 @@
+// Package trace carries W3C trace context (traceparent and tracestate)
+// through the protocol and exports the spans the server creates for it.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalid = errors.New("invalid traceparent")
+
+// SpanContext identifies a span across services, see
+// https://www.w3.org/TR/trace-context/.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	// State is the tracestate header, carried along untouched
+	State string
+}
+
+const flagSampled = 0x01
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// TraceIDHex is the trace id as it appears in traceparent.
+func (sc SpanContext) TraceIDHex() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf(
+		"00-%s-%s-%02x",
+		sc.TraceIDHex(),
+		hex.EncodeToString(sc.SpanID[:]),
+		sc.Flags,
+	)
+}
+
+// Parse reads a traceparent header and its tracestate, which may be
+// empty. Versions above 00 are read as 00, as the spec asks.
+func Parse(traceparent, tracestate string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalid
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return sc, ErrInvalid
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != 16 || len(parts[1]) != 32 {
+		return sc, ErrInvalid
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != 8 || len(parts[2]) != 16 {
+		return sc, ErrInvalid
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, ErrInvalid
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalid
+	}
+	sc.State = tracestate
+	return sc, nil
+}
+
+// NewSpanID returns a random span id.
+func NewSpanID() [8]byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return id
+}
+
+type contextKey struct{}
+
+// ContextWith returns ctx carrying sc, which the client sends along with
+// the commands run with ctx.
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context ctx carries, false when none.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Span is a finished span, as exported.
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Service    string            `json:"service"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	State      string            `json:"tracestate,omitempty"`
+}
+
+// Exporter receives the spans of the server once they ended.
+type Exporter interface {
+	Export(Span) error
+	Close() error
+}
+
+// Tracer creates the spans of a service and exports them, the spans of
+// unsampled traces are not created.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// Export records a span named name child of parent, from start to end,
+// and returns its context for the spans below it. Nothing is exported
+// for a nil tracer or an unsampled parent.
+func (t *Tracer) Export(parent SpanContext, name string, start, end time.Time, attrs map[string]string) (SpanContext, error) {
+	child := parent
+	child.SpanID = NewSpanID()
+	if t == nil || !parent.IsValid() || !parent.Sampled() {
+		return child, nil
+	}
+	return child, t.exporter.Export(Span{
+		TraceID:    parent.TraceIDHex(),
+		SpanID:     hex.EncodeToString(child.SpanID[:]),
+		ParentID:   hex.EncodeToString(parent.SpanID[:]),
+		Name:       name,
+		Service:    t.service,
+		Start:      start,
+		End:        end,
+		Attributes: attrs,
+		State:      parent.State,
+	})
+}
+
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Close()
+}
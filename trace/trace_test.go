@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParse(t *testing.T) {
+	sc, err := Parse(parent, "vendor=1")
+	assert.Nil(t, err)
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "vendor=1", sc.State)
+	assert.Equal(t, parent, sc.Traceparent())
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := Parse(bad, "")
+		assert.ErrorIs(t, err, ErrInvalid, bad)
+	}
+	// later versions may append fields
+	_, err = Parse("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", "")
+	assert.Nil(t, err)
+}
+
+func TestContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+	sc, _ := Parse(parent, "")
+	got, ok := FromContext(ContextWith(context.Background(), sc))
+	assert.True(t, ok)
+	assert.Equal(t, sc, got)
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("y3cache", exporter)
+
+	sc, _ := Parse(parent, "")
+	start := time.Now()
+	child, err := tracer.Export(sc, "SET", start, start.Add(time.Millisecond), map[string]string{"cmd": "SET"})
+	assert.Nil(t, err)
+	assert.Equal(t, sc.TraceID, child.TraceID)
+	assert.NotEqual(t, sc.SpanID, child.SpanID)
+	_, err = tracer.Export(child, "raft.apply", start, start, nil)
+	assert.Nil(t, err)
+
+	unsampled := sc
+	unsampled.Flags = 0
+	_, err = tracer.Export(unsampled, "GET", start, start, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, tracer.Close())
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var spans []Span
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var s Span
+		assert.Nil(t, json.Unmarshal(sc.Bytes(), &s))
+		spans = append(spans, s)
+	}
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID)
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].ParentID)
+		assert.Equal(t, "SET", spans[0].Attributes["cmd"])
+		assert.Equal(t, spans[0].SpanID, spans[1].ParentID)
+		assert.Equal(t, "raft.apply", spans[1].Name)
+	}
+}